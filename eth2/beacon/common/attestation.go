@@ -0,0 +1,68 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CommitteeBits marks the members of a committee, e.g. the aggregation bits of an attestation.
+type CommitteeBits interface {
+	BitLen() uint64
+	GetBit(i uint64) bool
+}
+
+// AttestationEnvelope is the fork-agnostic content of an attestation, as used by the forkchoice.
+// It is either indexed, with the attesting indices, or aggregated, with bits of the beacon committee.
+type AttestationEnvelope struct {
+	Slot            Slot
+	CommitteeIndex  CommitteeIndex
+	BeaconBlockRoot Root
+	Source          Checkpoint
+	Target          Checkpoint
+
+	// Attesting indices of an indexed attestation, nil if the attestation is aggregated.
+	AttestingIndices []ValidatorIndex
+	// Aggregation bits of the beacon committee of an aggregated attestation, nil if the attestation is indexed.
+	AggregationBits CommitteeBits
+}
+
+// Indexed returns true if the attesting indices are known without the committee.
+func (a *AttestationEnvelope) Indexed() bool {
+	return a.AggregationBits == nil
+}
+
+// Indices returns the sorted attesting indices.
+// The beacon committee of the attestation is only used if the attestation is not indexed.
+func (a *AttestationEnvelope) Indices(committee []ValidatorIndex) ([]ValidatorIndex, error) {
+	if a.Indexed() {
+		return a.AttestingIndices, nil
+	}
+	bitLen := a.AggregationBits.BitLen()
+	if uint64(len(committee)) != bitLen {
+		return nil, fmt.Errorf("committee size does not match bits size: %d <> %d", len(committee), bitLen)
+	}
+	participants := make([]ValidatorIndex, 0, len(committee))
+	for i := uint64(0); i < bitLen; i++ {
+		if a.AggregationBits.GetBit(i) {
+			participants = append(participants, committee[i])
+		}
+	}
+	sort.Slice(participants, func(i int, j int) bool {
+		return participants[i] < participants[j]
+	})
+	return participants, nil
+}
+
+// IsSlashable checks if the attestation data of a and b conflicts:
+// a double vote (different data, same target epoch), or a surrounding b.
+func (a *AttestationEnvelope) IsSlashable(b *AttestationEnvelope) bool {
+	sameData := a.Slot == b.Slot && a.CommitteeIndex == b.CommitteeIndex &&
+		a.BeaconBlockRoot == b.BeaconBlockRoot && a.Source == b.Source && a.Target == b.Target
+	doubleVote := !sameData && a.Target.Epoch == b.Target.Epoch
+	surroundVote := a.Source.Epoch < b.Source.Epoch && a.Target.Epoch > b.Target.Epoch
+	return doubleVote || surroundVote
+}
+
+type AttestationEnvelopeBuilder interface {
+	AttestationEnvelope() *AttestationEnvelope
+}
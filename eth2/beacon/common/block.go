@@ -2,7 +2,6 @@ package common
 
 import (
 	"bytes"
-	blsu "github.com/protolambda/bls12-381-util"
 )
 
 type BeaconBlockEnvelope struct {
@@ -30,6 +29,12 @@ func (b *BeaconBlockEnvelope) VerifySignature(spec *Spec, genesisValidatorsRoot
 }
 
 func (b *BeaconBlockEnvelope) VerifySignatureVersioned(spec *Spec, version Version, genesisValidatorsRoot Root, proposer ValidatorIndex, cachedPub *CachedPubkey) bool {
+	return b.VerifySignatureBatched(spec, version, genesisValidatorsRoot, proposer, cachedPub, nil)
+}
+
+// VerifySignatureBatched verifies the block signature like VerifySignatureVersioned,
+// or adds the signature to the batch to verify later, if the batch is not nil.
+func (b *BeaconBlockEnvelope) VerifySignatureBatched(spec *Spec, version Version, genesisValidatorsRoot Root, proposer ValidatorIndex, cachedPub *CachedPubkey, batch *SignatureBatch) bool {
 	if b.ProposerIndex != proposer {
 		return false
 	}
@@ -48,7 +53,7 @@ func (b *BeaconBlockEnvelope) VerifySignatureVersioned(spec *Spec, version Versi
 	if err != nil {
 		return false
 	}
-	return blsu.Verify(pub, signingRoot[:], sig)
+	return batch.Verify(pub, signingRoot[:], sig)
 }
 
 type EnvelopeBuilder interface {
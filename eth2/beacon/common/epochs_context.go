@@ -66,6 +66,10 @@ type EpochsContext struct {
 	TotalActiveStake Gwei
 	// cached integer square root of TotalActiveStake
 	TotalActiveStakeSqRoot Gwei
+
+	// SignatureBatch, if not nil, collects the signatures of block processing, to verify later in one batch.
+	// The batch is copied along with the context: unset it before the context is reused.
+	SignatureBatch *SignatureBatch
 }
 
 // NewEpochsContext constructs a new context for the processing of the current epoch.
@@ -146,6 +150,23 @@ func (epc *EpochsContext) LoadShuffling(state BeaconState) error {
 	return nil
 }
 
+// LoadCurrentStake loads the effective balances and total active stake of the current epoch.
+// The current epoch shuffling must be loaded already.
+func (epc *EpochsContext) LoadCurrentStake(state BeaconState) error {
+	if epc.CurrentEpoch == nil {
+		return fmt.Errorf("current epoch shuffling must be loaded before the stake")
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return err
+	}
+	indicesBounded, err := LoadBoundedIndices(vals)
+	if err != nil {
+		return err
+	}
+	return epc.loadCurrentStake(state, indicesBounded)
+}
+
 func (epc *EpochsContext) loadCurrentStake(state BeaconState, indicesBounded []BoundedIndex) error {
 	epc.EffectiveBalances = make([]Gwei, len(indicesBounded), len(indicesBounded))
 	epc.TotalActiveStake = 0
@@ -217,9 +217,9 @@ func AsCheckPoint(v View, err error) (*CheckpointView, error) {
 }
 
 type NodeRef struct {
-	Slot Slot
+	Slot Slot `json:"slot" yaml:"slot"`
 	// Block root, may be equal to parent root if empty
-	Root Root
+	Root Root `json:"root" yaml:"root"`
 }
 
 func (n NodeRef) String() string {
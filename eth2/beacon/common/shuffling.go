@@ -85,20 +85,27 @@ func ActiveIndices(indicesBounded []BoundedIndex, epoch Epoch) []ValidatorIndex
 }
 
 func NewShufflingEpoch(spec *Spec, indicesBounded []BoundedIndex, seed Root, epoch Epoch) *ShufflingEpoch {
-	shep := &ShufflingEpoch{
-		Epoch: epoch,
-	}
-
-	shep.ActiveIndices = ActiveIndices(indicesBounded, epoch)
+	activeIndices := ActiveIndices(indicesBounded, epoch)
 
 	// Copy over the active indices, then get the shuffling of them
-	shep.Shuffling = make([]ValidatorIndex, len(shep.ActiveIndices), len(shep.ActiveIndices))
-	for i, v := range shep.ActiveIndices {
-		shep.Shuffling[i] = v
+	shuffling := make([]ValidatorIndex, len(activeIndices), len(activeIndices))
+	for i, v := range activeIndices {
+		shuffling[i] = v
 	}
 	// shuffles the active indices into the shuffling
 	// (name is misleading, unshuffle as a list results in original indices to be traced back to their functional committee position)
-	UnshuffleList(spec.SHUFFLE_ROUND_COUNT, shep.Shuffling, seed)
+	UnshuffleList(spec.SHUFFLE_ROUND_COUNT, shuffling, seed)
+
+	return NewShufflingEpochFromShuffling(spec, epoch, activeIndices, shuffling)
+}
+
+// NewShufflingEpochFromShuffling creates the committees of an epoch from a previously computed shuffling.
+func NewShufflingEpochFromShuffling(spec *Spec, epoch Epoch, activeIndices []ValidatorIndex, shuffling []ValidatorIndex) *ShufflingEpoch {
+	shep := &ShufflingEpoch{
+		Epoch:         epoch,
+		ActiveIndices: activeIndices,
+		Shuffling:     shuffling,
+	}
 
 	validatorCount := uint64(len(shep.Shuffling))
 	committeesPerSlot := CommitteeCount(spec, validatorCount)
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"errors"
+	blsu "github.com/protolambda/bls12-381-util"
+)
+
+// SignatureBatch collects signature sets, to verify them all at once with a single batched verification.
+//
+// The verification methods check the signature immediately if the batch is nil.
+// If the batch is not nil, the signature is added to the batch and assumed to be valid,
+// until the batch is verified with VerifyBatch.
+type SignatureBatch struct {
+	pubkeys    []*blsu.Pubkey
+	messages   [][]byte
+	signatures []*blsu.Signature
+}
+
+// Add adds a signature set to the batch.
+func (b *SignatureBatch) Add(pub *blsu.Pubkey, message []byte, sig *blsu.Signature) {
+	b.pubkeys = append(b.pubkeys, pub)
+	b.messages = append(b.messages, message)
+	b.signatures = append(b.signatures, sig)
+}
+
+// Len returns the number of signature sets in the batch.
+func (b *SignatureBatch) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.signatures)
+}
+
+// Verify verifies the signature, or adds it to the batch.
+func (b *SignatureBatch) Verify(pub *blsu.Pubkey, message []byte, sig *blsu.Signature) bool {
+	if b == nil {
+		return blsu.Verify(pub, message, sig)
+	}
+	b.Add(pub, message, sig)
+	return true
+}
+
+// FastAggregateVerify verifies the aggregate signature, or adds it to the batch with the aggregate pubkey.
+func (b *SignatureBatch) FastAggregateVerify(pubkeys []*blsu.Pubkey, message []byte, sig *blsu.Signature) bool {
+	if b == nil {
+		return blsu.FastAggregateVerify(pubkeys, message, sig)
+	}
+	aggPub, err := blsu.AggregatePubkeys(pubkeys)
+	if err != nil {
+		return false
+	}
+	b.Add(aggPub, message, sig)
+	return true
+}
+
+// Eth2FastAggregateVerify is like FastAggregateVerify, but accepts the infinity signature for no pubkeys.
+// Signatures without pubkeys are verified immediately, these cannot be batched.
+func (b *SignatureBatch) Eth2FastAggregateVerify(pubkeys []*blsu.Pubkey, message []byte, sig *blsu.Signature) bool {
+	if b == nil || len(pubkeys) == 0 {
+		return blsu.Eth2FastAggregateVerify(pubkeys, message, sig)
+	}
+	return b.FastAggregateVerify(pubkeys, message, sig)
+}
+
+// VerifyBatch verifies all signature sets of the batch at once.
+// An error is returned if any of the signatures is invalid.
+func (b *SignatureBatch) VerifyBatch() error {
+	if b.Len() == 0 {
+		return nil
+	}
+	valid, err := blsu.SignatureSetVerify(b.pubkeys, b.messages, b.signatures)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("signature batch is invalid")
+	}
+	return nil
+}
@@ -13,6 +13,9 @@ type BatchRoots interface {
 }
 
 type HistoricalRoots interface {
+	Length() (uint64, error)
+	// GetRoot returns the historical root of the given era, starting at 0 for the first SLOTS_PER_HISTORICAL_ROOT slots.
+	GetRoot(index uint64) (Root, error)
 	Append(root Root) error
 }
 
@@ -139,7 +139,7 @@ func PostSlotTransition(ctx context.Context, spec *Spec, epc *EpochsContext, sta
 		if !ok {
 			return fmt.Errorf("unknown pubkey for proposer %d", proposer)
 		}
-		if !benv.VerifySignatureVersioned(spec, fork.CurrentVersion, genValRoot, proposer, pub) {
+		if !benv.VerifySignatureBatched(spec, fork.CurrentVersion, genValRoot, proposer, pub, epc.SignatureBatch) {
 			return errors.New("block has invalid signature")
 		}
 	}
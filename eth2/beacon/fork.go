@@ -8,6 +8,8 @@ import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/zrnt/eth2/beacon/sharding"
+	"github.com/protolambda/ztyp/codec"
+	"io"
 )
 
 type ForkDecoder struct {
@@ -54,6 +56,49 @@ func (d *ForkDecoder) AllocBlock(digest common.ForkDigest) (OpaqueBlock, error)
 	}
 }
 
+// DecodeState decodes a state of the fork with the given digest.
+func (d *ForkDecoder) DecodeState(digest common.ForkDigest, size uint64, r io.Reader) (common.BeaconState, error) {
+	dr := codec.NewDecodingReader(r, size)
+	var state common.BeaconState
+	var err error
+	switch digest {
+	case d.Genesis:
+		state, err = phase0.AsBeaconStateView(phase0.BeaconStateType(d.Spec).Deserialize(dr))
+	case d.Altair:
+		state, err = altair.AsBeaconStateView(altair.BeaconStateType(d.Spec).Deserialize(dr))
+	case d.Bellatrix:
+		state, err = bellatrix.AsBeaconStateView(bellatrix.BeaconStateType(d.Spec).Deserialize(dr))
+	case d.Capella:
+		// TODO: Implement
+		return nil, fmt.Errorf("capella not implemented: %s", digest)
+	case d.Sharding:
+		state, err = sharding.AsBeaconStateView(sharding.BeaconStateType(d.Spec).Deserialize(dr))
+	default:
+		return nil, fmt.Errorf("unrecognized fork digest: %s", digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ForkDigest returns the digest of the fork that is active at the given slot.
+// This selects the block type of blocks that are identified by slot, instead of by digest.
+func (d *ForkDecoder) ForkDigest(slot common.Slot) common.ForkDigest {
+	epoch := d.Spec.SlotToEpoch(slot)
+	if epoch < d.Spec.ALTAIR_FORK_EPOCH {
+		return d.Genesis
+	} else if epoch < d.Spec.BELLATRIX_FORK_EPOCH {
+		return d.Altair
+	} else if epoch < d.Spec.CAPELLA_FORK_EPOCH {
+		return d.Bellatrix
+	} else if epoch < d.Spec.SHARDING_FORK_EPOCH {
+		return d.Capella
+	} else {
+		return d.Sharding
+	}
+}
+
 type StandardUpgradeableBeaconState struct {
 	common.BeaconState
 }
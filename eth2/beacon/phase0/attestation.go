@@ -50,6 +50,17 @@ func (a *Attestation) HashTreeRoot(spec *common.Spec, hFn tree.HashFn) common.Ro
 	return hFn.HashTreeRoot(spec.Wrap(&a.AggregationBits), &a.Data, a.Signature)
 }
 
+func (a *Attestation) AttestationEnvelope() *common.AttestationEnvelope {
+	return &common.AttestationEnvelope{
+		Slot:            a.Data.Slot,
+		CommitteeIndex:  a.Data.Index,
+		BeaconBlockRoot: a.Data.BeaconBlockRoot,
+		Source:          a.Data.Source,
+		Target:          a.Data.Target,
+		AggregationBits: a.AggregationBits,
+	}
+}
+
 type Attestations []Attestation
 
 func (a *Attestations) Deserialize(spec *common.Spec, dr *codec.DecodingReader) error {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	blsu "github.com/protolambda/bls12-381-util"
 
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/ztyp/codec"
@@ -162,10 +161,10 @@ func ValidateProposerSlashing(spec *common.Spec, epc *common.EpochsContext, stat
 		return err
 	}
 	// Verify signatures
-	if !blsu.Verify(blsPub, sigRoot1[:], sig1) {
+	if !epc.SignatureBatch.Verify(blsPub, sigRoot1[:], sig1) {
 		return errors.New("proposer slashing header 1 has invalid BLS signature")
 	}
-	if !blsu.Verify(blsPub, sigRoot2[:], sig2) {
+	if !epc.SignatureBatch.Verify(blsPub, sigRoot2[:], sig2) {
 		return errors.New("proposer slashing header 2 has invalid BLS signature")
 	}
 	return nil
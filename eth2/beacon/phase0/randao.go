@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	blsu "github.com/protolambda/bls12-381-util"
 
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	. "github.com/protolambda/zrnt/eth2/util/hashing"
@@ -117,7 +116,7 @@ func ProcessRandaoReveal(ctx context.Context, spec *common.Spec, epc *common.Epo
 		return fmt.Errorf("failed to deserialize and sub-group check randao reveal: %v", err)
 	}
 	// Verify RANDAO reveal
-	if !blsu.Verify(blsPub, sigRoot[:], revealSig) {
+	if !epc.SignatureBatch.Verify(blsPub, sigRoot[:], revealSig) {
 		return errors.New("randao invalid")
 	}
 	mixes, err := state.RandaoMixes()
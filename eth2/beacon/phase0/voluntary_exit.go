@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	blsu "github.com/protolambda/bls12-381-util"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/ztyp/codec"
 	"github.com/protolambda/ztyp/tree"
@@ -182,7 +181,7 @@ func ValidateVoluntaryExit(spec *common.Spec, epc *common.EpochsContext, state c
 		return fmt.Errorf("failed to deserialize and sub-group check exit signature: %v", err)
 	}
 	// Verify signature
-	if !blsu.Verify(blsPub, sigRoot[:], sig) {
+	if !epc.SignatureBatch.Verify(blsPub, sigRoot[:], sig) {
 		return errors.New("voluntary exit signature could not be verified")
 	}
 	return nil
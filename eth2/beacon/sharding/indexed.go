@@ -38,6 +38,17 @@ func (p *IndexedAttestation) HashTreeRoot(spec *common.Spec, hFn tree.HashFn) co
 	return hFn.HashTreeRoot(spec.Wrap(&p.AttestingIndices), &p.Data, p.Signature)
 }
 
+func (p *IndexedAttestation) AttestationEnvelope() *common.AttestationEnvelope {
+	return &common.AttestationEnvelope{
+		Slot:             p.Data.Slot,
+		CommitteeIndex:   p.Data.Index,
+		BeaconBlockRoot:  p.Data.BeaconBlockRoot,
+		Source:           p.Data.Source,
+		Target:           p.Data.Target,
+		AttestingIndices: p.AttestingIndices,
+	}
+}
+
 func IndexedAttestationType(spec *common.Spec) *ContainerTypeDef {
 	return ContainerType("IndexedAttestation", []FieldDef{
 		{"attesting_indices", spec.CommitteeIndices()},
@@ -97,6 +108,12 @@ func ValidateIndexedAttestationNoSignature(spec *common.Spec, state common.Beaco
 }
 
 func ValidateIndexedAttestationSignature(spec *common.Spec, dom common.BLSDomain, pubCache *common.PubkeyCache, indexedAttestation *IndexedAttestation) error {
+	return validateIndexedAttestationSignature(spec, dom, pubCache, nil, indexedAttestation)
+}
+
+// validateIndexedAttestationSignature verifies the signature, or adds it to the batch if the batch is not nil.
+func validateIndexedAttestationSignature(spec *common.Spec, dom common.BLSDomain, pubCache *common.PubkeyCache,
+	batch *common.SignatureBatch, indexedAttestation *IndexedAttestation) error {
 	pubkeys := make([]*blsu.Pubkey, 0, len(indexedAttestation.AttestingIndices))
 	for _, i := range indexedAttestation.AttestingIndices {
 		pub, ok := pubCache.Pubkey(i)
@@ -119,7 +136,7 @@ func ValidateIndexedAttestationSignature(spec *common.Spec, dom common.BLSDomain
 	if err != nil {
 		return fmt.Errorf("failed to deserialize and sub-group check indexed attestation signature: %v", err)
 	}
-	if !blsu.Eth2FastAggregateVerify(pubkeys, sigRoot[:], sig) {
+	if !batch.Eth2FastAggregateVerify(pubkeys, sigRoot[:], sig) {
 		return errors.New("could not verify BLS signature for indexed attestation")
 	}
 	return nil
@@ -134,5 +151,5 @@ func ValidateIndexedAttestation(spec *common.Spec, epc *common.EpochsContext, st
 	if err != nil {
 		return err
 	}
-	return ValidateIndexedAttestationSignature(spec, dom, epc.ValidatorPubkeyCache, indexedAttestation)
+	return validateIndexedAttestationSignature(spec, dom, epc.ValidatorPubkeyCache, epc.SignatureBatch, indexedAttestation)
 }
@@ -270,7 +270,7 @@ func ProcessShardHeader(spec *common.Spec, epc *common.EpochsContext, state *Bea
 	if err != nil {
 		return fmt.Errorf("failed to deserialize and sub-group check shard header signature: %v", err)
 	}
-	if !blsu.FastAggregateVerify([]*blsu.Pubkey{blsBuilderPub, blsProposerPub}, signingRoot[:], sig) {
+	if !epc.SignatureBatch.FastAggregateVerify([]*blsu.Pubkey{blsBuilderPub, blsProposerPub}, signingRoot[:], sig) {
 		return errors.New("shard blob header has invalid signature")
 	}
 
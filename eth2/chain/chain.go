@@ -2,10 +2,12 @@ package chain
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
-	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
+	"io"
 	"sync"
 )
 
@@ -133,13 +135,67 @@ type HotColdChain struct {
 	sync.Mutex
 	HotChain
 	ColdChain
+	// OrphanStore keeps track of non-canonical blocks that were pruned from the HotChain.
+	OrphanStore
 	Spec *common.Spec
+	// events is shared with the hot chain, to publish entries that move to the cold chain.
+	events *EventFeed
 	GenesisInfo
 }
 
 var _ FullChain = (*HotColdChain)(nil)
 
-func NewHotColdChain(anchorState *phase0.BeaconStateView, spec *common.Spec, stateDB states.DB) (*HotColdChain, error) {
+// NewHotColdChain creates a chain starting at the anchor state, which may be of any fork.
+// The cold chain is only tracked in memory.
+// See OpenHotColdChain to persist the cold chain.
+func NewHotColdChain(anchorState common.BeaconState, spec *common.Spec, stateDB states.DB) (*HotColdChain, error) {
+	return NewHotColdChainFrom(context.Background(), anchorState, spec, NewFinalizedChain(spec, stateDB))
+}
+
+// OpenHotColdChain opens a HotColdChain that persists the cold chain index in the given data directory.
+// If the data directory already has finalized entries, the chain resumes from the last finalized entry,
+// and the anchorState is ignored (and may be nil).
+// Otherwise the chain starts from the anchorState, like NewHotColdChain.
+// The states of the finalized entries are expected to be persisted by the stateDB.
+func OpenHotColdChain(ctx context.Context, anchorState common.BeaconState, spec *common.Spec,
+	stateDB states.DB, dataDir string) (*HotColdChain, error) {
+	index, err := OpenColdIndex(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	coldCh, err := LoadFinalizedChain(ctx, spec, stateDB, index)
+	if err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	c, err := NewHotColdChainFrom(ctx, anchorState, spec, coldCh)
+	if err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewHotColdChainFrom creates a chain with the given cold chain,
+// e.g. a FinalizedChain that is configured with a StatePolicy to store states sparsely.
+// Like OpenHotColdChain, it resumes from the last finalized entry, if any.
+func NewHotColdChainFrom(ctx context.Context, anchorState common.BeaconState, spec *common.Spec,
+	coldCh *FinalizedChain) (*HotColdChain, error) {
+	if end := coldCh.ColdEnd(); end != 0 {
+		// Resume from the last finalized entry.
+		// The hot chain moves this entry to the cold chain again when it is pruned, which is a no-op.
+		last, ok := coldCh.ByCanonStep(end - 1)
+		if !ok {
+			return nil, fmt.Errorf("cannot find last cold chain entry %s", end-1)
+		}
+		state, err := last.State(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load state of last cold chain entry %s: %v", end-1, err)
+		}
+		anchorState = state
+	} else if anchorState == nil {
+		return nil, errors.New("no anchor state, and no finalized entries to resume from")
+	}
 	time, err := anchorState.GenesisTime()
 	if err != nil {
 		return nil, err
@@ -150,7 +206,8 @@ func NewHotColdChain(anchorState *phase0.BeaconStateView, spec *common.Spec, sta
 	}
 	c := &HotColdChain{
 		HotChain:    nil,
-		ColdChain:   NewFinalizedChain(spec, stateDB),
+		ColdChain:   coldCh,
+		OrphanStore: NewMemOrphanStore(),
 		Spec:        spec,
 		GenesisInfo: GenesisInfo{ValidatorsRoot: valRoot, Time: time},
 	}
@@ -159,20 +216,88 @@ func NewHotColdChain(anchorState *phase0.BeaconStateView, spec *common.Spec, sta
 		return nil, err
 	}
 	c.HotChain = hotCh
+	c.events = hotCh.EventFeed
 
 	return c, nil
 }
 
+// NewCheckpointHotColdChain starts a chain from a trusted finalized checkpoint (weak subjectivity sync):
+// the anchor state and the block it builds on. The anchor state may be of a later empty slot than the block.
+// The anchor is added to the cold chain, and the history before it can be added with FinalizedChain.Backfill.
+// If the cold chain already has entries, the chain resumes from the last one, like NewHotColdChainFrom.
+func NewCheckpointHotColdChain(ctx context.Context, anchorState common.BeaconState, anchorBlock *common.BeaconBlockEnvelope,
+	spec *common.Spec, coldCh *FinalizedChain) (*HotColdChain, error) {
+	if coldCh.ColdEnd() != 0 {
+		return NewHotColdChainFrom(ctx, nil, spec, coldCh)
+	}
+	header, err := anchorState.LatestBlockHeader()
+	if err != nil {
+		return nil, err
+	}
+	if header.StateRoot == (Root{}) {
+		header.StateRoot = anchorState.HashTreeRoot(tree.GetHashFn())
+	}
+	if root := header.HashTreeRoot(tree.GetHashFn()); root != anchorBlock.BlockRoot {
+		return nil, fmt.Errorf("anchor state builds on block %s, but got anchor block %s", root, anchorBlock.BlockRoot)
+	}
+	slot, err := anchorState.Slot()
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewHotColdChainFrom(ctx, anchorState, spec, coldCh)
+	if err != nil {
+		return nil, err
+	}
+	anchor, ok := c.HotChain.ByBlockSlot(anchorBlock.BlockRoot, slot)
+	if !ok {
+		return nil, errors.New("cannot find anchor in hot chain")
+	}
+	// The hot chain moves the anchor to the cold chain again when it is pruned, which is a no-op.
+	if err := coldCh.OnFinalizedEntry(ctx, anchor); err != nil {
+		return nil, fmt.Errorf("failed to add anchor to cold chain: %v", err)
+	}
+	if slot > anchorBlock.Slot {
+		// The anchor is an empty slot, the block is part of the history before it.
+		if err := coldCh.Backfill(ctx, []*common.BeaconBlockEnvelope{anchorBlock}); err != nil {
+			return nil, fmt.Errorf("failed to add anchor block: %v", err)
+		}
+	} else if coldCh.BlocksDB != nil {
+		if _, err := coldCh.BlocksDB.Store(ctx, anchorBlock); err != nil {
+			return nil, fmt.Errorf("failed to store anchor block: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// Close releases the hot states shared with the chain this chain was forked from, if any,
+// and closes the cold chain index, if any.
+func (hc *HotColdChain) Close() error {
+	hc.Lock()
+	defer hc.Unlock()
+	if cl, ok := hc.HotChain.(io.Closer); ok {
+		if err := cl.Close(); err != nil {
+			return err
+		}
+	}
+	if cl, ok := hc.ColdChain.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
 func (hc *HotColdChain) Genesis() GenesisInfo {
 	return hc.GenesisInfo
 }
 
-func (hc *HotColdChain) hotToCold(ctx context.Context, entry ChainEntry, canonical bool) error {
+func (hc *HotColdChain) hotToCold(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error {
 	if canonical {
-		return hc.ColdChain.OnFinalizedEntry(ctx, entry)
+		if err := hc.ColdChain.OnFinalizedEntry(ctx, entry); err != nil {
+			return err
+		}
+		hc.events.send(&ColdEvent{Entry: entry})
+		return nil
 	}
-	// TODO keep track of pruned non-finalized blocks?
-	return nil
+	return hc.OrphanStore.AddOrphan(ctx, entry, OrphanFinalizedConflict, finalized)
 }
 
 func (hc *HotColdChain) ByStateRoot(root Root) (entry ChainEntry, ok bool) {
@@ -293,6 +418,9 @@ type FullChainIter struct {
 }
 
 func (fi *FullChainIter) Start() Step {
+	if fi.ColdIter.Start() == fi.ColdIter.End() {
+		return fi.HotIter.Start()
+	}
 	return fi.ColdIter.Start()
 }
 
@@ -303,9 +431,41 @@ func (fi *FullChainIter) End() Step {
 func (fi *FullChainIter) Entry(step Step) (entry ChainEntry, err error) {
 	if step < fi.ColdIter.End() {
 		return fi.ColdIter.Entry(step)
+	} else if step < fi.HotIter.Start() && step.Block() {
+		// The cold chain may end with a slot without block, before the hot chain starts at the next slot.
+		return nil, nil
 	} else {
 		return fi.HotIter.Entry(step)
 	}
 }
 
-// TODO: chain copy
+// Fork creates a sandbox copy of the chain, to apply hypothetical blocks and attestations to.
+// The copy shares the state backings and finalized data with this chain, but changes to either chain
+// are not visible to the other. States finalized in the sandbox are kept in memory, and not persisted.
+// The sandbox retains the hot states it shares with this chain, and must be closed when it is discarded.
+func (hc *HotColdChain) Fork() (*HotColdChain, error) {
+	hc.Lock()
+	defer hc.Unlock()
+	hotCh, ok := hc.HotChain.(*UnfinalizedChain)
+	if !ok {
+		return nil, fmt.Errorf("cannot fork hot chain of type %T", hc.HotChain)
+	}
+	coldCh, ok := hc.ColdChain.(*FinalizedChain)
+	if !ok {
+		return nil, fmt.Errorf("cannot fork cold chain of type %T", hc.ColdChain)
+	}
+	orphans := NewMemOrphanStore()
+	if mem, ok := hc.OrphanStore.(*MemOrphanStore); ok {
+		orphans = mem.Copy()
+	}
+	out := &HotColdChain{
+		ColdChain:   coldCh.Copy(),
+		OrphanStore: orphans,
+		Spec:        hc.Spec,
+		GenesisInfo: hc.GenesisInfo,
+	}
+	hotCopy := hotCh.Copy(BlockSinkFn(out.hotToCold))
+	out.HotChain = hotCopy
+	out.events = hotCopy.EventFeed
+	return out, nil
+}
@@ -0,0 +1,410 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/bellatrix"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func stateFork(state common.BeaconState) string {
+	switch state.(type) {
+	case *phase0.BeaconStateView:
+		return "phase0"
+	case *altair.BeaconStateView:
+		return "altair"
+	case *bellatrix.BeaconStateView:
+		return "bellatrix"
+	default:
+		return fmt.Sprintf("%T", state)
+	}
+}
+
+func TestNewHotColdChainForkAnchors(t *testing.T) {
+	spec := chaintest.Spec()
+	cases := []struct {
+		fork       string
+		epoch      common.Epoch
+		nextFork   string
+		syncCommit bool
+	}{
+		{fork: "phase0", epoch: 0, nextFork: "altair", syncCommit: false},
+		{fork: "altair", epoch: 1, nextFork: "bellatrix", syncCommit: true},
+		{fork: "bellatrix", epoch: 2, nextFork: "bellatrix", syncCommit: true},
+	}
+	for _, c := range cases {
+		t.Run(c.fork, func(t *testing.T) {
+			ctx := context.Background()
+			anchorState := testAnchor(t, spec, c.epoch)
+			if f := stateFork(anchorState); f != c.fork {
+				t.Fatalf("expected %s anchor state, got %s", c.fork, f)
+			}
+			ch, err := NewHotColdChain(anchorState, spec, states.NewMemDB(spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, err := ch.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head.StateRoot() != anchorState.HashTreeRoot(tree.GetHashFn()) {
+				t.Fatal("head is not the anchor")
+			}
+			if entry, ok := ch.ByStateRoot(head.StateRoot()); !ok || entry.Step() != head.Step() {
+				t.Fatal("cannot find anchor by state root")
+			}
+			epc, err := head.EpochsContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.syncCommit && (epc.CurrentSyncCommittee == nil || epc.NextSyncCommittee == nil) {
+				t.Fatal("expected sync committees in epochs context")
+			}
+			if !c.syncCommit && epc.CurrentSyncCommittee != nil {
+				t.Fatal("unexpected sync committee in epochs context")
+			}
+			if epc.CurrentEpoch.Epoch != c.epoch {
+				t.Fatalf("unexpected epochs context epoch %d", epc.CurrentEpoch.Epoch)
+			}
+
+			// Transition into the next epoch, across a fork boundary if there is any.
+			nextSlot, _ := spec.EpochStartSlot(c.epoch + 1)
+			next, err := ch.Towards(ctx, head.BlockRoot(), nextSlot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nextState, err := next.State(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f := stateFork(nextState); f != c.nextFork {
+				t.Fatalf("expected %s state after transition, got %s", c.nextFork, f)
+			}
+			nextEpc, err := next.EpochsContext(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nextEpc.CurrentSyncCommittee == nil {
+				t.Fatal("expected sync committees after transition")
+			}
+		})
+	}
+}
+
+func TestHotColdChainFork(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	stateDB := states.NewMemDB(spec)
+	live, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, stateDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := live.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := testBlock(t, spec, live, genesis.BlockRoot(), 1, 0xa)
+	if err := live.AddBlock(ctx, blockA); err != nil {
+		t.Fatal(err)
+	}
+
+	sandbox, err := live.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+	events := make(chan ChainEvent, 100)
+	sub := live.Subscribe(events)
+	defer sub.Unsubscribe()
+
+	// B only exists in the sandbox, C only in the live chain
+	blockB := testBlock(t, spec, sandbox, blockA.BlockRoot, 2, 0xb)
+	if err := sandbox.AddBlock(ctx, blockB); err != nil {
+		t.Fatal(err)
+	}
+	blockC := testBlock(t, spec, live, blockA.BlockRoot, 2, 0xc)
+	if err := live.AddBlock(ctx, blockC); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := live.ByBlock(blockB.BlockRoot); ok {
+		t.Fatal("sandbox block leaked into live chain")
+	}
+	if _, ok := sandbox.ByBlock(blockC.BlockRoot); ok {
+		t.Fatal("live block leaked into sandbox")
+	}
+	for i := ValidatorIndex(0); i < 8; i++ {
+		sandbox.HotChain.(*UnfinalizedChain).ForkChoice.ProcessAttestation(i, blockB.BlockRoot, 2)
+		live.HotChain.(*UnfinalizedChain).ForkChoice.ProcessAttestation(i, blockC.BlockRoot, 2)
+	}
+	if head, err := sandbox.Head(); err != nil || head.BlockRoot() != blockB.BlockRoot {
+		t.Fatalf("expected sandbox head B, got %v (err: %v)", head, err)
+	}
+	if head, err := live.Head(); err != nil || head.BlockRoot() != blockC.BlockRoot {
+		t.Fatalf("expected live head C, got %v (err: %v)", head, err)
+	}
+	for len(events) > 0 {
+		switch ev := (<-events).(type) {
+		case *BlockEvent:
+			if ev.Entry.BlockRoot() == blockB.BlockRoot {
+				t.Fatal("sandbox block published to live subscribers")
+			}
+		}
+	}
+
+	// Finalization in the sandbox does not affect the live chain and its states DB
+	testFinalize(t, sandbox.HotChain.(*UnfinalizedChain), blockB.BlockRoot, 1)
+	if sandbox.ColdEnd() == 0 {
+		t.Fatal("expected entries to move to the sandbox cold chain")
+	}
+	if _, ok := sandbox.Orphan(blockC.BlockRoot); ok {
+		t.Fatal("live block cannot be orphaned in sandbox")
+	}
+	if live.ColdEnd() != 0 {
+		t.Fatal("sandbox finalization moved entries to the live cold chain")
+	}
+	if state, err := stateDB.Get(ctx, genesis.StateRoot()); err != nil || state != nil {
+		t.Fatal("sandbox finalization stored states in the live states DB")
+	}
+	if _, ok := live.ByBlock(genesis.BlockRoot()); !ok {
+		t.Fatal("expected genesis to still be in live hot chain")
+	}
+	if entry, ok := sandbox.ByBlock(genesis.BlockRoot()); !ok {
+		t.Fatal("expected genesis in sandbox cold chain")
+	} else if _, err := entry.State(ctx); err != nil {
+		t.Fatalf("expected sandbox to serve finalized state: %v", err)
+	}
+}
+
+func TestAddBlocks(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// build the blocks in a sandbox, to not create any entries in the chain itself
+	sandbox, err := ch.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+	var benvs []*common.BeaconBlockEnvelope
+	parent := head.BlockRoot()
+	for _, slot := range []Slot{1, 2, 4, 5} {
+		benv := testBlock(t, spec, sandbox, parent, slot, 0)
+		if err := sandbox.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		benvs = append(benvs, benv)
+		parent = benv.BlockRoot
+	}
+	hot := ch.HotChain.(*UnfinalizedChain)
+	entryCount := len(hot.Entries)
+
+	// a bad signature in the last block fails the batch, and no blocks are imported
+	badSig := *benvs[3]
+	badSig.Signature = chaintest.Sign(t, badSig.ProposerIndex, common.Root{0xba, 0xd})
+	invalid := []*common.BeaconBlockEnvelope{benvs[0], benvs[1], benvs[2], &badSig}
+	if err := ch.AddBlocks(ctx, invalid); err == nil {
+		t.Fatal("expected batch with bad signature to fail")
+	}
+	if len(hot.Entries) != entryCount {
+		t.Fatalf("expected chain to be unchanged, got %d entries, expected %d", len(hot.Entries), entryCount)
+	}
+	if _, ok := ch.ByBlock(benvs[0].BlockRoot); ok {
+		t.Fatal("expected first block of invalid batch to not be imported")
+	}
+
+	// a forkchoice rejection of the last block fails the batch, and no blocks are imported
+	fc := hot.ForkChoice
+	hot.ForkChoice = &rejectingForkChoice{Forkchoice: fc, reject: benvs[3].BlockRoot}
+	events := make(chan ChainEvent, 10)
+	sub := ch.Subscribe(events)
+	if err := ch.AddBlocks(ctx, benvs); err == nil {
+		t.Fatal("expected batch with rejected block to fail")
+	}
+	sub.Unsubscribe()
+	hot.ForkChoice = fc
+	if len(hot.Entries) != entryCount || len(events) != 0 {
+		t.Fatalf("expected chain to be unchanged, got %d entries (expected %d) and %d events",
+			len(hot.Entries), entryCount, len(events))
+	}
+	if _, ok := fc.GetSlot(benvs[0].BlockRoot); ok {
+		t.Fatal("expected first block of rejected batch to not be in the forkchoice")
+	}
+
+	// blocks that do not link up are rejected
+	if err := ch.AddBlocks(ctx, []*common.BeaconBlockEnvelope{benvs[0], benvs[2]}); err == nil {
+		t.Fatal("expected batch with missing block to fail")
+	}
+
+	if err := ch.AddBlocks(ctx, benvs); err != nil {
+		t.Fatal(err)
+	}
+	for _, benv := range benvs {
+		entry, ok := ch.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("block %s at slot %d not imported", benv.BlockRoot, benv.Slot)
+		}
+		if entry.StateRoot() != benv.StateRoot {
+			t.Fatalf("block %s has unexpected state root", benv.BlockRoot)
+		}
+	}
+	// importing the same blocks again is a no-op
+	if err := ch.AddBlocks(ctx, benvs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddBlockAtProposerBoost(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	genesis := chaintest.Genesis(t, spec)
+	genesisTime, err := genesis.GenesisTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := NewHotColdChain(genesis, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two competing blocks of slot 1, built in a sandbox to find the head without boost.
+	sandbox, err := ch.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+	a := testBlock(t, spec, sandbox, head.BlockRoot(), 1, 0xa)
+	b := testBlock(t, spec, sandbox, head.BlockRoot(), 1, 0xb)
+	for _, benv := range []*common.BeaconBlockEnvelope{a, b} {
+		if err := sandbox.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	winner, err := sandbox.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loser := a
+	if winner.BlockRoot() == a.BlockRoot {
+		loser = b
+	}
+	expectHead := func(expected Root) {
+		t.Helper()
+		head, err := ch.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.BlockRoot() != expected {
+			t.Fatalf("expected head %s, got %s", expected, head.BlockRoot())
+		}
+	}
+
+	// The timely block gets the boost, and becomes the head.
+	slotStart := genesisTime + spec.SECONDS_PER_SLOT
+	if err := ch.AddBlockAt(ctx, loser, slotStart+1); err != nil {
+		t.Fatal(err)
+	}
+	for _, benv := range []*common.BeaconBlockEnvelope{a, b} {
+		if benv != loser {
+			if err := ch.AddBlockAt(ctx, benv, slotStart+2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectHead(loser.BlockRoot)
+
+	// The boost ends with the slot.
+	if err := ch.OnTick(ctx, slotStart+spec.SECONDS_PER_SLOT); err != nil {
+		t.Fatal(err)
+	}
+	expectHead(winner.BlockRoot())
+}
+
+// rejectingForkChoice rejects a single block, also in copies.
+type rejectingForkChoice struct {
+	forkchoice.Forkchoice
+	reject Root
+}
+
+func (fc *rejectingForkChoice) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch,
+	unrealizedJustifiedEpoch Epoch, unrealizedFinalizedEpoch Epoch, execution forkchoice.ExecutionInfo) bool {
+	if blockRoot == fc.reject {
+		return false
+	}
+	return fc.Forkchoice.ProcessBlock(parent, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch,
+		unrealizedJustifiedEpoch, unrealizedFinalizedEpoch, execution)
+}
+
+func (fc *rejectingForkChoice) Copy(sink forkchoice.NodeSink) forkchoice.Forkchoice {
+	return &rejectingForkChoice{Forkchoice: fc.Forkchoice.Copy(sink), reject: fc.reject}
+}
+
+func TestSimulateBlock(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandbox, err := ch.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+	benv := testBlock(t, spec, sandbox, head.BlockRoot(), 3, 0)
+	hot := ch.HotChain.(*UnfinalizedChain)
+	entryCount := len(hot.Entries)
+
+	state, stateRoot, err := ch.SimulateBlock(ctx, benv, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stateRoot != benv.StateRoot || state.HashTreeRoot(tree.GetHashFn()) != stateRoot {
+		t.Fatalf("unexpected post-state root %s, expected %s", stateRoot, benv.StateRoot)
+	}
+	if len(hot.Entries) != entryCount || len(hot.State2Key) != entryCount {
+		t.Fatalf("expected chain to be unchanged, got %d entries, expected %d", len(hot.Entries), entryCount)
+	}
+	if _, ok := hot.ForkChoice.GetSlot(benv.BlockRoot); ok {
+		t.Fatal("simulated block leaked into the forkchoice")
+	}
+	if _, ok := ch.ByBlockSlot(head.BlockRoot(), 3); ok {
+		t.Fatal("simulated empty slots leaked into the chain")
+	}
+
+	// the state root is only checked if requested
+	wrongRoot := *benv
+	wrongRoot.StateRoot = Root{0x42}
+	if _, _, err := ch.SimulateBlock(ctx, &wrongRoot, true); err == nil {
+		t.Fatal("expected state root mismatch")
+	}
+	if _, stateRoot, err := ch.SimulateBlock(ctx, &wrongRoot, false); err != nil || stateRoot != benv.StateRoot {
+		t.Fatalf("expected simulation without state root check, got %s (err: %v)", stateRoot, err)
+	}
+	unknownParent := *benv
+	unknownParent.ParentRoot = Root{0x42}
+	if _, _, err := ch.SimulateBlock(ctx, &unknownParent, false); err == nil {
+		t.Fatal("expected block with unknown parent to fail")
+	}
+}
@@ -0,0 +1,297 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// CheckProblem is a kind of inconsistency that Check finds in a chain.
+type CheckProblem uint8
+
+const (
+	// MissingState: the state of the entry cannot be loaded.
+	MissingState CheckProblem = iota + 1
+	// CorruptState: the state of the entry does not match the state root of the entry.
+	CorruptState
+	// MissingBlock: the block of the entry is not in the blocks DB.
+	MissingBlock
+	// CorruptBlock: the block in the blocks DB does not match the block root of the entry.
+	CorruptBlock
+	// InconsistentEntry: the entry does not link to the previous entry,
+	// or its roots disagree with its state, its block, or the chain index.
+	InconsistentEntry
+)
+
+func (p CheckProblem) String() string {
+	switch p {
+	case MissingState:
+		return "missing state"
+	case CorruptState:
+		return "corrupt state"
+	case MissingBlock:
+		return "missing block"
+	case CorruptBlock:
+		return "corrupt block"
+	case InconsistentEntry:
+		return "inconsistent entry"
+	default:
+		return fmt.Sprintf("unknown problem %d", uint8(p))
+	}
+}
+
+// CheckIssue describes a problem with a single chain entry.
+type CheckIssue struct {
+	Step    Step
+	Problem CheckProblem
+	// Root of the state or block of the entry, depending on the problem.
+	Root Root
+	// Detail describes the problem
+	Detail string
+	// Repaired is true if the problem was fixed during the check.
+	Repaired bool
+}
+
+func (iss *CheckIssue) String() string {
+	out := fmt.Sprintf("%s at step %s (%s): %s", iss.Problem, iss.Step, iss.Root, iss.Detail)
+	if iss.Repaired {
+		out += " (repaired)"
+	}
+	return out
+}
+
+// CheckReport is the result of a Check of the chain.
+type CheckReport struct {
+	// Start and End of the checked steps, End is exclusive.
+	Start, End Step
+	// Entries is the number of checked entries. Block steps of empty slots may not have an entry.
+	Entries int
+	// States is the number of checked states. Backfilled entries have no states.
+	States int
+	// Blocks is the number of checked blocks.
+	Blocks int
+	// Issues lists the problems, ordered by step.
+	Issues []CheckIssue
+}
+
+// OK returns true if the check found no problems, or if all problems were repaired.
+func (r *CheckReport) OK() bool {
+	for i := range r.Issues {
+		if !r.Issues[i].Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CheckReport) add(step Step, problem CheckProblem, root Root, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, CheckIssue{
+		Step:    step,
+		Problem: problem,
+		Root:    root,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+// CheckOptions configures a Check of the chain.
+type CheckOptions struct {
+	// BlocksDB to check the blocks of the entries against, typically the BlocksDB of the cold chain.
+	// If nil, blocks are not checked, and states cannot be repaired by replaying blocks.
+	BlocksDB blocks.DB
+	// Repair re-derives missing and corrupt states of the cold chain, by replaying the entry on top of the previous state,
+	// and stores them in the states DB of the cold chain, if the state is meant to be stored.
+	// Hot states are kept by the hot chain itself, and are only checked.
+	Repair bool
+}
+
+// Check walks the canonical chain, and verifies that the chain index, the states and the blocks agree:
+// every state and block is reloaded and hashed, and every entry must link to the previous entry.
+// Problems are collected in the report, an error is only returned if the chain cannot be walked at all.
+func (hc *HotColdChain) Check(ctx context.Context, opts CheckOptions) (*CheckReport, error) {
+	it, err := hc.Iter()
+	if err != nil {
+		return nil, err
+	}
+	coldCh, _ := hc.ColdChain.(*FinalizedChain)
+	report := &CheckReport{Start: it.Start(), End: it.End()}
+
+	var prev ChainEntry
+	var prevState common.BeaconState
+	for step := it.Start(); step < it.End(); step++ {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		entry, err := it.Entry(step)
+		if err != nil {
+			return report, fmt.Errorf("failed to get entry at step %s: %v", step, err)
+		}
+		if entry == nil {
+			continue
+		}
+		report.Entries++
+		if entry.Step() != step {
+			report.add(step, InconsistentEntry, entry.BlockRoot(), "entry is at step %s", entry.Step())
+		}
+		hasBlock := step.Block() && entry.ParentRoot() != entry.BlockRoot()
+		if prev != nil {
+			if hasBlock && entry.ParentRoot() != prev.BlockRoot() {
+				report.add(step, InconsistentEntry, entry.BlockRoot(),
+					"block has parent %s, but previous entry has block %s", entry.ParentRoot(), prev.BlockRoot())
+			} else if !hasBlock && entry.BlockRoot() != prev.BlockRoot() {
+				report.add(step, InconsistentEntry, entry.BlockRoot(),
+					"entry without block does not repeat block %s of previous entry", prev.BlockRoot())
+			}
+		}
+		if hasBlock {
+			if indexed, ok := hc.ByBlockSlot(entry.BlockRoot(), step.Slot()); !ok {
+				report.add(step, InconsistentEntry, entry.BlockRoot(), "block is not indexed")
+			} else if indexed.Step() != step {
+				report.add(step, InconsistentEntry, entry.BlockRoot(), "block is indexed at step %s", indexed.Step())
+			}
+		}
+
+		var benv *common.BeaconBlockEnvelope
+		if hasBlock && opts.BlocksDB != nil {
+			benv = hc.checkBlock(ctx, report, opts.BlocksDB, entry)
+		}
+
+		if coldCh != nil && step < coldCh.ColdEnd() && !coldCh.hasState(step) {
+			prevState = nil
+		} else {
+			state := hc.checkState(ctx, report, entry)
+			if state == nil && opts.Repair && coldCh != nil && step < coldCh.ColdEnd() {
+				state = hc.repairState(ctx, report, coldCh, prev, prevState, entry, benv)
+			}
+			prevState = state
+		}
+		prev = entry
+	}
+	return report, nil
+}
+
+// checkBlock checks the block of the entry against the blocks DB, and returns it if it matches the entry.
+func (hc *HotColdChain) checkBlock(ctx context.Context, report *CheckReport, blocksDB blocks.DB,
+	entry ChainEntry) *common.BeaconBlockEnvelope {
+	step, root := entry.Step(), entry.BlockRoot()
+	benv, err := blocksDB.Get(ctx, root)
+	if err != nil {
+		report.add(step, MissingBlock, root, "failed to load block: %v", err)
+		return nil
+	}
+	if benv == nil {
+		// The genesis block is commonly not stored
+		if step.Slot() != 0 {
+			report.add(step, MissingBlock, root, "block is not in the blocks DB")
+		}
+		return nil
+	}
+	report.Blocks++
+	if benv.BlockRoot != root {
+		report.add(step, CorruptBlock, root, "stored block has root %s", benv.BlockRoot)
+		return nil
+	}
+	if benv.Slot != step.Slot() || benv.ParentRoot != entry.ParentRoot() || benv.StateRoot != entry.StateRoot() {
+		report.add(step, InconsistentEntry, root,
+			"block has slot %d, parent %s and state root %s, but entry has parent %s and state root %s",
+			benv.Slot, benv.ParentRoot, benv.StateRoot, entry.ParentRoot(), entry.StateRoot())
+		return nil
+	}
+	return benv
+}
+
+// checkState checks the state of the entry, and returns it if it matches the entry.
+func (hc *HotColdChain) checkState(ctx context.Context, report *CheckReport, entry ChainEntry) common.BeaconState {
+	step, root := entry.Step(), entry.StateRoot()
+	state, err := entry.State(ctx)
+	if err != nil {
+		report.add(step, MissingState, root, "failed to load state: %v", err)
+		return nil
+	}
+	report.States++
+	if stateRoot := state.HashTreeRoot(tree.GetHashFn()); stateRoot != root {
+		report.add(step, CorruptState, root, "state has root %s", stateRoot)
+		return nil
+	}
+	slot, err := state.Slot()
+	if err != nil {
+		report.add(step, CorruptState, root, "failed to read slot of state: %v", err)
+		return nil
+	}
+	if slot != step.Slot() {
+		report.add(step, InconsistentEntry, root, "state has slot %d", slot)
+		return state
+	}
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		report.add(step, CorruptState, root, "failed to read latest block header of state: %v", err)
+		return nil
+	}
+	// The state root of the header is only filled in by the next slot processing.
+	if header.StateRoot == (Root{}) {
+		header.StateRoot = root
+	}
+	if headerRoot := header.HashTreeRoot(tree.GetHashFn()); headerRoot != entry.BlockRoot() {
+		report.add(step, InconsistentEntry, root,
+			"latest block header of state has root %s, but entry has block %s", headerRoot, entry.BlockRoot())
+	}
+	return state
+}
+
+// repairState re-derives the state of a cold entry from the state of the previous entry,
+// and stores it in the states DB of the cold chain. The issue of the state is marked as repaired on success.
+func (hc *HotColdChain) repairState(ctx context.Context, report *CheckReport, coldCh *FinalizedChain,
+	prev ChainEntry, prevState common.BeaconState, entry ChainEntry, benv *common.BeaconBlockEnvelope) common.BeaconState {
+	iss := &report.Issues[len(report.Issues)-1]
+	step := entry.Step()
+	if prev == nil || prevState == nil {
+		iss.Detail += ", cannot repair without the previous state"
+		return nil
+	}
+	state, err := prevState.CopyState()
+	if err != nil {
+		iss.Detail += fmt.Sprintf(", failed to copy previous state to repair: %v", err)
+		return nil
+	}
+	if step.Block() {
+		// The block step of an empty slot has the same state as the slot step.
+		if entry.ParentRoot() != entry.BlockRoot() {
+			if benv == nil {
+				iss.Detail += ", cannot repair without the block"
+				return nil
+			}
+			epc, err := prev.EpochsContext(ctx)
+			if err != nil {
+				iss.Detail += fmt.Sprintf(", failed to get context to repair: %v", err)
+				return nil
+			}
+			if err := common.PostSlotTransition(ctx, hc.Spec, epc, state, benv, false); err != nil {
+				iss.Detail += fmt.Sprintf(", failed to replay block to repair: %v", err)
+				return nil
+			}
+		}
+	} else {
+		epc, err := prev.EpochsContext(ctx)
+		if err != nil {
+			iss.Detail += fmt.Sprintf(", failed to get context to repair: %v", err)
+			return nil
+		}
+		state, err = processNextSlot(ctx, hc.Spec, epc, state)
+		if err != nil {
+			iss.Detail += fmt.Sprintf(", failed to process slot to repair: %v", err)
+			return nil
+		}
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != entry.StateRoot() {
+		iss.Detail += fmt.Sprintf(", replayed state has root %s", root)
+		return nil
+	}
+	stored, err := coldCh.repairState(ctx, step, state)
+	if err != nil {
+		iss.Detail += fmt.Sprintf(", failed to store repaired state: %v", err)
+		return state
+	}
+	iss.Repaired = stored
+	return state
+}
@@ -0,0 +1,124 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	genesisState := chaintest.Genesis(t, spec)
+	genesisValRoot, err := genesisState.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDB := states.NewMemDB(spec)
+	blocksDB := blocks.NewMemDB(spec, beacon.NewForkDecoder(spec, genesisValRoot))
+	coldCh := NewFinalizedChain(spec, stateDB)
+	coldCh.BlocksDB = blocksDB
+	ch, err := NewHotColdChainFrom(ctx, genesisState, spec, coldCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := head.BlockRoot()
+	var roots []Root
+	for _, slot := range []Slot{1, 2, 3, 5} {
+		benv := testBlock(t, spec, ch, parent, slot, 0)
+		if _, err := blocksDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		parent = benv.BlockRoot
+		roots = append(roots, parent)
+	}
+	testFinalize(t, ch.HotChain.(*UnfinalizedChain), parent, 1)
+
+	opts := CheckOptions{BlocksDB: blocksDB}
+	report, err := ch.Check(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Issues) != 0 {
+		t.Fatalf("expected healthy chain, got issues: %v", report.Issues)
+	}
+	if report.Blocks != 4 || report.States != report.Entries || report.Entries == 0 {
+		t.Fatalf("unexpected check counts: %d entries, %d states, %d blocks",
+			report.Entries, report.States, report.Blocks)
+	}
+
+	// lose some states, they can be repaired by replaying blocks
+	var lost []Root
+	for _, step := range []Step{AsStep(2, true), AsStep(3, false)} {
+		entry, _ := ch.ColdChain.ByCanonStep(step)
+		lost = append(lost, entry.StateRoot())
+		if err := stateDB.Remove(entry.StateRoot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err = ch.Check(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || len(report.Issues) != 2 {
+		t.Fatalf("expected 2 issues, got: %v", report.Issues)
+	}
+	for i, iss := range report.Issues {
+		if iss.Problem != MissingState || iss.Root != lost[i] || iss.Repaired {
+			t.Fatalf("unexpected issue: %s", &iss)
+		}
+	}
+	opts.Repair = true
+	report, err = ch.Check(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Issues) != 2 {
+		t.Fatalf("expected 2 repaired issues, got: %v", report.Issues)
+	}
+	for _, root := range lost {
+		if state, err := stateDB.Get(ctx, root); err != nil || state == nil {
+			t.Fatalf("expected state %s to be repaired (err: %v)", root, err)
+		}
+	}
+	report, err = ch.Check(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("expected repaired chain to be healthy, got issues: %v", report.Issues)
+	}
+
+	// lose a block, and the state after it: without the block the state cannot be repaired
+	if _, err := blocksDB.Remove(roots[2]); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := ch.ColdChain.ByBlock(roots[2])
+	if err := stateDB.Remove(entry.StateRoot()); err != nil {
+		t.Fatal(err)
+	}
+	report, err = ch.Check(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || len(report.Issues) != 2 {
+		t.Fatalf("expected 2 issues, got: %v", report.Issues)
+	}
+	if iss := report.Issues[0]; iss.Problem != MissingBlock || iss.Root != roots[2] {
+		t.Fatalf("unexpected issue: %s", &iss)
+	}
+	if iss := report.Issues[1]; iss.Problem != MissingState || iss.Repaired {
+		t.Fatalf("unexpected issue: %s", &iss)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
 	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
 	"sort"
 	"sync"
 )
@@ -75,6 +77,30 @@ type FinalizedChain struct {
 	Spec *common.Spec
 
 	StateDB states.DB
+
+	// StatePolicy decides which states are stored in the StateDB, optional.
+	// If nil, all states are stored. The state of the first and last entry are always stored.
+	// Other states are regenerated by replaying blocks from the BlocksDB.
+	StatePolicy StatePolicy
+
+	// BlocksDB provides the finalized blocks to regenerate states with, required if a StatePolicy is set.
+	BlocksDB blocks.DB
+
+	// Archive keeps the shuffling and proposers of finalized epochs, optional.
+	// If nil, these are recomputed from the state of an entry whenever its EpochsContext is requested.
+	Archive EpochArchive
+
+	// Regenerated states that were recently used
+	stateCache *stateCache
+
+	// Index persists the roots of every finalized entry, optional.
+	// If nil, the cold chain is only tracked in memory.
+	Index ColdIndex
+
+	// First step of the chain, may be a backfilled step
+	startStep Step
+	// First step with a state, backfilled steps before it have no states
+	stateStart Step
 }
 
 var _ ColdChain = (*FinalizedChain)(nil)
@@ -89,7 +115,103 @@ func NewFinalizedChain(spec *common.Spec, stateDB states.DB) *FinalizedChain {
 		StateRootsMap: make(map[Root]Step, initialCapacity),
 		Spec:          spec,
 		StateDB:       stateDB,
+		stateCache:    newStateCache(DefaultStateCacheSize),
+	}
+}
+
+// SetStateCacheSize changes the number of regenerated states that are kept in memory, and clears the cache.
+func (f *FinalizedChain) SetStateCacheSize(size int) {
+	f.Lock()
+	defer f.Unlock()
+	f.stateCache = newStateCache(size)
+}
+
+// LoadFinalizedChain restores a FinalizedChain from a persisted index, and continues to persist to it.
+// The entries are checked for consistency, and the state of the last entry must be available in the stateDB.
+func LoadFinalizedChain(ctx context.Context, spec *common.Spec, stateDB states.DB, index ColdIndex) (*FinalizedChain, error) {
+	f := NewFinalizedChain(spec, stateDB)
+	// Backfilled entries are appended to the index in descending order, after the entries they precede.
+	backfilled := make(map[Step]backfillRoots)
+	if err := index.Load(func(step Step, blockRoot Root, stateRoot Root) error {
+		if len(f.StateRoots) != 0 && step < f.start() {
+			backfilled[step] = backfillRoots{blockRoot: blockRoot, stateRoot: stateRoot}
+			return nil
+		}
+		if err := f.checkAppend(step); err != nil {
+			return err
+		}
+		f.appendRoots(step, blockRoot, stateRoot)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to load cold chain index: %v", err)
+	}
+	f.loadBackfilled(backfilled)
+	f.Index = index
+	if len(f.StateRoots) == 0 {
+		return f, nil
+	}
+	last := f.end() - 1
+	state, err := f.getState(ctx, last)
+	if err != nil {
+		return nil, fmt.Errorf("cold chain index is inconsistent with states DB: %v", err)
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != f.stateRoot(last) {
+		return nil, fmt.Errorf("cold chain index is inconsistent with states DB: state %s has root %s",
+			f.stateRoot(last), root)
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return nil, err
 	}
+	f.PubkeyCache, err = common.NewPubkeyCache(vals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pubkey cache: %v", err)
+	}
+	return f, nil
+}
+
+// Copy creates an in-memory copy of the finalized chain.
+// New states and archived epochs of the copy are kept in memory,
+// on top of the states DB and archive of this chain, which are not modified.
+// The copy does not persist to the index.
+func (f *FinalizedChain) Copy() *FinalizedChain {
+	f.RLock()
+	defer f.RUnlock()
+	out := &FinalizedChain{
+		PubkeyCache:   f.PubkeyCache,
+		BlockRoots:    append(make([]Root, 0, cap(f.BlockRoots)), f.BlockRoots...),
+		StateRoots:    append(make([]Root, 0, cap(f.StateRoots)), f.StateRoots...),
+		BlockRootsMap: make(map[Root]Slot, len(f.BlockRootsMap)),
+		StateRootsMap: make(map[Root]Step, len(f.StateRootsMap)),
+		Spec:          f.Spec,
+		StateDB:       states.NewOverlayDB(f.Spec, f.StateDB),
+		StatePolicy:   f.StatePolicy,
+		BlocksDB:      f.BlocksDB,
+		stateCache:    newStateCache(f.stateCache.size),
+		startStep:     f.startStep,
+		stateStart:    f.stateStart,
+	}
+	if f.Archive != nil {
+		// Epochs finalized by the copy are hypothetical, they are archived in memory only.
+		out.Archive = NewOverlayEpochArchive(f.Archive)
+	}
+	for k, v := range f.BlockRootsMap {
+		out.BlockRootsMap[k] = v
+	}
+	for k, v := range f.StateRootsMap {
+		out.StateRootsMap[k] = v
+	}
+	return out
+}
+
+// Close closes the index, if any. The states DB is not closed.
+func (f *FinalizedChain) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.Index == nil {
+		return nil
+	}
+	return f.Index.Close()
 }
 
 type ColdChainIter struct {
@@ -144,7 +266,7 @@ func (f *FinalizedChain) start() Step {
 	if len(f.StateRoots) == 0 {
 		return 0
 	}
-	return f.StateRootsMap[f.StateRoots[0]]
+	return f.startStep
 }
 
 // End step of the cold chain part (exclusive), should equal the epoch start slot of the finalized checkpoint,
@@ -249,7 +371,7 @@ func (f *FinalizedChain) Search(parentRoot *Root, slot *Slot) ([]SearchEntry, er
 	defer f.RUnlock()
 	// Searching the cold chain is a lot easier: there is at most 1 entry to retrieve.
 	if slot != nil {
-		entry, ok := f.ByCanonStep(AsStep(*slot, true))
+		entry, ok := f.byCanonStep(AsStep(*slot, true))
 		if !ok {
 			return nil, nil
 		}
@@ -305,10 +427,10 @@ func (f *FinalizedChain) ByCanonStep(step Step) (entry ChainEntry, ok bool) {
 }
 
 func (f *FinalizedChain) byCanonStep(step Step) (entry ChainEntry, ok bool) {
-	if start := f.ColdStart(); step < start {
+	if start := f.start(); step < start {
 		return nil, false
 	}
-	if end := f.ColdEnd(); step >= end {
+	if end := f.end(); step >= end {
 		return nil, false
 	}
 	return &FinalizedEntryView{
@@ -325,14 +447,14 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 
 	// If the chain is not empty, we need to verify consistency with what we add.
 	if len(f.StateRoots) != 0 {
-		end := f.ColdEnd()
-		if end > next {
-			return fmt.Errorf("received finalized entry %s at %s, but already finalized up to later step %s", blockRoot, next, end)
+		last := f.end() - 1
+		// The last entry may be repeated, e.g. when the hot chain was resumed from it.
+		if next == last && f.BlockRoots[len(f.BlockRoots)-1] == blockRoot &&
+			f.StateRoots[len(f.StateRoots)-1] == entry.StateRoot() {
+			return nil
 		}
-		// Any direct follow-up (block after slot, slot after block),
-		// or if the end is a gap slot, it may be left empty.
-		if !(end+1 == next || (!end.Block() && end+2 == next)) {
-			return fmt.Errorf("consistency issue, got %s and cannot append to %s", next, end)
+		if err := f.checkAppend(next); err != nil {
+			return err
 		}
 		// check parent root
 		parent := entry.ParentRoot()
@@ -341,6 +463,16 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 		}
 	}
 
+	// The state of the last entry is always stored, to resume from.
+	// It is removed again when the next entry is added, if the StatePolicy does not keep it.
+	var prevStep Step
+	var prevStateRoot Root
+	hasPrev := len(f.StateRoots) != 0
+	if hasPrev {
+		prevStep = f.end() - 1
+		prevStateRoot = f.StateRoots[len(f.StateRoots)-1]
+	}
+
 	// Before modifying the chain tracking, try to store the state, so it is safe to abort on error
 	state, err := entry.State(ctx)
 	if err != nil {
@@ -350,6 +482,61 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 		return fmt.Errorf("failed to store state of new finalized entry %s: %v", next, err)
 	}
 
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve context of new finalized entry %s: %v", next, err)
+	}
+
+	stateRoot := entry.StateRoot()
+	// Persist the entry after the state, an index entry should never point to a missing state.
+	if f.Index != nil {
+		if err := f.Index.Append(next, blockRoot, stateRoot); err != nil {
+			return fmt.Errorf("failed to persist new finalized entry %s: %v", next, err)
+		}
+	}
+	f.appendRoots(next, blockRoot, stateRoot)
+	if f.Archive != nil && (!hasPrev || f.Spec.SlotToEpoch(prevStep.Slot()) != f.Spec.SlotToEpoch(next.Slot())) {
+		// Missing archive data is computed again when requested, no need to fail finalization.
+		_ = f.archiveEpochsContext(epc)
+	}
+	if hasPrev && prevStateRoot != stateRoot && !f.keepState(prevStep) {
+		// A left-over state does not hurt, it is only wasting space, no need to fail finalization.
+		_ = f.StateDB.Remove(prevStateRoot)
+	}
+	// Adopt the pubkey cache of the entry, it is a superset of the pubkeys that are finalized.
+	f.PubkeyCache = epc.ValidatorPubkeyCache
+	return nil
+}
+
+// checkAppend checks if the given step can be appended to the (non-empty) chain.
+func (f *FinalizedChain) checkAppend(next Step) error {
+	if len(f.StateRoots) == 0 {
+		return nil
+	}
+	end := f.end()
+	if next < end {
+		return fmt.Errorf("received finalized entry at %s, but already finalized up to later step %s", next, end)
+	}
+	// Any direct follow-up (block after slot, slot after block),
+	// or if the last entry is a gap slot, the block step of it may be left empty.
+	if !(next == end || (end.Block() && next == end+1)) {
+		return fmt.Errorf("consistency issue, got %s and cannot append to %s", next, end)
+	}
+	return nil
+}
+
+// appendRoots adds the roots of the next step, the step must have been checked with checkAppend.
+func (f *FinalizedChain) appendRoots(next Step, blockRoot Root, stateRoot Root) {
+	if len(f.StateRoots) == 0 {
+		f.startStep = next
+		f.stateStart = next
+	}
+	// The block step of a gap slot is filled with a copy of the slot step, to keep the chain indexed by step.
+	if len(f.StateRoots) != 0 && next == f.end()+1 {
+		f.BlockRoots = append(f.BlockRoots, f.BlockRoots[len(f.BlockRoots)-1])
+		f.StateRoots = append(f.StateRoots, f.StateRoots[len(f.StateRoots)-1])
+	}
+
 	// Add block (may be a repeat of last)
 	f.BlockRoots = append(f.BlockRoots, blockRoot)
 	// Track the first occurrence
@@ -358,22 +545,32 @@ func (f *FinalizedChain) OnFinalizedEntry(ctx context.Context, entry ChainEntry)
 	}
 
 	// Add new state
-	stateRoot := entry.StateRoot()
 	f.StateRoots = append(f.StateRoots, stateRoot)
-	f.StateRootsMap[stateRoot] = next
-	return nil
+	if _, ok := f.StateRootsMap[stateRoot]; !ok {
+		f.StateRootsMap[stateRoot] = next
+	}
 }
 
 func (f *FinalizedChain) entryParentRoot(slot Slot) (root Root) {
-	return f.entryBlockRoot(AsStep(slot, false))
+	f.RLock()
+	defer f.RUnlock()
+	// The parent of the first block of the chain may be unknown
+	if step := AsStep(slot, false); step >= f.start() {
+		return f.entryBlockRootUnlocked(step)
+	}
+	return Root{}
 }
 
 func (f *FinalizedChain) entryBlockRoot(step Step) (root Root) {
 	f.RLock()
 	defer f.RUnlock()
+	return f.entryBlockRootUnlocked(step)
+}
+
+func (f *FinalizedChain) entryBlockRootUnlocked(step Step) (root Root) {
 	start := f.start()
 	end := f.end()
-	if start < step || step >= end {
+	if step < start || step >= end {
 		panic("out of bounds internal usage error")
 	}
 	return f.BlockRoots[step-start]
@@ -388,7 +585,7 @@ func (f *FinalizedChain) entryStateRoot(step Step) Root {
 func (f *FinalizedChain) stateRoot(step Step) Root {
 	start := f.start()
 	end := f.end()
-	if start < step || step >= end {
+	if step < start || step >= end {
 		panic("out of bounds internal usage error")
 	}
 	return f.StateRoots[step-start]
@@ -397,21 +594,33 @@ func (f *FinalizedChain) stateRoot(step Step) Root {
 func (f *FinalizedChain) entryGetEpochsContext(ctx context.Context, step Step) (*common.EpochsContext, error) {
 	f.RLock()
 	defer f.RUnlock()
-	epc := &common.EpochsContext{
-		ValidatorPubkeyCache: f.PubkeyCache,
-	}
-	// We do not store shuffling for older epochs
-	// TODO: maybe store it after all, for archive node functionality?
 	state, err := f.getState(ctx, step)
 	if err != nil {
 		return nil, err
 	}
+	if f.Archive != nil {
+		return f.archivedEpochsContext(state, f.Spec.SlotToEpoch(step.Slot()))
+	}
+	return f.stateEpochsContext(state)
+}
+
+// stateEpochsContext computes the context of a finalized state, using the pubkey cache of the chain.
+func (f *FinalizedChain) stateEpochsContext(state common.BeaconState) (*common.EpochsContext, error) {
+	epc := &common.EpochsContext{
+		Spec:                 f.Spec,
+		ValidatorPubkeyCache: f.PubkeyCache,
+	}
 	if err := epc.LoadShuffling(state); err != nil {
 		return nil, err
 	}
 	if err := epc.LoadProposers(state); err != nil {
 		return nil, err
 	}
+	if syncState, ok := state.(common.SyncCommitteeBeaconState); ok {
+		if err := epc.LoadSyncCommittees(syncState); err != nil {
+			return nil, err
+		}
+	}
 	return epc, nil
 }
 
@@ -423,9 +632,15 @@ func (f *FinalizedChain) entryGetState(ctx context.Context, step Step) (common.B
 
 func (f *FinalizedChain) getState(ctx context.Context, step Step) (common.BeaconState, error) {
 	root := f.stateRoot(step)
+	if step < f.stateStart {
+		return nil, fmt.Errorf("no state available for backfilled step %s", step)
+	}
 	if root == (common.Root{}) {
 		return nil, fmt.Errorf("unknown state, step out of range: %s", step)
 	}
+	if !f.keepState(step) && step != f.end()-1 {
+		return f.regenState(ctx, step)
+	}
 	state, err := f.StateDB.Get(ctx, root)
 	if err != nil {
 		return nil, err
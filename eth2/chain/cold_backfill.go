@@ -0,0 +1,194 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// backfillRoots are the roots of a backfilled step. The state root is zero if unknown.
+type backfillRoots struct {
+	blockRoot Root
+	stateRoot Root
+}
+
+// BackfillTarget returns the root of the block that Backfill expects next, and the slot the block must be before.
+// The root is zero if the chain is backfilled up to genesis.
+func (f *FinalizedChain) BackfillTarget(ctx context.Context) (root Root, beforeSlot Slot, err error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.backfillTarget(ctx)
+}
+
+func (f *FinalizedChain) backfillTarget(ctx context.Context) (root Root, beforeSlot Slot, err error) {
+	if len(f.StateRoots) == 0 {
+		return Root{}, 0, errors.New("cannot backfill an empty chain")
+	}
+	start := f.start()
+	if start.Slot() == 0 {
+		return Root{}, 0, nil
+	}
+	if !start.Block() {
+		// The pre-block step has the root of the last block before the slot.
+		return f.BlockRoots[0], start.Slot(), nil
+	}
+	// The chain starts with the block of the anchor, the anchor state knows the parent.
+	state, err := f.getState(ctx, start)
+	if err != nil {
+		return Root{}, 0, fmt.Errorf("failed to get anchor state to find parent of first block: %v", err)
+	}
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		return Root{}, 0, err
+	}
+	return header.ParentRoot, start.Slot(), nil
+}
+
+// Backfill extends the chain backwards with blocks from before the first entry, e.g. after a checkpoint sync.
+// The blocks must be ordered by descending slot, starting with the block that BackfillTarget returns.
+// Each block root is checked against the parent root of the next block,
+// and the proposer signatures are verified in one batch with the pubkey cache of the chain.
+// The backfilled entries have no states, only the block roots, and the state roots of the blocks.
+// The blocks are stored in the BlocksDB, if any, and the entries are persisted to the Index, if any.
+// If there is an error, the chain and the index are not modified. Blocks that were already stored remain in the BlocksDB.
+func (f *FinalizedChain) Backfill(ctx context.Context, benvs []*common.BeaconBlockEnvelope) error {
+	f.Lock()
+	defer f.Unlock()
+	if len(benvs) == 0 {
+		return nil
+	}
+	expected, before, err := f.backfillTarget(ctx)
+	if err != nil {
+		return err
+	}
+	anchorState, err := f.getState(ctx, f.stateStart)
+	if err != nil {
+		return fmt.Errorf("failed to get anchor state: %v", err)
+	}
+	genesisValRoot, err := anchorState.GenesisValidatorsRoot()
+	if err != nil {
+		return err
+	}
+
+	batch := new(common.SignatureBatch)
+	// The steps to add, in descending order
+	var steps []Step
+	var roots []backfillRoots
+	next := f.start()
+	for i, benv := range benvs {
+		if expected == (Root{}) && before == 0 {
+			return fmt.Errorf("block %d of backfill (%s) is before genesis", i, benv.BlockRoot)
+		}
+		if benv.BlockRoot != expected {
+			return fmt.Errorf("block %d of backfill has root %s, expected %s", i, benv.BlockRoot, expected)
+		}
+		if benv.Slot >= before {
+			return fmt.Errorf("block %d of backfill (%s) has slot %d, expected a slot before %d",
+				i, benv.BlockRoot, benv.Slot, before)
+		}
+		// The genesis block has no signature
+		if benv.Slot != 0 {
+			pub, ok := f.PubkeyCache.Pubkey(benv.ProposerIndex)
+			if !ok {
+				return fmt.Errorf("block %d of backfill (%s) has unknown proposer %d", i, benv.BlockRoot, benv.ProposerIndex)
+			}
+			version := f.Spec.ForkVersion(benv.Slot)
+			if !benv.VerifySignatureBatched(f.Spec, version, genesisValRoot, benv.ProposerIndex, pub, batch) {
+				return fmt.Errorf("block %d of backfill (%s) has an invalid signature", i, benv.BlockRoot)
+			}
+		}
+		// The steps after the block, up to the entries that were added before, all have the block as last block.
+		blockStep := AsStep(benv.Slot, true)
+		for step := next - 1; step > blockStep; step-- {
+			steps = append(steps, step)
+			roots = append(roots, backfillRoots{blockRoot: benv.BlockRoot})
+		}
+		steps = append(steps, blockStep)
+		roots = append(roots, backfillRoots{blockRoot: benv.BlockRoot, stateRoot: benv.StateRoot})
+		next = blockStep
+		// The genesis block has no step before it
+		if benv.Slot != 0 {
+			steps = append(steps, blockStep-1)
+			roots = append(roots, backfillRoots{blockRoot: benv.ParentRoot})
+			next = blockStep - 1
+		}
+		expected, before = benv.ParentRoot, benv.Slot
+		if benv.Slot == 0 {
+			expected = Root{}
+		}
+	}
+	if err := batch.VerifyBatch(); err != nil {
+		return fmt.Errorf("failed to verify signatures of backfill: %v", err)
+	}
+
+	if f.BlocksDB != nil {
+		for _, benv := range benvs {
+			if _, err := f.BlocksDB.Store(ctx, benv); err != nil {
+				return fmt.Errorf("failed to store backfilled block %s: %v", benv.BlockRoot, err)
+			}
+		}
+	}
+	if f.Index != nil {
+		// All entries are persisted at once, a failure leaves no partial backfill in the index.
+		entries := make([]ColdIndexEntry, len(steps))
+		for i, step := range steps {
+			entries[i] = ColdIndexEntry{Step: step, BlockRoot: roots[i].blockRoot, StateRoot: roots[i].stateRoot}
+		}
+		if err := f.Index.AppendBatch(entries); err != nil {
+			return fmt.Errorf("failed to persist backfilled entries: %v", err)
+		}
+	}
+	f.prependRoots(steps, roots)
+	return nil
+}
+
+// prependRoots adds the roots of the given steps before the start of the chain.
+// The steps must be in descending order, and continue from the start of the chain.
+func (f *FinalizedChain) prependRoots(steps []Step, roots []backfillRoots) {
+	n := len(steps)
+	if n == 0 {
+		return
+	}
+	blockRoots := make([]Root, n, n+len(f.BlockRoots))
+	stateRoots := make([]Root, n, n+len(f.StateRoots))
+	for i, step := range steps {
+		r := roots[i]
+		blockRoots[n-1-i] = r.blockRoot
+		stateRoots[n-1-i] = r.stateRoot
+		// Descending order: the last write is the first occurrence
+		if r.blockRoot != (Root{}) {
+			f.BlockRootsMap[r.blockRoot] = step.Slot()
+		}
+		if r.stateRoot != (Root{}) {
+			f.StateRootsMap[r.stateRoot] = step
+		}
+	}
+	f.BlockRoots = append(blockRoots, f.BlockRoots...)
+	f.StateRoots = append(stateRoots, f.StateRoots...)
+	f.startStep = steps[n-1]
+}
+
+// loadBackfilled adds the backfilled entries that were loaded from the index.
+func (f *FinalizedChain) loadBackfilled(backfilled map[Step]backfillRoots) {
+	if len(backfilled) == 0 || len(f.StateRoots) == 0 {
+		return
+	}
+	var steps []Step
+	var roots []backfillRoots
+	for step := f.start(); step > 0; {
+		step--
+		r, ok := backfilled[step]
+		if !ok {
+			break
+		}
+		steps = append(steps, step)
+		roots = append(roots, r)
+	}
+	// A block step without the pre-block step is an incomplete backfill,
+	// the parent of the block is unknown: drop it, the block can be backfilled again.
+	if n := len(steps); n > 0 && steps[n-1].Block() && steps[n-1].Slot() != 0 {
+		steps, roots = steps[:n-1], roots[:n-1]
+	}
+	f.prependRoots(steps, roots)
+}
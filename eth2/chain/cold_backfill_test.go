@@ -0,0 +1,156 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestCheckpointSyncBackfill(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	genesisState := chaintest.Genesis(t, spec)
+	genesisValRoot, err := genesisState.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := common.ComputeForkDigest(spec.GENESIS_FORK_VERSION, genesisValRoot)
+	genesisBlock := (&phase0.SignedBeaconBlock{
+		Message: phase0.BeaconBlock{StateRoot: genesisState.HashTreeRoot(tree.GetHashFn())},
+	}).Envelope(spec, digest)
+
+	// the chain to sync from
+	src, err := NewHotColdChain(genesisState, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := genesisBlock.BlockRoot
+	var history []*common.BeaconBlockEnvelope
+	for _, slot := range []Slot{1, 2, 4} {
+		benv := testBlock(t, spec, src, parent, slot, 0)
+		if err := src.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, benv)
+		parent = benv.BlockRoot
+	}
+	b1, b2, b4 := history[0], history[1], history[2]
+	// the checkpoint is an empty slot after block 4
+	anchor, err := src.Towards(ctx, b4.BlockRoot, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchorState, err := anchor.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateDB := states.NewMemDB(spec)
+	dir := t.TempDir()
+	index, err := OpenColdIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coldCh, err := LoadFinalizedChain(ctx, spec, stateDB, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocksDB := blocks.NewMemDB(spec, beacon.NewForkDecoder(spec, genesisValRoot))
+	coldCh.BlocksDB = blocksDB
+	if _, err := NewCheckpointHotColdChain(ctx, anchorState, b2, spec, coldCh); err == nil {
+		t.Fatal("expected anchor state to not match other block")
+	}
+	ch, err := NewCheckpointHotColdChain(ctx, anchorState, b4, spec, coldCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start := ch.ColdStart(); start != AsStep(4, false) {
+		t.Fatalf("expected anchor block to be backfilled, cold chain starts at %s", start)
+	}
+	if root, before, err := coldCh.BackfillTarget(ctx); err != nil || root != b2.BlockRoot || before != 4 {
+		t.Fatalf("unexpected backfill target %s before %d (err: %v)", root, before, err)
+	}
+
+	// blocks out of order, or with a bad signature, are rejected
+	if err := coldCh.Backfill(ctx, []*common.BeaconBlockEnvelope{b1, b2}); err == nil {
+		t.Fatal("expected out of order backfill to fail")
+	}
+	badSig := *b1
+	badSig.Signature = chaintest.Sign(t, badSig.ProposerIndex, Root{0xba, 0xd})
+	if err := coldCh.Backfill(ctx, []*common.BeaconBlockEnvelope{b2, &badSig}); err == nil {
+		t.Fatal("expected backfill with bad signature to fail")
+	}
+	if start := ch.ColdStart(); start != AsStep(4, false) {
+		t.Fatalf("expected failed backfill to not change the chain, starts at %s", start)
+	}
+
+	if err := coldCh.Backfill(ctx, []*common.BeaconBlockEnvelope{b2, b1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coldCh.Backfill(ctx, []*common.BeaconBlockEnvelope{genesisBlock}); err != nil {
+		t.Fatal(err)
+	}
+	if root, _, err := coldCh.BackfillTarget(ctx); err != nil || root != (Root{}) {
+		t.Fatalf("expected backfill to be complete, got target %s (err: %v)", root, err)
+	}
+
+	checkHistory := func(f *FinalizedChain) {
+		if start := f.ColdStart(); start != AsStep(0, true) {
+			t.Fatalf("expected chain to start at genesis, got %s", start)
+		}
+		for _, benv := range []*common.BeaconBlockEnvelope{genesisBlock, b1, b2, b4} {
+			entry, ok := f.ByBlock(benv.BlockRoot)
+			if !ok {
+				t.Fatalf("cannot find backfilled block %s", benv.BlockRoot)
+			}
+			if entry.Step() != AsStep(benv.Slot, true) || entry.StateRoot() != benv.StateRoot {
+				t.Fatalf("unexpected entry for block %s: step %s", benv.BlockRoot, entry.Step())
+			}
+			if benv.Slot != 0 && entry.ParentRoot() != benv.ParentRoot {
+				t.Fatalf("unexpected parent of block %s", benv.BlockRoot)
+			}
+		}
+		if entry, ok := f.ByBlockSlot(b2.BlockRoot, 3); !ok || entry.BlockRoot() != b2.BlockRoot {
+			t.Fatal("cannot find gap slot after backfilled block")
+		}
+		if entry, ok := f.ByStateRoot(b1.StateRoot); !ok || entry.Step() != AsStep(1, true) {
+			t.Fatal("cannot find backfilled block by state root")
+		}
+		entry, _ := f.ByBlock(b1.BlockRoot)
+		if _, err := entry.State(ctx); err == nil {
+			t.Fatal("expected backfilled entry to have no state")
+		}
+	}
+	checkHistory(coldCh)
+	if stored, err := blocksDB.Get(ctx, b1.BlockRoot); err != nil || stored == nil {
+		t.Fatalf("expected backfilled block to be stored (err: %v)", err)
+	}
+
+	// the chain continues to work on top of the checkpoint
+	next := testBlock(t, spec, ch, b4.BlockRoot, 7, 0)
+	if err := ch.AddBlock(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backfilled history is persisted
+	if err := coldCh.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = OpenColdIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	resumed, err := LoadFinalizedChain(ctx, spec, stateDB, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistory(resumed)
+}
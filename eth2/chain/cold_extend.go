@@ -0,0 +1,131 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// replayEntry is an entry that is regenerated by replaying blocks, to append to the FinalizedChain.
+// The state and context are shared with the replay, and copied when requested.
+type replayEntry struct {
+	step       Step
+	blockRoot  Root
+	parentRoot Root
+	stateRoot  Root
+	state      common.BeaconState
+	epc        *common.EpochsContext
+}
+
+func (e *replayEntry) Step() Step {
+	return e.step
+}
+
+func (e *replayEntry) BlockRoot() Root {
+	return e.blockRoot
+}
+
+func (e *replayEntry) ParentRoot() Root {
+	return e.parentRoot
+}
+
+func (e *replayEntry) StateRoot() Root {
+	return e.stateRoot
+}
+
+func (e *replayEntry) EpochsContext(ctx context.Context) (*common.EpochsContext, error) {
+	return e.epc.Clone(), nil
+}
+
+func (e *replayEntry) State(ctx context.Context) (common.BeaconState, error) {
+	return e.state.CopyState()
+}
+
+// Extend appends finalized history to the chain, by replaying the given blocks on top of the last entry,
+// up to and including the step before block processing of toSlot.
+// The blocks must be ordered by slot, and build on the last block of the chain.
+// The blocks are trusted to be finalized: signatures are not verified, but the state root of every block is.
+// The blocks are stored in the BlocksDB, if any.
+// If there is an error, the chain is extended up to the last valid entry.
+func (f *FinalizedChain) Extend(ctx context.Context, benvs []*common.BeaconBlockEnvelope, toSlot Slot) error {
+	if f.ColdStart() == f.ColdEnd() {
+		return errors.New("cannot extend an empty chain")
+	}
+	lastStep := f.ColdEnd() - 1
+	last, ok := f.ByCanonStep(lastStep)
+	if !ok {
+		return fmt.Errorf("cannot find last entry %s", lastStep)
+	}
+	state, err := last.State(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get state of last entry %s: %v", lastStep, err)
+	}
+	epc, err := last.EpochsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get context of last entry %s: %v", lastStep, err)
+	}
+	blockRoot := last.BlockRoot()
+
+	applyBlock := func(benv *common.BeaconBlockEnvelope) error {
+		if benv.ParentRoot != blockRoot {
+			return fmt.Errorf("block %s at slot %d has parent %s, expected %s",
+				benv.BlockRoot, benv.Slot, benv.ParentRoot, blockRoot)
+		}
+		if err := common.PostSlotTransition(ctx, f.Spec, epc, state, benv, false); err != nil {
+			return fmt.Errorf("failed to replay block %s at slot %d: %v", benv.BlockRoot, benv.Slot, err)
+		}
+		stateRoot := state.HashTreeRoot(tree.GetHashFn())
+		if stateRoot != benv.StateRoot {
+			return fmt.Errorf("replayed block %s at slot %d has state root %s, expected %s",
+				benv.BlockRoot, benv.Slot, stateRoot, benv.StateRoot)
+		}
+		if f.BlocksDB != nil {
+			if _, err := f.BlocksDB.Store(ctx, benv); err != nil {
+				return fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+			}
+		}
+		entry := &replayEntry{step: AsStep(benv.Slot, true), blockRoot: benv.BlockRoot, parentRoot: blockRoot,
+			stateRoot: stateRoot, state: state, epc: epc}
+		if err := f.OnFinalizedEntry(ctx, entry); err != nil {
+			return err
+		}
+		blockRoot = benv.BlockRoot
+		return nil
+	}
+
+	i := 0
+	// The last entry may be a slot without its block processed yet
+	if !lastStep.Block() && lastStep.Slot() < toSlot && len(benvs) > 0 && benvs[0].Slot == lastStep.Slot() {
+		if err := applyBlock(benvs[0]); err != nil {
+			return err
+		}
+		i++
+	}
+	for slot := lastStep.Slot() + 1; slot <= toSlot; slot++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		state, err = processNextSlot(ctx, f.Spec, epc, state)
+		if err != nil {
+			return fmt.Errorf("failed to process slot %d: %v", slot, err)
+		}
+		entry := &replayEntry{step: AsStep(slot, false), blockRoot: blockRoot, parentRoot: blockRoot,
+			stateRoot: state.HashTreeRoot(tree.GetHashFn()), state: state, epc: epc}
+		if err := f.OnFinalizedEntry(ctx, entry); err != nil {
+			return err
+		}
+		if slot < toSlot && i < len(benvs) && benvs[i].Slot == slot {
+			if err := applyBlock(benvs[i]); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	if i < len(benvs) {
+		return fmt.Errorf("block %s at slot %d is not within the replayed slots, or out of order",
+			benvs[i].BlockRoot, benvs[i].Slot)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// ColdIndex persists the roots of the FinalizedChain, so the cold chain can be restored after a restart.
+// The states themselves are not part of the index, these are stored in the states.DB of the FinalizedChain.
+type ColdIndex interface {
+	// Append persists the roots of the next step of the cold chain,
+	// or of the step before the first step, when backfilling the chain.
+	// The entry is durable when Append returns without error.
+	Append(step Step, blockRoot Root, stateRoot Root) error
+	// AppendBatch persists the entries like Append, in the given order, as a single write.
+	// If there is an error, none of the entries are persisted.
+	AppendBatch(entries []ColdIndexEntry) error
+	// Load calls fn for every persisted entry, in the order the entries were appended.
+	Load(fn func(step Step, blockRoot Root, stateRoot Root) error) error
+	io.Closer
+}
+
+// ColdIndexEntry is a step of the cold chain with its roots, as persisted in the ColdIndex.
+type ColdIndexEntry struct {
+	Step      Step
+	BlockRoot Root
+	StateRoot Root
+}
+
+// ColdIndexFileName is the name of the cold index file within a chain data directory.
+const ColdIndexFileName = "cold.idx"
+
+var coldIndexMagic = [8]byte{'z', 'r', 'n', 't', 'c', 'i', 'd', 'x'}
+
+const coldIndexVersion uint32 = 1
+
+const coldIndexHeaderSize = 8 + 4
+
+// step (8) + block root (32) + state root (32) + crc32 checksum (4)
+const coldIndexRecordSize = 8 + 32 + 32 + 4
+
+var coldIndexTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileColdIndex is an append-only file with fixed-size checksummed records, one per cold chain step.
+// Every append is synced to disk before returning.
+// A partially written last record (e.g. due to a crash during Append) is discarded when the file is opened.
+type FileColdIndex struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+var _ ColdIndex = (*FileColdIndex)(nil)
+
+// OpenColdIndex opens (or creates) the cold index in the given data directory.
+func OpenColdIndex(dataDir string) (*FileColdIndex, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chain data dir: %v", err)
+	}
+	return NewFileColdIndex(path.Join(dataDir, ColdIndexFileName))
+}
+
+// NewFileColdIndex opens (or creates) a cold index file.
+// The file header and all records are checked, a torn write at the end of the file is truncated.
+func NewFileColdIndex(filePath string) (*FileColdIndex, error) {
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	idx := &FileColdIndex{f: f}
+	if err := idx.init(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to open cold index %s: %v", filePath, err)
+	}
+	return idx, nil
+}
+
+func (idx *FileColdIndex) init() error {
+	info, err := idx.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size < coldIndexHeaderSize {
+		// Empty, or crashed while writing the header: (re)initialize the file.
+		var header [coldIndexHeaderSize]byte
+		copy(header[:8], coldIndexMagic[:])
+		binary.LittleEndian.PutUint32(header[8:], coldIndexVersion)
+		if err := idx.f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := idx.f.WriteAt(header[:], 0); err != nil {
+			return err
+		}
+		if err := idx.f.Sync(); err != nil {
+			return err
+		}
+		idx.size = coldIndexHeaderSize
+		return nil
+	}
+	var header [coldIndexHeaderSize]byte
+	if _, err := idx.f.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:8], coldIndexMagic[:]) {
+		return errors.New("not a cold index file")
+	}
+	if v := binary.LittleEndian.Uint32(header[8:]); v != coldIndexVersion {
+		return fmt.Errorf("unsupported cold index version %d", v)
+	}
+	// Discard any incomplete trailing record.
+	records := (size - coldIndexHeaderSize) / coldIndexRecordSize
+	valid := coldIndexHeaderSize + records*coldIndexRecordSize
+	if records > 0 {
+		// The last complete record may still be torn if the data was not fully synced.
+		var rec [coldIndexRecordSize]byte
+		if _, err := idx.f.ReadAt(rec[:], valid-coldIndexRecordSize); err != nil {
+			return err
+		}
+		if _, _, _, err := decodeColdIndexRecord(&rec); err != nil {
+			valid -= coldIndexRecordSize
+		}
+	}
+	if valid != size {
+		if err := idx.f.Truncate(valid); err != nil {
+			return err
+		}
+		if err := idx.f.Sync(); err != nil {
+			return err
+		}
+	}
+	idx.size = valid
+	return nil
+}
+
+func encodeColdIndexRecord(step Step, blockRoot Root, stateRoot Root) (out [coldIndexRecordSize]byte) {
+	binary.LittleEndian.PutUint64(out[0:8], uint64(step))
+	copy(out[8:40], blockRoot[:])
+	copy(out[40:72], stateRoot[:])
+	binary.LittleEndian.PutUint32(out[72:76], crc32.Checksum(out[:72], coldIndexTable))
+	return
+}
+
+func decodeColdIndexRecord(rec *[coldIndexRecordSize]byte) (step Step, blockRoot Root, stateRoot Root, err error) {
+	if crc32.Checksum(rec[:72], coldIndexTable) != binary.LittleEndian.Uint32(rec[72:76]) {
+		return 0, Root{}, Root{}, errors.New("checksum mismatch")
+	}
+	step = Step(binary.LittleEndian.Uint64(rec[0:8]))
+	copy(blockRoot[:], rec[8:40])
+	copy(stateRoot[:], rec[40:72])
+	return
+}
+
+func (idx *FileColdIndex) Append(step Step, blockRoot Root, stateRoot Root) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	rec := encodeColdIndexRecord(step, blockRoot, stateRoot)
+	if err := idx.write(rec[:]); err != nil {
+		return fmt.Errorf("failed to write cold index record for step %s: %v", step, err)
+	}
+	return nil
+}
+
+func (idx *FileColdIndex) AppendBatch(entries []ColdIndexEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	data := make([]byte, 0, len(entries)*coldIndexRecordSize)
+	for _, e := range entries {
+		rec := encodeColdIndexRecord(e.Step, e.BlockRoot, e.StateRoot)
+		data = append(data, rec[:]...)
+	}
+	if err := idx.write(data); err != nil {
+		return fmt.Errorf("failed to write %d cold index records, starting at step %s: %v", len(entries), entries[0].Step, err)
+	}
+	return nil
+}
+
+// write appends and syncs the records. On failure, whatever part of the records was written is dropped again.
+func (idx *FileColdIndex) write(data []byte) error {
+	if _, err := idx.f.WriteAt(data, idx.size); err != nil {
+		_ = idx.f.Truncate(idx.size)
+		return err
+	}
+	if err := idx.f.Sync(); err != nil {
+		_ = idx.f.Truncate(idx.size)
+		return err
+	}
+	idx.size += int64(len(data))
+	return nil
+}
+
+func (idx *FileColdIndex) Load(fn func(step Step, blockRoot Root, stateRoot Root) error) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	r := io.NewSectionReader(idx.f, coldIndexHeaderSize, idx.size-coldIndexHeaderSize)
+	var rec [coldIndexRecordSize]byte
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		step, blockRoot, stateRoot, err := decodeColdIndexRecord(&rec)
+		if err != nil {
+			return fmt.Errorf("cold index record %d is corrupt: %v", i, err)
+		}
+		if err := fn(step, blockRoot, stateRoot); err != nil {
+			return err
+		}
+	}
+}
+
+func (idx *FileColdIndex) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.f.Close()
+}
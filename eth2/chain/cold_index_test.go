@@ -0,0 +1,122 @@
+package chain
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+func TestFileColdIndexTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := OpenColdIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := Step(10); i < 13; i++ {
+		if err := idx.Append(i, Root{byte(i)}, Root{0xff, byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash halfway through writing a record
+	f, err := os.OpenFile(path.Join(dir, ColdIndexFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{13, 0, 0, 0, 0, 0, 0, 0, 0xaa}); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	idx, err = OpenColdIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	var steps []Step
+	if err := idx.Load(func(step Step, blockRoot Root, stateRoot Root) error {
+		if blockRoot != (Root{byte(step)}) || stateRoot != (Root{0xff, byte(step)}) {
+			t.Errorf("unexpected roots at step %s", step)
+		}
+		steps = append(steps, step)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 3 || steps[0] != 10 || steps[2] != 12 {
+		t.Fatalf("unexpected steps after recovery: %v", steps)
+	}
+	// appends continue after the recovered records, batches are written in order
+	if err := idx.AppendBatch([]ColdIndexEntry{
+		{Step: 13, BlockRoot: Root{13}, StateRoot: Root{0xff, 13}},
+		{Step: 14, BlockRoot: Root{14}, StateRoot: Root{0xff, 14}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	steps = steps[:0]
+	_ = idx.Load(func(step Step, blockRoot Root, stateRoot Root) error {
+		steps = append(steps, step)
+		return nil
+	})
+	if len(steps) != 5 || steps[3] != 13 || steps[4] != 14 {
+		t.Fatalf("unexpected steps after batch: %v", steps)
+	}
+}
+
+func TestOpenHotColdChainResume(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	stateDB := states.NewMemDB(spec)
+	dir := t.TempDir()
+
+	c, err := OpenHotColdChain(ctx, chaintest.Genesis(t, spec), spec, stateDB, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := c.HotChain.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Move some entries to the cold chain, like the hot chain would when pruning.
+	next, err := c.HotChain.Towards(ctx, genesis.BlockRoot(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []ChainEntry{genesis, next} {
+		if err := c.ColdChain.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := OpenHotColdChain(ctx, nil, spec, stateDB, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if start, end := resumed.ColdStart(), resumed.ColdEnd(); start != genesis.Step() || end != next.Step()+1 {
+		t.Fatalf("unexpected cold chain range after resume: %s - %s", start, end)
+	}
+	if entry, ok := resumed.ByStateRoot(genesis.StateRoot()); !ok || entry.Step() != genesis.Step() {
+		t.Fatal("expected to find genesis entry after resume")
+	}
+	head, err := resumed.HotChain.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.StateRoot() != next.StateRoot() {
+		t.Fatalf("expected hot chain to resume from last finalized entry %s, got %s", next.StateRoot(), head.StateRoot())
+	}
+	// the hot chain anchor moving to the cold chain again is accepted
+	if err := resumed.ColdChain.OnFinalizedEntry(ctx, head); err != nil {
+		t.Fatal(err)
+	}
+}
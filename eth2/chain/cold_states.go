@@ -0,0 +1,199 @@
+package chain
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+	"sync"
+)
+
+// StatePolicy decides if the state of a finalized entry is stored in the states DB of the FinalizedChain.
+// States that are not stored are regenerated by replaying blocks on top of the closest earlier stored state.
+type StatePolicy func(step Step) bool
+
+// KeepAllStates stores the state of every finalized entry.
+func KeepAllStates(step Step) bool {
+	return true
+}
+
+// KeepEpochStates only stores the state of the first slot (before block processing) of every N epochs.
+func KeepEpochStates(spec *common.Spec, epochs Epoch) StatePolicy {
+	if epochs == 0 {
+		epochs = 1
+	}
+	return func(step Step) bool {
+		if step.Block() {
+			return false
+		}
+		slot := step.Slot()
+		return slot%spec.SLOTS_PER_EPOCH == 0 && spec.SlotToEpoch(slot)%epochs == 0
+	}
+}
+
+// DefaultStateCacheSize is the number of regenerated states a FinalizedChain keeps in memory by default.
+const DefaultStateCacheSize = 8
+
+// stateCache is a LRU cache of regenerated states, by step.
+type stateCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[Step]*list.Element
+	order   *list.List
+}
+
+type stateCacheEntry struct {
+	step  Step
+	state common.BeaconState
+}
+
+func newStateCache(size int) *stateCache {
+	return &stateCache{
+		size:    size,
+		entries: make(map[Step]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// get returns a copy of the cached state, the cached state itself is never modified.
+func (c *stateCache) get(step Step) (common.BeaconState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[step]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	state, err := elem.Value.(*stateCacheEntry).state.CopyState()
+	if err != nil {
+		return nil, false
+	}
+	return state, true
+}
+
+func (c *stateCache) put(step Step, state common.BeaconState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if elem, ok := c.entries[step]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[step] = c.order.PushFront(&stateCacheEntry{step: step, state: state})
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*stateCacheEntry).step)
+	}
+}
+
+func (c *stateCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// keepState returns true if the state of the step is stored permanently.
+// The first entry with a state is always kept, it is the base to regenerate any other state from.
+func (f *FinalizedChain) keepState(step Step) bool {
+	return f.StatePolicy == nil || step == f.stateStart || f.StatePolicy(step)
+}
+
+// regenState regenerates the state of the given step,
+// by replaying the blocks on top of the closest earlier state that is stored or cached.
+func (f *FinalizedChain) regenState(ctx context.Context, step Step) (common.BeaconState, error) {
+	// The cache returns a copy, the cached state is not modified by the caller.
+	if state, ok := f.stateCache.get(step); ok {
+		return state, nil
+	}
+	if f.BlocksDB == nil {
+		return nil, fmt.Errorf("state of step %s is not stored, and no blocks DB to regenerate it with", step)
+	}
+	start := f.stateStart
+	var base common.BeaconState
+	baseStep := step
+	for base == nil {
+		if baseStep == start {
+			return nil, fmt.Errorf("no stored state to regenerate step %s from", step)
+		}
+		baseStep--
+		if state, ok := f.stateCache.get(baseStep); ok {
+			// The cache already returns a copy.
+			base = state
+		} else if f.keepState(baseStep) {
+			state, err := f.StateDB.Get(ctx, f.stateRoot(baseStep))
+			if err != nil {
+				return nil, err
+			}
+			if state == nil {
+				return nil, fmt.Errorf("stored state of step %s is missing, cannot regenerate step %s", baseStep, step)
+			}
+			// The DB may return the stored state itself, the replay must not modify it.
+			base, err = state.CopyState()
+			if err != nil {
+				return nil, fmt.Errorf("failed to copy stored state of step %s: %v", baseStep, err)
+			}
+		}
+	}
+	epc, err := f.stateEpochsContext(base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare context of state at step %s: %v", baseStep, err)
+	}
+	state := base
+	for next := baseStep + 1; next <= step; next++ {
+		if next.Block() {
+			// The block step of a gap slot is a copy of the slot step.
+			if f.stateRoot(next) == f.stateRoot(next-1) {
+				continue
+			}
+			blockRoot := f.entryBlockRootUnlocked(next)
+			benv, err := f.BlocksDB.Get(ctx, blockRoot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get block %s to regenerate step %s: %v", blockRoot, step, err)
+			}
+			if benv == nil {
+				return nil, fmt.Errorf("missing block %s to regenerate step %s", blockRoot, step)
+			}
+			// The block is finalized, and the resulting state root is verified, no need to verify signatures.
+			if err := common.PostSlotTransition(ctx, f.Spec, epc, state, benv, false); err != nil {
+				return nil, fmt.Errorf("failed to replay block %s to regenerate step %s: %v", blockRoot, step, err)
+			}
+		} else {
+			state, err = processNextSlot(ctx, f.Spec, epc, state)
+			if err != nil {
+				return nil, fmt.Errorf("failed to process slot %d to regenerate step %s: %v", next.Slot(), step, err)
+			}
+		}
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != f.stateRoot(step) {
+		return nil, fmt.Errorf("regenerated state of step %s has root %s, expected %s", step, root, f.stateRoot(step))
+	}
+	f.stateCache.put(step, state)
+	return state.CopyState()
+}
+
+// hasState returns true if the step has a state, backfilled steps have no states.
+func (f *FinalizedChain) hasState(step Step) bool {
+	f.RLock()
+	defer f.RUnlock()
+	return step >= f.stateStart
+}
+
+// repairState stores a regenerated state of the step, if the state of the step is meant to be stored.
+func (f *FinalizedChain) repairState(ctx context.Context, step Step, state common.BeaconState) (stored bool, err error) {
+	f.RLock()
+	defer f.RUnlock()
+	if step < f.stateStart || step >= f.end() {
+		return false, nil
+	}
+	if !f.keepState(step) && step != f.end()-1 {
+		return false, nil
+	}
+	if err := f.StateDB.Store(ctx, state); err != nil {
+		return false, err
+	}
+	return true, nil
+}
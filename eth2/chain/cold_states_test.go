@@ -0,0 +1,103 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func TestSparseColdStates(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	genesisState := chaintest.Genesis(t, spec)
+	genesisValRoot, err := genesisState.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDB := states.NewMemDB(spec)
+	blocksDB := blocks.NewMemDB(spec, beacon.NewForkDecoder(spec, genesisValRoot))
+	coldCh := NewFinalizedChain(spec, stateDB)
+	coldCh.StatePolicy = KeepEpochStates(spec, 1)
+	coldCh.BlocksDB = blocksDB
+	coldCh.SetStateCacheSize(2)
+	ch, err := NewHotColdChainFrom(ctx, genesisState, spec, coldCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blocks with gap slots in between
+	parent := head.BlockRoot()
+	for _, slot := range []Slot{1, 2, 3, 5} {
+		benv := testBlock(t, spec, ch, parent, slot, 0)
+		if _, err := blocksDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		parent = benv.BlockRoot
+	}
+	testFinalize(t, ch.HotChain.(*UnfinalizedChain), parent, 1)
+
+	start, end := ch.ColdStart(), ch.ColdEnd()
+	if start != AsStep(0, true) || end != AsStep(7, true) {
+		t.Fatalf("unexpected cold chain range: %s - %s", start, end)
+	}
+	for step := start; step < end; step++ {
+		entry, ok := ch.ColdChain.ByCanonStep(step)
+		if !ok {
+			t.Fatalf("missing cold entry %s", step)
+		}
+		stored, err := stateDB.Get(ctx, entry.StateRoot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expectStored := step == start || step == end-1; (stored != nil) != expectStored {
+			t.Fatalf("unexpected stored state at step %s: %v", step, stored != nil)
+		}
+		state, err := entry.State(ctx)
+		if err != nil {
+			t.Fatalf("failed to get state of step %s: %v", step, err)
+		}
+		if root := state.HashTreeRoot(tree.GetHashFn()); root != entry.StateRoot() {
+			t.Fatalf("regenerated state of step %s has root %s, expected %s", step, root, entry.StateRoot())
+		}
+		if _, err := entry.EpochsContext(ctx); err != nil {
+			t.Fatalf("failed to get context of step %s: %v", step, err)
+		}
+	}
+	if n := coldCh.stateCache.len(); n != 2 {
+		t.Fatalf("expected state cache to be full, got %d states", n)
+	}
+
+	// Regenerating the same state again does not modify the stored or cached base states.
+	for _, cacheSize := range []int{0, 2} {
+		coldCh.SetStateCacheSize(cacheSize)
+		entry, _ := ch.ColdChain.ByCanonStep(AsStep(3, true))
+		for i := 0; i < 2; i++ {
+			state, err := entry.State(ctx)
+			if err != nil {
+				t.Fatalf("failed to regenerate state (cache size %d, attempt %d): %v", cacheSize, i, err)
+			}
+			if root := state.HashTreeRoot(tree.GetHashFn()); root != entry.StateRoot() {
+				t.Fatalf("regenerated state has root %s, expected %s", root, entry.StateRoot())
+			}
+		}
+	}
+
+	// Without blocks, states that are not stored or cached cannot be regenerated.
+	coldCh.BlocksDB = nil
+	coldCh.SetStateCacheSize(2)
+	entry, _ := ch.ColdChain.ByCanonStep(AsStep(3, true))
+	if _, err := entry.State(ctx); err == nil {
+		t.Fatal("expected regeneration to fail without blocks")
+	}
+}
@@ -0,0 +1,368 @@
+package chain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// EpochArchive persists the shuffling and proposers of finalized epochs,
+// so the EpochsContext of cold chain entries does not have to be recomputed.
+//
+// Data is keyed by epoch and dependent root: the block root at the last slot of the epoch
+// that decided the randomness of the data (see FinalizedChain for the exact dependent roots).
+type EpochArchive interface {
+	// Shuffling gets the archived shuffling of the epoch, or nil if it is not archived.
+	Shuffling(epoch Epoch, dependentRoot Root) (*common.ShufflingEpoch, error)
+	// PutShuffling archives the shuffling. Archiving data that already exists is a no-op.
+	PutShuffling(dependentRoot Root, shuf *common.ShufflingEpoch) error
+	// Proposers gets the archived proposers of the epoch, or nil if it is not archived.
+	Proposers(epoch Epoch, dependentRoot Root) (*common.ProposersEpoch, error)
+	// PutProposers archives the proposers. Archiving data that already exists is a no-op.
+	PutProposers(dependentRoot Root, props *common.ProposersEpoch) error
+}
+
+type epochArchiveKey struct {
+	Epoch         Epoch
+	DependentRoot Root
+}
+
+// MemEpochArchive keeps the archive in memory.
+type MemEpochArchive struct {
+	sync.RWMutex
+	shufflings map[epochArchiveKey]*common.ShufflingEpoch
+	proposers  map[epochArchiveKey]*common.ProposersEpoch
+}
+
+var _ EpochArchive = (*MemEpochArchive)(nil)
+
+func NewMemEpochArchive() *MemEpochArchive {
+	return &MemEpochArchive{
+		shufflings: make(map[epochArchiveKey]*common.ShufflingEpoch),
+		proposers:  make(map[epochArchiveKey]*common.ProposersEpoch),
+	}
+}
+
+func (a *MemEpochArchive) Shuffling(epoch Epoch, dependentRoot Root) (*common.ShufflingEpoch, error) {
+	a.RLock()
+	defer a.RUnlock()
+	return a.shufflings[epochArchiveKey{epoch, dependentRoot}], nil
+}
+
+func (a *MemEpochArchive) PutShuffling(dependentRoot Root, shuf *common.ShufflingEpoch) error {
+	a.Lock()
+	defer a.Unlock()
+	a.shufflings[epochArchiveKey{shuf.Epoch, dependentRoot}] = shuf
+	return nil
+}
+
+func (a *MemEpochArchive) Proposers(epoch Epoch, dependentRoot Root) (*common.ProposersEpoch, error) {
+	a.RLock()
+	defer a.RUnlock()
+	return a.proposers[epochArchiveKey{epoch, dependentRoot}], nil
+}
+
+func (a *MemEpochArchive) PutProposers(dependentRoot Root, props *common.ProposersEpoch) error {
+	a.Lock()
+	defer a.Unlock()
+	a.proposers[epochArchiveKey{props.Epoch, dependentRoot}] = props
+	return nil
+}
+
+// OverlayEpochArchive keeps new entries in memory, and reads through to a base archive, which is not modified.
+type OverlayEpochArchive struct {
+	*MemEpochArchive
+	Base EpochArchive
+}
+
+var _ EpochArchive = (*OverlayEpochArchive)(nil)
+
+func NewOverlayEpochArchive(base EpochArchive) *OverlayEpochArchive {
+	return &OverlayEpochArchive{MemEpochArchive: NewMemEpochArchive(), Base: base}
+}
+
+func (a *OverlayEpochArchive) Shuffling(epoch Epoch, dependentRoot Root) (*common.ShufflingEpoch, error) {
+	if shuf, err := a.MemEpochArchive.Shuffling(epoch, dependentRoot); err != nil || shuf != nil {
+		return shuf, err
+	}
+	return a.Base.Shuffling(epoch, dependentRoot)
+}
+
+func (a *OverlayEpochArchive) Proposers(epoch Epoch, dependentRoot Root) (*common.ProposersEpoch, error) {
+	if props, err := a.MemEpochArchive.Proposers(epoch, dependentRoot); err != nil || props != nil {
+		return props, err
+	}
+	return a.Base.Proposers(epoch, dependentRoot)
+}
+
+// EpochArchiveDirName is the name of the epoch archive directory within a chain data directory.
+const EpochArchiveDirName = "epochs"
+
+// FileEpochArchive stores every shuffling and proposers entry in a separate file,
+// named after the kind of data, the epoch and the dependent root.
+// Files are written to a temporary file first, and then renamed, so a crash never leaves a partial entry.
+type FileEpochArchive struct {
+	spec     *common.Spec
+	basePath string
+}
+
+var _ EpochArchive = (*FileEpochArchive)(nil)
+
+// OpenEpochArchive opens (or creates) the epoch archive in the given chain data directory.
+func OpenEpochArchive(spec *common.Spec, dataDir string) (*FileEpochArchive, error) {
+	basePath := path.Join(dataDir, EpochArchiveDirName)
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create epoch archive dir: %v", err)
+	}
+	return &FileEpochArchive{spec: spec, basePath: basePath}, nil
+}
+
+func (a *FileEpochArchive) entryPath(kind string, epoch Epoch, dependentRoot Root) string {
+	return path.Join(a.basePath, fmt.Sprintf("%s_%d_0x%s.bin", kind, epoch, hex.EncodeToString(dependentRoot[:])))
+}
+
+func (a *FileEpochArchive) read(p string, fn func(r io.Reader) error) (exists bool, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	if err := fn(bufio.NewReader(f)); err != nil {
+		return true, fmt.Errorf("failed to read epoch archive entry %s: %v", p, err)
+	}
+	return true, nil
+}
+
+func (a *FileEpochArchive) write(p string, fn func(w io.Writer) error) error {
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	tmpPath := p + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := fn(w); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write epoch archive entry %s: %v", p, err)
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p)
+}
+
+func writeIndices(w io.Writer, indices []ValidatorIndex) error {
+	buf := make([]byte, 8+8*len(indices))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(len(indices)))
+	for i, v := range indices {
+		binary.LittleEndian.PutUint64(buf[8+8*i:], uint64(v))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// maxArchivedIndices limits allocations when reading a corrupt entry.
+const maxArchivedIndices = 1 << 24
+
+func readIndices(r io.Reader) ([]ValidatorIndex, error) {
+	var lenBuf [8]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint64(lenBuf[:])
+	if n > maxArchivedIndices {
+		return nil, errors.New("too many indices")
+	}
+	buf := make([]byte, 8*n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	out := make([]ValidatorIndex, n)
+	for i := range out {
+		out[i] = ValidatorIndex(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	return out, nil
+}
+
+func (a *FileEpochArchive) Shuffling(epoch Epoch, dependentRoot Root) (out *common.ShufflingEpoch, err error) {
+	_, err = a.read(a.entryPath("shuffling", epoch, dependentRoot), func(r io.Reader) error {
+		active, err := readIndices(r)
+		if err != nil {
+			return err
+		}
+		shuffling, err := readIndices(r)
+		if err != nil {
+			return err
+		}
+		if len(active) != len(shuffling) {
+			return errors.New("shuffling does not match active indices")
+		}
+		out = common.NewShufflingEpochFromShuffling(a.spec, epoch, active, shuffling)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *FileEpochArchive) PutShuffling(dependentRoot Root, shuf *common.ShufflingEpoch) error {
+	return a.write(a.entryPath("shuffling", shuf.Epoch, dependentRoot), func(w io.Writer) error {
+		if err := writeIndices(w, shuf.ActiveIndices); err != nil {
+			return err
+		}
+		return writeIndices(w, shuf.Shuffling)
+	})
+}
+
+func (a *FileEpochArchive) Proposers(epoch Epoch, dependentRoot Root) (out *common.ProposersEpoch, err error) {
+	_, err = a.read(a.entryPath("proposers", epoch, dependentRoot), func(r io.Reader) error {
+		var err error
+		props := &common.ProposersEpoch{Spec: a.spec, Epoch: epoch}
+		if props.Proposers, err = readIndices(r); err != nil {
+			return err
+		}
+		if uint64(len(props.Proposers)) != uint64(a.spec.SLOTS_PER_EPOCH) {
+			return fmt.Errorf("expected %d proposers, got %d", a.spec.SLOTS_PER_EPOCH, len(props.Proposers))
+		}
+		var shardInfo [3]uint64
+		if err := binary.Read(r, binary.LittleEndian, &shardInfo); err != nil {
+			return err
+		}
+		props.CommitteesPerSlot, props.ActiveShards = shardInfo[0], shardInfo[1]
+		if shardInfo[2] > uint64(a.spec.SLOTS_PER_EPOCH) {
+			return errors.New("too many shard proposer slots")
+		}
+		if shardInfo[2] > 0 {
+			props.ShardProposers = make([][]ValidatorIndex, shardInfo[2])
+			for i := range props.ShardProposers {
+				if props.ShardProposers[i], err = readIndices(r); err != nil {
+					return err
+				}
+			}
+		}
+		out = props
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *FileEpochArchive) PutProposers(dependentRoot Root, props *common.ProposersEpoch) error {
+	return a.write(a.entryPath("proposers", props.Epoch, dependentRoot), func(w io.Writer) error {
+		if err := writeIndices(w, props.Proposers); err != nil {
+			return err
+		}
+		shardInfo := [3]uint64{props.CommitteesPerSlot, props.ActiveShards, uint64(len(props.ShardProposers))}
+		if err := binary.Write(w, binary.LittleEndian, shardInfo); err != nil {
+			return err
+		}
+		for _, shardProps := range props.ShardProposers {
+			if err := writeIndices(w, shardProps); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dependentRoot returns the canonical block root at the last slot before the given epoch,
+// or the first block root of the chain if that slot precedes the chain.
+// The proposers of an epoch depend on the dependent root of the epoch itself,
+// the shuffling of an epoch depends on the dependent root of the previous epoch.
+func (f *FinalizedChain) dependentRoot(epoch Epoch) Root {
+	start, end := f.start(), f.end()
+	if epoch == 0 {
+		return f.BlockRoots[0]
+	}
+	slot, _ := f.Spec.EpochStartSlot(epoch)
+	step := AsStep(slot-1, true)
+	if step < start {
+		return f.BlockRoots[0]
+	}
+	if step >= end {
+		step = end - 1
+	}
+	return f.BlockRoots[step-start]
+}
+
+// archiveEpochsContext archives the shufflings and proposers of the context.
+func (f *FinalizedChain) archiveEpochsContext(epc *common.EpochsContext) error {
+	for _, shuf := range []*common.ShufflingEpoch{epc.PreviousEpoch, epc.CurrentEpoch, epc.NextEpoch} {
+		if shuf == nil {
+			continue
+		}
+		if err := f.Archive.PutShuffling(f.dependentRoot(shuf.Epoch.Previous()), shuf); err != nil {
+			return err
+		}
+	}
+	if epc.Proposers != nil {
+		if err := f.Archive.PutProposers(f.dependentRoot(epc.Proposers.Epoch), epc.Proposers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedEpochsContext creates the context of a finalized state of the given epoch,
+// with shufflings and proposers from the archive. Data missing from the archive is computed and archived.
+func (f *FinalizedChain) archivedEpochsContext(state common.BeaconState, epoch Epoch) (*common.EpochsContext, error) {
+	epc := &common.EpochsContext{
+		Spec:                 f.Spec,
+		ValidatorPubkeyCache: f.PubkeyCache,
+	}
+	var err error
+	if epc.PreviousEpoch, err = f.Archive.Shuffling(epoch.Previous(), f.dependentRoot(epoch.Previous().Previous())); err != nil {
+		return nil, err
+	}
+	if epc.CurrentEpoch, err = f.Archive.Shuffling(epoch, f.dependentRoot(epoch.Previous())); err != nil {
+		return nil, err
+	}
+	if epc.NextEpoch, err = f.Archive.Shuffling(epoch+1, f.dependentRoot(epoch)); err != nil {
+		return nil, err
+	}
+	if epc.Proposers, err = f.Archive.Proposers(epoch, f.dependentRoot(epoch)); err != nil {
+		return nil, err
+	}
+	if epc.PreviousEpoch == nil || epc.CurrentEpoch == nil || epc.NextEpoch == nil || epc.Proposers == nil {
+		epc, err := f.stateEpochsContext(state)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.archiveEpochsContext(epc); err != nil {
+			return nil, fmt.Errorf("failed to archive epoch %d: %v", epoch, err)
+		}
+		return epc, nil
+	}
+	if err := epc.LoadCurrentStake(state); err != nil {
+		return nil, err
+	}
+	if syncState, ok := state.(common.SyncCommitteeBeaconState); ok {
+		if err := epc.LoadSyncCommittees(syncState); err != nil {
+			return nil, err
+		}
+	}
+	return epc, nil
+}
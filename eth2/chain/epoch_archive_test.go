@@ -0,0 +1,168 @@
+package chain
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+func TestFileEpochArchive(t *testing.T) {
+	spec := chaintest.Spec()
+	dir := t.TempDir()
+	archive, err := OpenEpochArchive(spec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := common.NewEpochsContext(spec, testAnchor(t, spec, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dep := Root{0xde}
+	if shuf, err := archive.Shuffling(epc.CurrentEpoch.Epoch, dep); err != nil || shuf != nil {
+		t.Fatalf("expected no archived shuffling, got %v (err: %v)", shuf, err)
+	}
+	if err := archive.PutShuffling(dep, epc.CurrentEpoch); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.PutProposers(dep, epc.Proposers); err != nil {
+		t.Fatal(err)
+	}
+	// reopen, the data is persisted
+	archive, err = OpenEpochArchive(spec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shuf, err := archive.Shuffling(epc.CurrentEpoch.Epoch, dep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shuf, epc.CurrentEpoch) {
+		t.Fatal("archived shuffling does not match")
+	}
+	props, err := archive.Proposers(epc.Proposers.Epoch, dep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(props.Proposers, epc.Proposers.Proposers) || props.Epoch != epc.Proposers.Epoch {
+		t.Fatal("archived proposers do not match")
+	}
+	if shuf, err := archive.Shuffling(epc.CurrentEpoch.Epoch, Root{0xff}); err != nil || shuf != nil {
+		t.Fatal("expected no shuffling for other dependent root")
+	}
+}
+
+func TestArchivedColdEpochsContext(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	dir := t.TempDir()
+	archive, err := OpenEpochArchive(spec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coldCh := NewFinalizedChain(spec, states.NewMemDB(spec))
+	coldCh.Archive = archive
+	ch, err := NewHotColdChainFrom(ctx, chaintest.Genesis(t, spec), spec, coldCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := testBlock(t, spec, ch, head.BlockRoot(), 3, 0)
+	if err := ch.AddBlock(ctx, blockA); err != nil {
+		t.Fatal(err)
+	}
+	testFinalize(t, ch.HotChain.(*UnfinalizedChain), blockA.BlockRoot, 1)
+
+	files, err := os.ReadDir(path.Join(dir, EpochArchiveDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("expected finalized epoch data to be archived")
+	}
+	entry, ok := ch.ColdChain.ByCanonStep(AsStep(3, true))
+	if !ok {
+		t.Fatal("expected block A in cold chain")
+	}
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := common.NewEpochsContext(spec, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(epc.PreviousEpoch, expected.PreviousEpoch) ||
+		!reflect.DeepEqual(epc.CurrentEpoch, expected.CurrentEpoch) ||
+		!reflect.DeepEqual(epc.NextEpoch, expected.NextEpoch) {
+		t.Fatal("archived shufflings do not match state")
+	}
+	if !reflect.DeepEqual(epc.Proposers.Proposers, expected.Proposers.Proposers) {
+		t.Fatal("archived proposers do not match state")
+	}
+	if epc.TotalActiveStake != expected.TotalActiveStake {
+		t.Fatal("expected stake to be loaded")
+	}
+}
+
+func TestForkEpochArchive(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	dir := t.TempDir()
+	archive, err := OpenEpochArchive(spec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coldCh := NewFinalizedChain(spec, states.NewMemDB(spec))
+	coldCh.Archive = archive
+	ch, err := NewHotColdChainFrom(ctx, chaintest.Genesis(t, spec), spec, coldCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countFiles := func() int {
+		files, err := os.ReadDir(path.Join(dir, EpochArchiveDirName))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+	before := countFiles()
+
+	fork, err := ch.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Close()
+	head, err := fork.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := testBlock(t, spec, fork, head.BlockRoot(), 3, 0)
+	if err := fork.AddBlock(ctx, blockA); err != nil {
+		t.Fatal(err)
+	}
+	testFinalize(t, fork.HotChain.(*UnfinalizedChain), blockA.BlockRoot, 1)
+
+	if after := countFiles(); after != before {
+		t.Fatalf("fork wrote to the archive of the original chain: %d files, expected %d", after, before)
+	}
+	entry, ok := fork.ColdChain.ByCanonStep(AsStep(3, true))
+	if !ok {
+		t.Fatal("expected block A in cold chain of fork")
+	}
+	if _, err := entry.EpochsContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,142 @@
+package chain
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ChainEvent is one of BlockEvent, HeadEvent, JustifiedEvent, FinalizedEvent or ColdEvent.
+type ChainEvent interface {
+	chainEvent()
+}
+
+// BlockEvent is emitted when a block is imported into the hot chain.
+type BlockEvent struct {
+	Entry ChainEntry
+}
+
+// HeadEvent is emitted when the head block of the chain changes, by blocks, votes, ticks or checkpoint updates.
+type HeadEvent struct {
+	// Head is the entry of the new head, which may be an empty slot on top of the head block.
+	Head ChainEntry
+	// PrevHead is the previous head block.
+	PrevHead BlockSlotKey
+	// CommonAncestor is the latest block shared by the previous and new head.
+	// Equal to PrevHead if the new head builds on top of the previous head.
+	CommonAncestor BlockSlotKey
+	// ReorgDepth is the number of slots from the common ancestor to the previous head. Zero if not a reorg.
+	ReorgDepth Slot
+}
+
+// Reorg returns true if the previous head is not an ancestor of the new head.
+func (ev *HeadEvent) Reorg() bool {
+	return ev.CommonAncestor != ev.PrevHead
+}
+
+// JustifiedEvent is emitted when the forkchoice adopts a new justified checkpoint.
+type JustifiedEvent struct {
+	Justified Checkpoint
+	Previous  Checkpoint
+}
+
+// FinalizedEvent is emitted when the forkchoice adopts a new finalized checkpoint.
+type FinalizedEvent struct {
+	Finalized Checkpoint
+	Previous  Checkpoint
+}
+
+// ColdEvent is emitted when a canonical entry moves from the hot chain to the cold chain.
+type ColdEvent struct {
+	Entry ChainEntry
+}
+
+func (*BlockEvent) chainEvent()     {}
+func (*HeadEvent) chainEvent()      {}
+func (*JustifiedEvent) chainEvent() {}
+func (*FinalizedEvent) chainEvent() {}
+func (*ColdEvent) chainEvent()      {}
+
+type ChainEvents interface {
+	// Subscribe registers a channel to receive chain events.
+	// Delivery does not block: events are dropped if the channel is not ready to receive.
+	// The channel is owned by the caller, and not closed when unsubscribing.
+	Subscribe(ch chan<- ChainEvent) *Subscription
+	// SubscribeFn registers a callback for chain events.
+	// Callbacks run in order on a separate goroutine, and may use the chain.
+	// Up to buffer events are queued for the callback, events are dropped when the queue is full.
+	SubscribeFn(fn func(ev ChainEvent), buffer int) *Subscription
+}
+
+// Subscription is a registration to an EventFeed.
+type Subscription struct {
+	feed    *EventFeed
+	ch      chan<- ChainEvent
+	done    chan struct{}
+	once    sync.Once
+	dropped uint64
+}
+
+// Unsubscribe stops the delivery of events. It is safe to call multiple times.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.feed.mu.Lock()
+		delete(s.feed.subs, s)
+		s.feed.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// Dropped returns the number of events that could not be delivered to the subscriber.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// EventFeed delivers chain events to subscribers without blocking the sender.
+type EventFeed struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+var _ ChainEvents = (*EventFeed)(nil)
+
+func NewEventFeed() *EventFeed {
+	return &EventFeed{subs: make(map[*Subscription]struct{})}
+}
+
+func (f *EventFeed) Subscribe(ch chan<- ChainEvent) *Subscription {
+	sub := &Subscription{feed: f, ch: ch, done: make(chan struct{})}
+	f.mu.Lock()
+	f.subs[sub] = struct{}{}
+	f.mu.Unlock()
+	return sub
+}
+
+func (f *EventFeed) SubscribeFn(fn func(ev ChainEvent), buffer int) *Subscription {
+	ch := make(chan ChainEvent, buffer)
+	sub := f.Subscribe(ch)
+	go func() {
+		for {
+			select {
+			case ev := <-ch:
+				fn(ev)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+// send delivers the event to all subscribers that are ready to receive it.
+// The chain may call this while locked, it never blocks.
+func (f *EventFeed) send(ev ChainEvent) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for sub := range f.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package chain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+func nextEvent(t *testing.T, ch <-chan ChainEvent) ChainEvent {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("expected chain event")
+		return nil
+	}
+}
+
+func TestChainEvents(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := BlockSlotKey{Root: genesis.BlockRoot(), Slot: 0}
+
+	events := make(chan ChainEvent, 100)
+	sub := ch.Subscribe(events)
+	defer sub.Unsubscribe()
+
+	// A full queue drops events instead of blocking the chain.
+	full := ch.Subscribe(make(chan ChainEvent))
+	defer full.Unsubscribe()
+
+	blockA := testBlock(t, spec, ch, g.Root, 1, 0xa)
+	if err := ch.AddBlock(ctx, blockA); err != nil {
+		t.Fatal(err)
+	}
+	a := BlockSlotKey{Root: blockA.BlockRoot, Slot: 1}
+	if ev, ok := nextEvent(t, events).(*BlockEvent); !ok || ev.Entry.BlockRoot() != a.Root {
+		t.Fatalf("expected block event of A, got %v", ev)
+	}
+	if ev, ok := nextEvent(t, events).(*HeadEvent); !ok || ev.Head.BlockRoot() != a.Root ||
+		ev.PrevHead != g || ev.Reorg() {
+		t.Fatalf("expected head event of A, got %v", ev)
+	}
+	// Importing the same block again does not emit events
+	if err := ch.AddBlock(ctx, blockA); err != nil {
+		t.Fatal(err)
+	}
+	for i := ValidatorIndex(0); i < 8; i++ {
+		uc.ForkChoice.ProcessAttestation(i, a.Root, 1)
+	}
+
+	// B conflicts with A, but has no votes yet
+	blockB := testBlock(t, spec, ch, g.Root, 2, 0xb)
+	if err := ch.AddBlock(ctx, blockB); err != nil {
+		t.Fatal(err)
+	}
+	b := BlockSlotKey{Root: blockB.BlockRoot, Slot: 2}
+	if ev, ok := nextEvent(t, events).(*BlockEvent); !ok || ev.Entry.BlockRoot() != b.Root {
+		t.Fatalf("expected block event of B, got %v", ev)
+	}
+
+	// Votes move to B, and the chain reorgs on the next tick.
+	var callbackEvents []ChainEvent
+	done := make(chan struct{})
+	fnSub := ch.SubscribeFn(func(ev ChainEvent) {
+		callbackEvents = append(callbackEvents, ev)
+		close(done)
+	}, 10)
+	for i := ValidatorIndex(0); i < 32; i++ {
+		uc.ForkChoice.ProcessAttestation(i, b.Root, 2)
+	}
+	if err := uc.OnTick(ctx, ch.Genesis().Time+3*spec.SECONDS_PER_SLOT); err != nil {
+		t.Fatal(err)
+	}
+	ev, ok := nextEvent(t, events).(*HeadEvent)
+	if !ok || ev.Head.BlockRoot() != b.Root || ev.PrevHead != a || ev.CommonAncestor != g ||
+		!ev.Reorg() || ev.ReorgDepth != 1 {
+		t.Fatalf("expected reorg to B, got %+v", ev)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected callback")
+	}
+	fnSub.Unsubscribe()
+	if len(callbackEvents) != 1 || callbackEvents[0] != ev {
+		t.Fatalf("unexpected callback events: %v", callbackEvents)
+	}
+
+	// Justify and finalize B, the genesis moves to the cold chain.
+	checkpoint := testFinalize(t, uc, b.Root, 1)
+	finSlot, _ := spec.EpochStartSlot(1)
+	var cold []Step
+	var justified, finalized bool
+	for len(events) > 0 {
+		switch ev := nextEvent(t, events).(type) {
+		case *ColdEvent:
+			cold = append(cold, ev.Entry.Step())
+		case *JustifiedEvent:
+			justified = ev.Justified == checkpoint
+		case *FinalizedEvent:
+			finalized = ev.Finalized == checkpoint && ev.Previous.Epoch == 0
+		}
+	}
+	if !justified || !finalized {
+		t.Fatal("expected justified and finalized events")
+	}
+	if len(cold) == 0 || cold[0] != AsStep(0, true) || cold[len(cold)-1] >= AsStep(finSlot, false) {
+		t.Fatalf("unexpected cold events: %v", cold)
+	}
+	if full.Dropped() == 0 {
+		t.Fatal("expected dropped events for subscriber that is not receiving")
+	}
+}
@@ -1,12 +1,16 @@
 package chain
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/bellatrix"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/beacon/sharding"
 	"github.com/protolambda/zrnt/eth2/forkchoice"
 	"github.com/protolambda/zrnt/eth2/forkchoice/proto"
 	"github.com/protolambda/ztyp/tree"
@@ -14,24 +18,45 @@ import (
 )
 
 type HotEntry struct {
-	self   BlockSlotKey
-	parent Root
-	epc    *common.EpochsContext
-	state  common.BeaconState
+	self      BlockSlotKey
+	parent    Root
+	epc       *common.EpochsContext
+	stateRoot Root
+	// state is nil if it was evicted by the store
+	state common.BeaconState
+
+	// The store that manages the state, nil if the state is always kept in memory.
+	// The fields below are guarded by the store.
+	store *HotStateStore
+	// The entry the state was derived from, to regenerate the state from, nil if the state cannot be dropped.
+	prev *HotEntry
+	// The block that was applied on top of the prev state, to regenerate the state with, if dropped.
+	block *common.BeaconBlockEnvelope
+	// Position in the resident states of the store, nil if not resident
+	elem *list.Element
+	// Number of chains that have the entry
+	refs int
+	// True if the state is stored in the DB of the store
+	spilled bool
 }
 
 func NewHotEntry(self BlockSlotKey, parent Root,
 	state common.BeaconState, epc *common.EpochsContext) *HotEntry {
 	return &HotEntry{
-		self:   self,
-		parent: parent,
-		epc:    epc,
-		state:  state,
+		self:      self,
+		parent:    parent,
+		epc:       epc,
+		stateRoot: state.HashTreeRoot(tree.GetHashFn()),
+		state:     state,
 	}
 }
 
+func (e *HotEntry) hasBlock() bool {
+	return e.parent != e.self.Root
+}
+
 func (e *HotEntry) Step() Step {
-	return AsStep(e.self.Slot, e.parent != e.self.Root)
+	return AsStep(e.self.Slot, e.hasBlock())
 }
 
 func (e *HotEntry) ParentRoot() (root Root) {
@@ -43,20 +68,24 @@ func (e *HotEntry) BlockRoot() (root Root) {
 }
 
 func (e *HotEntry) StateRoot() Root {
-	return e.state.HashTreeRoot(tree.GetHashFn())
+	return e.stateRoot
 }
 
 func (e *HotEntry) EpochsContext(context.Context) (*common.EpochsContext, error) {
 	return e.epc.Clone(), nil
 }
 
-func (e *HotEntry) State(context.Context) (common.BeaconState, error) {
+func (e *HotEntry) State(ctx context.Context) (common.BeaconState, error) {
+	if e.store != nil {
+		return e.store.state(ctx, e)
+	}
 	// Return a copy of the view, the state itself may not be modified
 	return e.state.CopyState()
 }
 
 type HotChain interface {
 	Chain
+	ChainEvents
 	JustifiedCheckpoint() Checkpoint
 	FinalizedCheckpoint() Checkpoint
 	Justified() (ChainEntry, error)
@@ -69,13 +98,34 @@ type HotChain interface {
 	Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error)
 	// Process a block. If there is an error, the chain is not mutated, and can be continued to use.
 	AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error
-	// Process an attestation. If there is an error, the chain is not mutated, and can be continued to use.
-	AddAttestation(att *phase0.Attestation) error
+	// Process a block like AddBlock, with the time the block arrived at:
+	// the first block that arrives in the first interval of its slot gets the proposer boost.
+	AddBlockAt(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival common.Timestamp) error
+	// Process a batch of consecutive blocks, and verify all their signatures at once.
+	// If there is an error, none of the blocks are imported, and the chain can be continued to use,
+	// unless the BlockSink failed to take the entries that the batch pruned.
+	AddBlocks(ctx context.Context, benvs []*common.BeaconBlockEnvelope) error
+	// Process a block on a copy of the chain, to compute the post-state. The chain is not mutated.
+	SimulateBlock(ctx context.Context, benv *common.BeaconBlockEnvelope, checkStateRoot bool) (state common.BeaconState, stateRoot Root, err error)
+	// Process an attestation of any fork, indexed or not. If there is an error, the chain is not mutated,
+	// and can be continued to use. The attesting indices that changed their forkchoice vote are returned.
+	AddAttestation(ctx context.Context, att common.AttestationEnvelopeBuilder) (changed []ValidatorIndex, err error)
+	// Process a batch of attestations, with a single lock of the chain. The results are in the order of the attestations,
+	// an invalid attestation does not affect the processing of the others.
+	// If any vote changed, the head is updated, and a HeadEvent is published if it changed.
+	AddAttestations(ctx context.Context, atts []common.AttestationEnvelopeBuilder) []AttestationResult
+	// OnTick updates the time of the forkchoice. At the start of an epoch the unrealized justification
+	// and finalization of the blocks of the previous epoch is realized, which may finalize and prune entries.
+	// The head is updated, the votes and the proposer boost may change it.
+	OnTick(ctx context.Context, now common.Timestamp) error
 }
 
 type UnfinalizedChain struct {
 	sync.RWMutex
 
+	// EventFeed publishes block imports, head changes and justification/finalization updates
+	*EventFeed
+
 	ForkChoice forkchoice.Forkchoice
 
 	// Block root (parent if empty slot) and slot -> Entry
@@ -93,6 +143,19 @@ type UnfinalizedChain struct {
 	// Non-canonical non-empty entries are still available, to track what is getting abandoned by the chain
 	BlockSink BlockSink
 
+	// The finalized checkpoint that is being applied to the forkchoice, which may prune nodes.
+	finalizing Checkpoint
+
+	// The last head block that was published to the EventFeed
+	head BlockSlotKey
+
+	// Manages the states of the entries, nil if all states are kept in memory
+	states *HotStateStore
+	// Entries shared with the chain this chain was copied from, retained in the store of that chain until Close
+	retained []*HotEntry
+	// Entries that were pruned during the current finalization update
+	pruned []*HotEntry
+
 	// Spec is holds configuration information for the parameters and types of the chain
 	Spec *common.Spec
 }
@@ -113,7 +176,7 @@ func (fi HotChainIter) Start() Step {
 }
 
 func (fi HotChainIter) End() Step {
-	return fi[len(fi)-1].Step()
+	return fi[len(fi)-1].Step() + 1
 }
 
 func (fi HotChainIter) Entry(step Step) (entry ChainEntry, err error) {
@@ -142,6 +205,10 @@ func (uc *UnfinalizedChain) Iter() (ChainIter, error) {
 	if len(nodes) == 0 {
 		return nil, errors.New("empty chain")
 	}
+	// The canonical chain is ordered from head to anchor, reverse it.
+	for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
 	entries := make([]*HotEntry, 0, len(nodes))
 	for i := 0; i < len(nodes); i++ {
 		node := &nodes[i]
@@ -165,17 +232,71 @@ func (uc *UnfinalizedChain) Iter() (ChainIter, error) {
 }
 
 type BlockSink interface {
-	// Sink handles blocks that come from the Hot part, and may be finalized or not
-	Sink(ctx context.Context, entry ChainEntry, canonical bool) error
+	// Sink handles blocks that come from the Hot part, and may be finalized or not.
+	// The finalized checkpoint is the finalization that caused the entry to be pruned from the Hot part.
+	Sink(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error
+}
+
+type BlockSinkFn func(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error
+
+func (fn BlockSinkFn) Sink(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error {
+	return fn(ctx, entry, canonical, finalized)
 }
 
-type BlockSinkFn func(ctx context.Context, entry ChainEntry, canonical bool) error
+// asUpgradeable wraps the state, to upgrade it at fork boundaries during slot processing.
+// States that implement their own upgrade logic are used as-is.
+func asUpgradeable(state common.BeaconState) common.UpgradeableBeaconState {
+	if up, ok := state.(common.UpgradeableBeaconState); ok {
+		return up
+	}
+	return &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+}
 
-func (fn BlockSinkFn) Sink(ctx context.Context, entry ChainEntry, canonical bool) error {
-	return fn(ctx, entry, canonical)
+// unwrapUpgradeable returns the state without the upgrade wrapper of asUpgradeable, if any.
+func unwrapUpgradeable(state common.UpgradeableBeaconState) common.BeaconState {
+	if std, ok := state.(*beacon.StandardUpgradeableBeaconState); ok {
+		return std.BeaconState
+	}
+	return state
+}
+
+// processNextSlot transitions the state to the next slot, and upgrades it at fork boundaries.
+// The state is modified, but may be replaced by the upgraded state, which is returned.
+func processNextSlot(ctx context.Context, spec *common.Spec, epc *common.EpochsContext, state common.BeaconState) (common.BeaconState, error) {
+	slot, err := state.Slot()
+	if err != nil {
+		return nil, err
+	}
+	upgradeable := asUpgradeable(state)
+	if err := common.ProcessSlot(ctx, spec, upgradeable); err != nil {
+		return nil, err
+	}
+	// Per-epoch transition happens at the start of the first slot of every epoch.
+	// (with the slot still at the end of the last epoch)
+	isEpochEnd := spec.SlotToEpoch(slot+1) != spec.SlotToEpoch(slot)
+	if isEpochEnd {
+		if err := upgradeable.ProcessEpoch(ctx, spec, epc); err != nil {
+			return nil, err
+		}
+	}
+	if err := upgradeable.SetSlot(slot + 1); err != nil {
+		return nil, err
+	}
+	if isEpochEnd {
+		// Rotate with the unwrapped state, the epochs context checks the state type for sync committees.
+		if err := epc.RotateEpochs(state); err != nil {
+			return nil, err
+		}
+	}
+	// Check for state upgrades at fork boundaries
+	if err := upgradeable.UpgradeMaybe(ctx, spec, epc); err != nil {
+		return nil, fmt.Errorf("failed BeaconState upgrade-check/process: %v", err)
+	}
+	return unwrapUpgradeable(upgradeable), nil
 }
 
-func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
+// NewUnfinalizedChain creates a hot chain starting at the given anchor state, which may be of any fork.
+func NewUnfinalizedChain(anchorState common.BeaconState, sink BlockSink, spec *common.Spec) (*UnfinalizedChain, error) {
 	fin, err := anchorState.FinalizedCheckpoint()
 	if err != nil {
 		return nil, err
@@ -189,10 +310,18 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	if err != nil {
 		return nil, err
 	}
+	anchorStateRoot := anchorState.HashTreeRoot(tree.GetHashFn())
 	if latestHeader.StateRoot == (Root{}) {
-		latestHeader.StateRoot = anchorState.HashTreeRoot(tree.GetHashFn())
+		latestHeader.StateRoot = anchorStateRoot
 	}
 	anchorBlockRoot := latestHeader.HashTreeRoot(tree.GetHashFn())
+	// Genesis checkpoints have a zero root in the state, refer to the anchor block instead.
+	if fin.Root == (Root{}) {
+		fin.Root = anchorBlockRoot
+	}
+	if just.Root == (Root{}) {
+		just.Root = anchorBlockRoot
+	}
 
 	slot, err := anchorState.Slot()
 	if err != nil {
@@ -203,36 +332,45 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 		return nil, err
 	}
 	anchor := BlockSlotKey{Root: anchorBlockRoot, Slot: slot}
+	// parent root is equal to anchorBlockRoot if the anchor state is of a gap slot.
+	anchorParent := latestHeader.ParentRoot
+	if latestHeader.Slot < slot {
+		anchorParent = anchorBlockRoot
+	}
 	anchorBlock := &HotEntry{
-		self: anchor,
-		// parent root may be equal to anchorBlockRoot if the anchor state is of a gap slot.
-		parent: latestHeader.ParentRoot,
-		epc:    epc,
-		state:  anchorState,
+		self:      anchor,
+		parent:    anchorParent,
+		epc:       epc,
+		stateRoot: anchorStateRoot,
+		state:     anchorState,
 	}
 	uc := &UnfinalizedChain{
+		EventFeed:  NewEventFeed(),
 		ForkChoice: nil,
 		Entries:    map[BlockSlotKey]*HotEntry{anchor: anchorBlock},
-		State2Key:  map[Root]BlockSlotKey{latestHeader.StateRoot: anchor},
+		State2Key:  map[Root]BlockSlotKey{anchorStateRoot: anchor},
 		BlockSink:  sink,
+		finalizing: fin,
+		head:       anchor,
 		Spec:       spec,
 	}
-	balancesView, err := anchorState.Balances()
+	balances, err := forkchoiceBalances(epc, anchorState)
 	if err != nil {
 		return nil, err
 	}
-	balances, err := balancesView.AllBalances()
+	genesisTime, err := anchorState.GenesisTime()
 	if err != nil {
 		return nil, err
 	}
 	fc, err := proto.NewProtoForkChoice(
 		spec,
+		genesisTime,
 		fin,
 		just,
 		anchorBlockRoot, slot,
-		latestHeader.ParentRoot,
+		anchorParent,
 		balances,
-		proto.NodeSinkFn(uc.onPrunedNode),
+		forkchoice.NodeSinkFn(uc.onPrunedNode),
 	)
 	if err != nil {
 		return nil, err
@@ -241,6 +379,39 @@ func NewUnfinalizedChain(anchorState *phase0.BeaconStateView, sink BlockSink, sp
 	return uc, nil
 }
 
+// Copy creates an independent hot chain that shares the entries (and thus state backings) with this chain,
+// and has a copy of the forkchoice. Pruned entries of the copy go to the given sink.
+// The copy starts without event subscribers.
+// The states of the shared entries are retained in the HotStateStore of this chain, if any,
+// the copy must be closed to release them. Entries added by the copy keep their states in memory.
+func (uc *UnfinalizedChain) Copy(sink BlockSink) *UnfinalizedChain {
+	uc.RLock()
+	defer uc.RUnlock()
+	out := &UnfinalizedChain{
+		EventFeed:  NewEventFeed(),
+		Entries:    make(map[BlockSlotKey]*HotEntry, len(uc.Entries)),
+		State2Key:  make(map[Root]BlockSlotKey, len(uc.State2Key)),
+		BlockSink:  sink,
+		finalizing: uc.finalizing,
+		head:       uc.head,
+		Spec:       uc.Spec,
+	}
+	// Entries are never modified, only added and removed, and can be shared.
+	// The store of a shared entry keeps managing its state, the copy does not evict or re-anchor it.
+	for k, v := range uc.Entries {
+		out.Entries[k] = v
+		if v.store != nil {
+			v.store.retain(v)
+			out.retained = append(out.retained, v)
+		}
+	}
+	for k, v := range uc.State2Key {
+		out.State2Key[k] = v
+	}
+	out.ForkChoice = uc.ForkChoice.Copy(forkchoice.NodeSinkFn(out.onPrunedNode))
+	return out
+}
+
 // onPrunedNode handles when nodes leave the forkchoice, and thus get removed from the hot view of the chain.
 // Includes empty slots and nodes of the slot pre-block processing (even if the block exists)
 func (uc *UnfinalizedChain) onPrunedNode(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
@@ -254,8 +425,138 @@ func (uc *UnfinalizedChain) onPrunedNode(ctx context.Context, ref forkchoice.Nod
 	// Remove node from hot state
 	delete(uc.Entries, key)
 	delete(uc.State2Key, entry.StateRoot())
+	if uc.states != nil {
+		uc.pruned = append(uc.pruned, entry)
+	}
 	// Move the node to the sink.
-	return uc.BlockSink.Sink(ctx, entry, canonical)
+	return uc.BlockSink.Sink(ctx, entry, canonical, uc.finalizing)
+}
+
+// updateJustified makes the forkchoice aware of justification and finalization data,
+// and tracks the finalized checkpoint for the entries that get pruned because of it.
+func (uc *UnfinalizedChain) updateJustified(ctx context.Context, trigger Root, justified Checkpoint, finalized Checkpoint,
+	justifiedStateBalances func() ([]Gwei, error)) error {
+	justified, finalized = anchorCheckpoints(uc.ForkChoice, justified, finalized)
+	uc.finalizing = finalized
+	return uc.updateCheckpoints(ctx, func() error {
+		return uc.ForkChoice.UpdateJustified(ctx, trigger, justified, finalized, justifiedStateBalances)
+	})
+}
+
+// updateUnrealized makes the forkchoice aware of the unrealized justification and finalization of a block entry.
+func (uc *UnfinalizedChain) updateUnrealized(ctx context.Context, entry *HotEntry, justified Checkpoint, finalized Checkpoint,
+	justifiedStateBalances func() ([]Gwei, error)) error {
+	justified, finalized = anchorCheckpoints(uc.ForkChoice, justified, finalized)
+	uc.finalizing = finalized
+	return uc.updateCheckpoints(ctx, func() error {
+		return uc.ForkChoice.UpdateUnrealized(ctx, entry.self.Root, entry.self.Slot, justified, finalized,
+			justifiedStateBalances)
+	})
+}
+
+func (uc *UnfinalizedChain) OnTick(ctx context.Context, now common.Timestamp) error {
+	uc.Lock()
+	defer uc.Unlock()
+	// Realized checkpoints are always unrealized first, entries get pruned for the unrealized finalization.
+	uc.finalizing = uc.ForkChoice.UnrealizedFinalized()
+	if err := uc.updateCheckpoints(ctx, func() error {
+		return uc.ForkChoice.OnTick(ctx, now)
+	}); err != nil {
+		return err
+	}
+	// The applied votes and the expiry of the proposer boost may change the head, without a checkpoint change.
+	_, _ = uc.updateHead()
+	return nil
+}
+
+// anchorCheckpoints replaces the checkpoints with a zero root by the checkpoints known to the forkchoice:
+// genesis checkpoints have a zero root in the state, the forkchoice knows them by the anchor block root.
+func anchorCheckpoints(fc forkchoice.Forkchoice, justified Checkpoint, finalized Checkpoint) (Checkpoint, Checkpoint) {
+	if justified.Root == (Root{}) {
+		justified = fc.Justified()
+	}
+	if finalized.Root == (Root{}) {
+		finalized = fc.Finalized()
+	}
+	return justified, finalized
+}
+
+// updateCheckpoints runs the forkchoice update, releases the entries that got pruned by it,
+// and publishes the justification, finalization and head changes.
+func (uc *UnfinalizedChain) updateCheckpoints(ctx context.Context, update func() error) error {
+	prevJustified, prevFinalized := uc.ForkChoice.Justified(), uc.ForkChoice.Finalized()
+	err := update()
+	if relErr := uc.releasePruned(ctx); relErr != nil && err == nil {
+		err = relErr
+	}
+	if err != nil {
+		return err
+	}
+	newJustified, newFinalized := uc.ForkChoice.Justified(), uc.ForkChoice.Finalized()
+	if newJustified == prevJustified && newFinalized == prevFinalized {
+		return nil
+	}
+	if newJustified != prevJustified {
+		uc.send(&JustifiedEvent{Justified: newJustified, Previous: prevJustified})
+	}
+	if newFinalized != prevFinalized {
+		uc.send(&FinalizedEvent{Finalized: newFinalized, Previous: prevFinalized})
+	}
+	// The head is relative to the justified checkpoint, and may change with it.
+	// The forkchoice may not have a viable head until more blocks are processed,
+	// the head change is then published when the head is computed next.
+	_, _ = uc.updateHead()
+	return nil
+}
+
+// updateHead computes the head, and publishes a HeadEvent if the head block changed.
+func (uc *UnfinalizedChain) updateHead() (*HotEntry, error) {
+	ref, err := uc.ForkChoice.Head()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := uc.Entries[BlockSlotKey{Root: ref.Root, Slot: ref.Slot}]
+	if !ok {
+		return nil, fmt.Errorf("forkchoice found head node that is not in the hot chain: %s:%d",
+			ref.Root, ref.Slot)
+	}
+	if ref.Root == uc.head.Root {
+		return entry, nil
+	}
+	headSlot, ok := uc.ForkChoice.GetSlot(ref.Root)
+	if !ok {
+		return nil, fmt.Errorf("forkchoice head block %s has no slot", ref.Root)
+	}
+	prev := uc.head
+	head := BlockSlotKey{Root: ref.Root, Slot: headSlot}
+	ancestor, ok := uc.commonAncestor(prev, head)
+	if !ok {
+		// The previous head was pruned, it conflicts with finalization.
+		fin := uc.ForkChoice.Finalized()
+		finSlot, _ := uc.ForkChoice.GetSlot(fin.Root)
+		ancestor = BlockSlotKey{Root: fin.Root, Slot: finSlot}
+	}
+	ev := &HeadEvent{Head: entry, PrevHead: prev, CommonAncestor: ancestor}
+	if ancestor != prev && prev.Slot > ancestor.Slot {
+		ev.ReorgDepth = prev.Slot - ancestor.Slot
+	}
+	uc.head = head
+	uc.send(ev)
+	return entry, nil
+}
+
+// commonAncestor finds the latest block that both a and b are, or descend from.
+// Returns false if the blocks do not share an ancestor in the hot chain.
+func (uc *UnfinalizedChain) commonAncestor(a BlockSlotKey, b BlockSlotKey) (BlockSlotKey, bool) {
+	ref, err := uc.ForkChoice.CommonAncestor(common.NodeRef{Root: a.Root, Slot: a.Slot}, common.NodeRef{Root: b.Root, Slot: b.Slot})
+	if err != nil {
+		return BlockSlotKey{}, false
+	}
+	slot, ok := uc.ForkChoice.GetSlot(ref.Root)
+	if !ok {
+		return BlockSlotKey{}, false
+	}
+	return BlockSlotKey{Root: ref.Root, Slot: slot}, true
 }
 
 func (uc *UnfinalizedChain) ByStateRoot(root Root) (entry ChainEntry, ok bool) {
@@ -329,6 +630,33 @@ func (uc *UnfinalizedChain) closest(fromBlockRoot Root, toSlot Slot) (entry Chai
 	return uc.byBlockSlot(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
 }
 
+// forkchoiceBalances computes the vote weights of the validators: the effective balances of the active, unslashed validators.
+func forkchoiceBalances(epc *common.EpochsContext, state common.BeaconState) ([]Gwei, error) {
+	vals, err := state.Validators()
+	if err != nil {
+		return nil, err
+	}
+	count, err := vals.ValidatorCount()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Gwei, count)
+	for _, index := range epc.CurrentEpoch.ActiveIndices {
+		val, err := vals.Validator(index)
+		if err != nil {
+			return nil, err
+		}
+		slashed, err := val.Slashed()
+		if err != nil {
+			return nil, err
+		}
+		if !slashed {
+			out[index] = epc.EffectiveBalances[index]
+		}
+	}
+	return out, nil
+}
+
 // helper function to fetch justified and finalized checkpoint from a beacon state
 func stateJustFin(state common.BeaconState) (justified Checkpoint, finalized Checkpoint, err error) {
 	justifiedCh, err := state.CurrentJustifiedCheckpoint()
@@ -342,9 +670,57 @@ func stateJustFin(state common.BeaconState) (justified Checkpoint, finalized Che
 	return justifiedCh, finalizedCh, nil
 }
 
+// stateUnrealizedJustFin computes the unrealized justified and finalized checkpoint of a beacon state:
+// the checkpoints after processing the justification and finalization of the current epoch, on a copy of the state.
+func stateUnrealizedJustFin(ctx context.Context, spec *common.Spec, epc *common.EpochsContext,
+	state common.BeaconState) (justified Checkpoint, finalized Checkpoint, err error) {
+	state, err = state.CopyState()
+	if err != nil {
+		return Checkpoint{}, Checkpoint{}, err
+	}
+	vals, err := state.Validators()
+	if err != nil {
+		return Checkpoint{}, Checkpoint{}, err
+	}
+	flats, err := common.FlattenValidators(vals)
+	if err != nil {
+		return Checkpoint{}, Checkpoint{}, err
+	}
+	just := phase0.JustificationStakeData{
+		CurrentEpoch:     epc.CurrentEpoch.Epoch,
+		TotalActiveStake: epc.TotalActiveStake,
+	}
+	switch s := state.(type) {
+	case phase0.Phase0PendingAttestationsBeaconState:
+		attesterData, err := phase0.ComputeEpochAttesterData(ctx, spec, epc, flats, s)
+		if err != nil {
+			return Checkpoint{}, Checkpoint{}, err
+		}
+		just.PrevEpochUnslashedTargetStake = attesterData.PrevEpochUnslashedStake.TargetStake
+		just.CurrEpochUnslashedTargetStake = attesterData.CurrEpochUnslashedTargetStake
+	case altair.AltairLikeBeaconState:
+		attesterData, err := altair.ComputeEpochAttesterData(ctx, spec, epc, flats, s)
+		if err != nil {
+			return Checkpoint{}, Checkpoint{}, err
+		}
+		just.PrevEpochUnslashedTargetStake = attesterData.PrevEpochUnslashedStake.TargetStake
+		just.CurrEpochUnslashedTargetStake = attesterData.CurrEpochUnslashedTargetStake
+	default:
+		return Checkpoint{}, Checkpoint{}, fmt.Errorf("cannot compute unrealized justification of state type %T", state)
+	}
+	if err := phase0.ProcessEpochJustification(ctx, spec, &just, state); err != nil {
+		return Checkpoint{}, Checkpoint{}, err
+	}
+	return stateJustFin(state)
+}
+
 func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
 	uc.Lock()
 	defer uc.Unlock()
+	return uc.towards(ctx, fromBlockRoot, toSlot)
+}
+
+func (uc *UnfinalizedChain) towards(ctx context.Context, fromBlockRoot Root, toSlot Slot) (ChainEntry, error) {
 	closest, ok := uc.closest(fromBlockRoot, toSlot)
 	if !ok {
 		return nil, fmt.Errorf("failed to find starting point to root %s to go towards slot %d", fromBlockRoot, toSlot)
@@ -352,79 +728,55 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 	if closest.Step().Slot() == toSlot {
 		return closest, nil
 	}
-
-	epc, err := closest.EpochsContext(ctx)
+	if closest.Step().Slot() > toSlot {
+		return nil, fmt.Errorf("block %s is past slot %d", fromBlockRoot, toSlot)
+	}
+	entries, err := uc.transitionSlots(ctx, closest.(*HotEntry), toSlot)
 	if err != nil {
 		return nil, err
 	}
+	for _, entry := range entries {
+		if err := uc.insertSlot(ctx, entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries[len(entries)-1], nil
+}
 
-	state, err := closest.State(ctx)
+// transitionSlots computes the entries of the empty slots on top of the given entry, up to and including toSlot.
+// The chain is not modified, the entries are added with insertSlot.
+func (uc *UnfinalizedChain) transitionSlots(ctx context.Context, from *HotEntry, toSlot Slot) ([]*HotEntry, error) {
+	epc, err := from.EpochsContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	var last *HotEntry
+	state, err := from.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root := from.self.Root
+	out := make([]*HotEntry, 0, toSlot-from.self.Slot)
+	prev := from
 	// Process empty slots
-	for slot := closest.Step().Slot(); slot < toSlot; {
-		if err := common.ProcessSlot(ctx, uc.Spec, state); err != nil {
-			return nil, err
-		}
-		// Per-epoch transition happens at the start of the first slot of every epoch.
-		// (with the slot still at the end of the last epoch)
-		isEpochEnd := uc.Spec.SlotToEpoch(slot+1) != uc.Spec.SlotToEpoch(slot)
-		if isEpochEnd {
-			if err := state.ProcessEpoch(ctx, uc.Spec, epc); err != nil {
-				return nil, err
-			}
-		}
-		slot += 1
-		if err := state.SetSlot(slot); err != nil {
-			return nil, err
-		}
-		// TODO: check for fork boundary, and execute state upgrade if necessary.
-		if isEpochEnd {
-			if err := epc.RotateEpochs(state); err != nil {
-				return nil, err
-			}
-		}
-
-		// Check for state upgrades
-		upgradeable := beacon.StandardUpgradeableBeaconState{BeaconState: state}
-		if err := upgradeable.UpgradeMaybe(ctx, uc.Spec, epc); err != nil {
-			return nil, fmt.Errorf("failed BeaconState upgrade-check/process: %v", err)
-		}
-		state = upgradeable.BeaconState
-
-		justified, finalized, err := stateJustFin(state)
+	for slot := from.self.Slot; slot < toSlot; {
+		state, err = processNextSlot(ctx, uc.Spec, epc, state)
 		if err != nil {
 			return nil, err
 		}
-		// Make the forkchoice aware of this new slot
-		uc.ForkChoice.ProcessSlot(fromBlockRoot, slot, justified.Epoch, finalized.Epoch)
-		// Make the forkchoice aware of latest justified/finalized data. Lazy-fetch the balances if necessary.
-		if err := uc.ForkChoice.UpdateJustified(ctx, fromBlockRoot, finalized, justified,
-			func() ([]forkchoice.Gwei, error) {
-				balancesView, err := state.Balances()
-				if err != nil {
-					return nil, err
-				}
-				return balancesView.AllBalances()
-			}); err != nil {
-			return nil, fmt.Errorf("failed to update forkchoice with new justification data: %v", err)
-		}
+		slot += 1
 
-		// Track the entry
-		key := BlockSlotKey{Root: fromBlockRoot, Slot: slot}
 		entry := &HotEntry{
-			self:   key,
-			epc:    epc,
-			state:  state,
-			parent: fromBlockRoot,
+			self:      BlockSlotKey{Root: root, Slot: slot},
+			epc:       epc,
+			stateRoot: state.HashTreeRoot(tree.GetHashFn()),
+			state:     state,
+			parent:    root,
+		}
+		if uc.states != nil {
+			entry.prev = prev
 		}
-		uc.Entries[key] = entry
-		stateRoot := state.HashTreeRoot(tree.GetHashFn())
-		uc.State2Key[stateRoot] = key
-		last = entry
+		out = append(out, entry)
+		prev = entry
 
 		state, err = state.CopyState()
 		if err != nil {
@@ -432,7 +784,19 @@ func (uc *UnfinalizedChain) Towards(ctx context.Context, fromBlockRoot Root, toS
 		}
 		epc = epc.Clone()
 	}
-	return last, nil
+	return out, nil
+}
+
+// insertSlot makes the forkchoice aware of the empty slot, and adds the entry to the chain.
+func (uc *UnfinalizedChain) insertSlot(ctx context.Context, entry *HotEntry) error {
+	p, err := uc.prepareEntry(ctx, entry, nil)
+	if err != nil {
+		return err
+	}
+	if err := uc.trackEntry(ctx, p); err != nil {
+		return err
+	}
+	return uc.realizeEntry(ctx, p)
 }
 
 func (uc *UnfinalizedChain) InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool) {
@@ -489,90 +853,371 @@ func (uc *UnfinalizedChain) Finalized() (ChainEntry, error) {
 	return entry, nil
 }
 
+// Head computes the head of the chain. Vote changes of attestations are published as HeadEvent
+// when the head is computed, i.e. with Head or AddBlock.
 func (uc *UnfinalizedChain) Head() (ChainEntry, error) {
 	uc.Lock()
 	defer uc.Unlock()
-	ref, err := uc.ForkChoice.Head()
+	entry, err := uc.updateHead()
 	if err != nil {
 		return nil, err
 	}
-	entry, ok := uc.byBlockSlot(BlockSlotKey{Root: ref.Root, Slot: ref.Slot})
-	if !ok {
-		return nil, fmt.Errorf("forkchoice found head node that is not in the hot chain: %s:%d",
-			ref.Root, ref.Slot)
-	}
 	return entry, nil
 }
 
 func (uc *UnfinalizedChain) AddBlock(ctx context.Context, benv *common.BeaconBlockEnvelope) error {
+	return uc.addBlock(ctx, benv, nil)
+}
+
+func (uc *UnfinalizedChain) AddBlockAt(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival common.Timestamp) error {
+	return uc.addBlock(ctx, benv, &arrival)
+}
+
+// addBlock imports the block, and applies the proposer boost if the arrival time is known and timely.
+func (uc *UnfinalizedChain) addBlock(ctx context.Context, benv *common.BeaconBlockEnvelope, arrival *common.Timestamp) error {
 	uc.Lock()
 	defer uc.Unlock()
 
-	pre, err := uc.Towards(ctx, benv.ParentRoot, benv.Slot)
+	key := BlockSlotKey{Slot: benv.Slot, Root: benv.BlockRoot}
+	if _, ok := uc.Entries[key]; ok {
+		// already imported
+		return nil
+	}
+
+	pre, err := uc.towards(ctx, benv.ParentRoot, benv.Slot)
 	if err != nil {
 		return fmt.Errorf("failed to prepare for block, towards-slot failed: %v", err)
 	}
 
-	state, err := pre.State(ctx)
+	entry, err := uc.transitionBlock(ctx, pre.(*HotEntry), benv, nil)
 	if err != nil {
 		return err
 	}
-	epc, err := pre.EpochsContext(ctx)
-	if err != nil {
+	if err := uc.insertBlock(ctx, entry, benv); err != nil {
 		return err
 	}
+	if arrival != nil {
+		uc.ForkChoice.OnBlockArrival(benv.BlockRoot, benv.Slot, *arrival)
+	}
 
-	// we already processed the slots (including that of the block itself), just finish the transition.
-	if err := common.PostSlotTransition(ctx, uc.Spec, epc, state, benv, true); err != nil {
-		return err
+	if _, err := uc.updateHead(); err != nil {
+		return fmt.Errorf("failed to update head after block import: %v", err)
 	}
+	return nil
+}
 
-	justified, finalized, err := stateJustFin(state)
-	if err != nil {
-		return err
+// AddBlocks imports a batch of consecutive blocks, e.g. from range sync.
+// Each block must build on the previous block of the batch, the first block on a block of the hot chain.
+// The state transitions of all blocks run first, collecting the signatures,
+// and then all signatures of the batch are verified at once.
+// The blocks and their justification and finalization updates are first checked on a copy of the forkchoice:
+// if any block in the batch is invalid, or rejected by the forkchoice, none of the blocks are imported.
+// Only a failure of the BlockSink to take the entries pruned by the batch can leave the batch imported.
+func (uc *UnfinalizedChain) AddBlocks(ctx context.Context, benvs []*common.BeaconBlockEnvelope) error {
+	uc.Lock()
+	defer uc.Unlock()
+
+	for i := 1; i < len(benvs); i++ {
+		if benvs[i].ParentRoot != benvs[i-1].BlockRoot {
+			return fmt.Errorf("block %d of batch (%s) does not build on previous block %s",
+				i, benvs[i].BlockRoot, benvs[i-1].BlockRoot)
+		}
+		if benvs[i].Slot <= benvs[i-1].Slot {
+			return fmt.Errorf("block %d of batch (%s) has slot %d, not after previous block slot %d",
+				i, benvs[i].BlockRoot, benvs[i].Slot, benvs[i-1].Slot)
+		}
+	}
+	// skip the blocks that were already imported
+	for len(benvs) > 0 {
+		if _, ok := uc.Entries[BlockSlotKey{Slot: benvs[0].Slot, Root: benvs[0].BlockRoot}]; !ok {
+			break
+		}
+		benvs = benvs[1:]
+	}
+	if len(benvs) == 0 {
+		return nil
 	}
 
-	// Make the forkchoice aware of the new block
-	uc.ForkChoice.ProcessBlock(benv.ParentRoot, benv.BlockRoot, benv.Slot, justified.Epoch, finalized.Epoch)
+	first := benvs[0]
+	closest, ok := uc.closest(first.ParentRoot, first.Slot)
+	if !ok || closest.BlockRoot() != first.ParentRoot {
+		return fmt.Errorf("unknown parent %s of first block of batch", first.ParentRoot)
+	}
+	pre := closest.(*HotEntry)
+
+	// Run the transitions, without modifying the chain yet.
+	batch := new(common.SignatureBatch)
+	var pending []*HotEntry
+	for i, benv := range benvs {
+		if pre.self.Slot < benv.Slot {
+			slots, err := uc.transitionSlots(ctx, pre, benv.Slot)
+			if err != nil {
+				return fmt.Errorf("failed to process slots up to block %d of batch (%s): %v", i, benv.BlockRoot, err)
+			}
+			pending = append(pending, slots...)
+			pre = slots[len(slots)-1]
+		}
+		entry, err := uc.transitionBlock(ctx, pre, benv, batch)
+		if err != nil {
+			return fmt.Errorf("invalid block %d of batch (%s): %v", i, benv.BlockRoot, err)
+		}
+		pending = append(pending, entry)
+		pre = entry
+	}
+	if err := batch.VerifyBatch(); err != nil {
+		return fmt.Errorf("failed to verify %d signatures of batch of %d blocks: %v", batch.Len(), len(benvs), err)
+	}
 
-	key := BlockSlotKey{Slot: benv.Slot, Root: benv.BlockRoot}
-	uc.Entries[key] = &HotEntry{
-		self:   key,
-		parent: benv.ParentRoot,
-		epc:    epc,
-		state:  state,
+	// All blocks are valid, check that the forkchoice accepts them, before modifying the chain.
+	prepared := make([]*pendingEntry, 0, len(pending))
+	next := 0
+	for _, entry := range pending {
+		var benv *common.BeaconBlockEnvelope
+		if entry.hasBlock() {
+			benv = benvs[next]
+			next++
+		}
+		p, err := uc.prepareEntry(ctx, entry, benv)
+		if err != nil {
+			return fmt.Errorf("failed to prepare entry %s:%d of batch: %v", entry.self.Root, entry.self.Slot, err)
+		}
+		prepared = append(prepared, p)
+	}
+	dryRun := uc.ForkChoice.Copy(nil)
+	for _, p := range prepared {
+		if !p.addTo(dryRun) {
+			return fmt.Errorf("forkchoice rejected block %s at slot %d of batch", p.benv.BlockRoot, p.benv.Slot)
+		}
+	}
+	for _, p := range prepared {
+		if err := p.realizeOn(ctx, dryRun); err != nil {
+			return fmt.Errorf("failed to update forkchoice with justification data of entry %s:%d of batch: %v",
+				p.entry.self.Root, p.entry.self.Slot, err)
+		}
+	}
+	// Add all entries, and then update the justification and finalization.
+	for _, p := range prepared {
+		if err := uc.trackEntry(ctx, p); err != nil {
+			return err
+		}
+	}
+	for _, p := range prepared {
+		if err := uc.realizeEntry(ctx, p); err != nil {
+			return err
+		}
 	}
-	uc.State2Key[benv.StateRoot] = key
 
+	if _, err := uc.updateHead(); err != nil {
+		return fmt.Errorf("failed to update head after block import: %v", err)
+	}
 	return nil
 }
 
-// AddAttestation updates the forkchoice with the given attestation.
-// Warning: the attestation signature is not verified, it is up to the caller to verify.
-func (uc *UnfinalizedChain) AddAttestation(att *phase0.Attestation) error {
-	uc.Lock()
-	defer uc.Unlock()
+// SimulateBlock processes the block on top of its parent, without adding it to the chain,
+// e.g. to compute the state root of a block that is being produced, or to debug a block.
+// The entries and the forkchoice are not modified, the processing runs on copies of the states.
+// The proposer signature is not verified, and the state root of the block is only checked if checkStateRoot is true.
+// The post-state and its root are returned, also if the state root of the block does not match.
+func (uc *UnfinalizedChain) SimulateBlock(ctx context.Context, benv *common.BeaconBlockEnvelope,
+	checkStateRoot bool) (state common.BeaconState, stateRoot Root, err error) {
+	uc.RLock()
+	defer uc.RUnlock()
 
-	data := &att.Data
-	node, ok := uc.ByBlockSlot(data.BeaconBlockRoot, data.Slot)
-	if ok {
-		return fmt.Errorf("unknown block and slot pair: %s, %d", data.BeaconBlockRoot, data.Slot)
+	closest, ok := uc.closest(benv.ParentRoot, benv.Slot)
+	if !ok || closest.BlockRoot() != benv.ParentRoot {
+		return nil, Root{}, fmt.Errorf("unknown parent %s of block", benv.ParentRoot)
 	}
-	epc, err := node.EpochsContext(context.Background())
+	pre := closest.(*HotEntry)
+	if pre.self.Slot < benv.Slot {
+		slots, err := uc.transitionSlots(ctx, pre, benv.Slot)
+		if err != nil {
+			return nil, Root{}, fmt.Errorf("failed to process slots up to block: %v", err)
+		}
+		pre = slots[len(slots)-1]
+	}
+	state, err = pre.State(ctx)
 	if err != nil {
-		return err
+		return nil, Root{}, err
+	}
+	epc, err := pre.EpochsContext(ctx)
+	if err != nil {
+		return nil, Root{}, err
+	}
+	if err := common.PostSlotTransition(ctx, uc.Spec, epc, state, benv, false); err != nil {
+		return nil, Root{}, err
 	}
-	committee, err := epc.GetBeaconCommittee(data.Slot, data.Index)
+	stateRoot = state.HashTreeRoot(tree.GetHashFn())
+	if checkStateRoot && stateRoot != benv.StateRoot {
+		return state, stateRoot, fmt.Errorf("block has state root %s, but post-state has root %s", benv.StateRoot, stateRoot)
+	}
+	return state, stateRoot, nil
+}
+
+// transitionBlock computes the entry of the block, on top of the entry of the block slot.
+// The chain is not modified, the entry is added with insertBlock.
+// If the batch is not nil, the signatures are added to the batch instead of being verified.
+func (uc *UnfinalizedChain) transitionBlock(ctx context.Context, pre *HotEntry, benv *common.BeaconBlockEnvelope,
+	batch *common.SignatureBatch) (*HotEntry, error) {
+	state, err := pre.State(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	epc, err := pre.EpochsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// we already processed the slots (including that of the block itself), just finish the transition.
+	epc.SignatureBatch = batch
+	err = common.PostSlotTransition(ctx, uc.Spec, epc, state, benv, true)
+	epc.SignatureBatch = nil
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &HotEntry{
+		self:      BlockSlotKey{Slot: benv.Slot, Root: benv.BlockRoot},
+		parent:    benv.ParentRoot,
+		epc:       epc,
+		stateRoot: benv.StateRoot,
+		state:     state,
+	}
+	if uc.states != nil {
+		entry.prev = pre
+		// The block is only needed to regenerate the state if it cannot be spilled.
+		if uc.states.db == nil {
+			entry.block = benv
+		}
+	}
+	return entry, nil
+}
+
+// blockExecution returns the execution payload info of the block for the forkchoice.
+// The chain does not verify payloads with an execution engine, blocks with a payload are imported optimistically.
+// An empty payload, before the merge transition, has a zero block hash.
+func blockExecution(benv *common.BeaconBlockEnvelope) forkchoice.ExecutionInfo {
+	var payload *common.ExecutionPayload
+	switch b := benv.SignedBlock.(type) {
+	case *bellatrix.SignedBeaconBlock:
+		payload = &b.Message.Body.ExecutionPayload
+	case *sharding.SignedBeaconBlock:
+		payload = &b.Message.Body.ExecutionPayload
+	}
+	if payload == nil || payload.BlockHash == (Root{}) {
+		return forkchoice.ExecutionInfo{}
 	}
-	indexedAtt, err := att.ConvertToIndexed(uc.Spec, committee)
+	return forkchoice.ExecutionInfo{BlockHash: payload.BlockHash, Status: forkchoice.ExecutionOptimistic}
+}
+
+// insertBlock makes the forkchoice aware of the block, and adds the entry to the chain.
+func (uc *UnfinalizedChain) insertBlock(ctx context.Context, entry *HotEntry, benv *common.BeaconBlockEnvelope) error {
+	p, err := uc.prepareEntry(ctx, entry, benv)
 	if err != nil {
 		return err
 	}
-	for _, index := range indexedAtt.AttestingIndices {
-		// the node should exist, unless pruned during attestation processing, fine to ignore.
-		_ = uc.ForkChoice.ProcessAttestation(index, data.BeaconBlockRoot, data.Slot)
+	if err := uc.trackEntry(ctx, p); err != nil {
+		return err
+	}
+	return uc.realizeEntry(ctx, p)
+}
+
+// pendingEntry is a new entry, with the justification and finalization data to update the forkchoice with.
+type pendingEntry struct {
+	entry *HotEntry
+	// The block of the entry, nil for an empty slot
+	benv *common.BeaconBlockEnvelope
+	// The state of the entry, the store may evict the state of the entry itself once it is tracked.
+	state     common.BeaconState
+	justified Checkpoint
+	finalized Checkpoint
+	// Block entries only
+	unrealizedJustified Checkpoint
+	unrealizedFinalized Checkpoint
+	// The forkchoice balances of the state, computed once when needed.
+	balances []Gwei
+}
+
+// prepareEntry computes the justification and finalization data of a new entry, without modifying the chain.
+func (uc *UnfinalizedChain) prepareEntry(ctx context.Context, entry *HotEntry, benv *common.BeaconBlockEnvelope) (*pendingEntry, error) {
+	p := &pendingEntry{entry: entry, benv: benv, state: entry.state}
+	var err error
+	p.justified, p.finalized, err = stateJustFin(entry.state)
+	if err != nil {
+		return nil, err
+	}
+	if benv != nil {
+		p.unrealizedJustified, p.unrealizedFinalized, err = stateUnrealizedJustFin(ctx, uc.Spec, entry.epc, entry.state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute unrealized justification: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// addTo adds the node of the entry to the forkchoice, and returns false if the forkchoice rejected the block.
+func (p *pendingEntry) addTo(fc forkchoice.ForkchoiceNodeInput) bool {
+	if p.benv == nil {
+		fc.ProcessSlot(p.entry.self.Root, p.entry.self.Slot, p.justified.Epoch, p.finalized.Epoch)
+		return true
+	}
+	return fc.ProcessBlock(p.benv.ParentRoot, p.benv.BlockRoot, p.benv.Slot, p.justified.Epoch, p.finalized.Epoch,
+		p.unrealizedJustified.Epoch, p.unrealizedFinalized.Epoch, blockExecution(p.benv))
+}
+
+// justifiedBalances lazily computes the forkchoice balances of the state of the entry.
+func (p *pendingEntry) justifiedBalances() ([]Gwei, error) {
+	if p.balances == nil {
+		balances, err := forkchoiceBalances(p.entry.epc, p.state)
+		if err != nil {
+			return nil, err
+		}
+		p.balances = balances
+	}
+	return p.balances, nil
+}
+
+// realizeOn updates the forkchoice with the justification and finalization of the entry, like realizeEntry,
+// but without pruning the chain: used to check a batch on a copy of the forkchoice.
+func (p *pendingEntry) realizeOn(ctx context.Context, fc forkchoice.Forkchoice) error {
+	if p.benv == nil {
+		justified, finalized := anchorCheckpoints(fc, p.justified, p.finalized)
+		return fc.UpdateJustified(ctx, p.entry.self.Root, justified, finalized, p.justifiedBalances)
+	}
+	justified, finalized := anchorCheckpoints(fc, p.unrealizedJustified, p.unrealizedFinalized)
+	return fc.UpdateUnrealized(ctx, p.entry.self.Root, p.entry.self.Slot, justified, finalized, p.justifiedBalances)
+}
+
+// trackEntry makes the forkchoice aware of the entry, and adds the entry to the chain.
+// Only a forkchoice rejection of the block can fail, the chain is not modified if so.
+func (uc *UnfinalizedChain) trackEntry(ctx context.Context, p *pendingEntry) error {
+	if !p.addTo(uc.ForkChoice) {
+		return fmt.Errorf("forkchoice rejected block %s at slot %d", p.benv.BlockRoot, p.benv.Slot)
+	}
+	entry := p.entry
+	uc.Entries[entry.self] = entry
+	uc.State2Key[entry.stateRoot] = entry.self
+	if uc.states != nil {
+		uc.states.add(ctx, entry)
+	}
+	return nil
+}
+
+// realizeEntry updates the forkchoice with the justification and finalization of a tracked entry,
+// and publishes the block of the entry.
+func (uc *UnfinalizedChain) realizeEntry(ctx context.Context, p *pendingEntry) error {
+	balances := p.justifiedBalances
+	// Make the forkchoice aware of latest justified/finalized data. Lazy-fetch the balances if necessary.
+	if p.benv == nil {
+		if err := uc.updateJustified(ctx, p.entry.self.Root, p.justified, p.finalized, balances); err != nil {
+			return fmt.Errorf("failed to update forkchoice with new justification data: %v", err)
+		}
+		return nil
+	}
+	// Blocks from before the current epoch are realized right away.
+	if err := uc.updateUnrealized(ctx, p.entry, p.unrealizedJustified, p.unrealizedFinalized, balances); err != nil {
+		return fmt.Errorf("failed to update forkchoice with unrealized justification data: %v", err)
 	}
+	// Only published when the import cannot fail anymore.
+	uc.send(&BlockEvent{Entry: p.entry})
 	return nil
 }
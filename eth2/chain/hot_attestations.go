@@ -0,0 +1,177 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+)
+
+// AttestationResult is the outcome of processing a single attestation of a batch.
+type AttestationResult struct {
+	// Changed lists the attesting indices that changed their forkchoice vote.
+	Changed []ValidatorIndex
+	// Err is the reason the attestation was rejected, nil if it was processed.
+	Err error
+}
+
+// attestationKey identifies the attestation data that is checked against the chain.
+type attestationKey struct {
+	Slot            Slot
+	BeaconBlockRoot Root
+	Source          Checkpoint
+	Target          Checkpoint
+}
+
+type attestationCheck struct {
+	// The entry of the block at the attestation slot, or the latest entry before it, which gets the vote.
+	vote *HotEntry
+	// The epochs context of the epoch of the attestation, with the committees.
+	epc *common.EpochsContext
+	err error
+}
+
+// AddAttestation updates the forkchoice with the given attestation, see AddAttestations.
+func (uc *UnfinalizedChain) AddAttestation(ctx context.Context, att common.AttestationEnvelopeBuilder) (changed []ValidatorIndex, err error) {
+	res := uc.AddAttestations(ctx, []common.AttestationEnvelopeBuilder{att})[0]
+	return res.Changed, res.Err
+}
+
+// AddAttestations updates the forkchoice with the given attestations, of any fork, indexed or not.
+// The attestation data must be consistent with the chain: the block must be known,
+// the target must be the checkpoint of the block in the epoch of the attestation,
+// and the source must be the justified checkpoint at the block.
+// The attestation must be of the current or previous epoch, and not of a future slot, by the time of the last OnTick.
+// Warning: the attestation signatures are not verified, it is up to the caller to verify.
+func (uc *UnfinalizedChain) AddAttestations(ctx context.Context, atts []common.AttestationEnvelopeBuilder) []AttestationResult {
+	uc.Lock()
+	defer uc.Unlock()
+
+	out := make([]AttestationResult, len(atts))
+	// Attestations of the same committee or slot commonly share their data, the data is only checked once.
+	checked := make(map[attestationKey]attestationCheck)
+	votesChanged := false
+	for i, att := range atts {
+		if err := ctx.Err(); err != nil {
+			out[i].Err = err
+			continue
+		}
+		a := att.AttestationEnvelope()
+		key := attestationKey{Slot: a.Slot, BeaconBlockRoot: a.BeaconBlockRoot, Source: a.Source, Target: a.Target}
+		check, ok := checked[key]
+		if !ok {
+			check.vote, check.epc, check.err = uc.checkAttestation(ctx, a)
+			checked[key] = check
+		}
+		if check.err != nil {
+			out[i].Err = check.err
+			continue
+		}
+		out[i].Changed, out[i].Err = uc.applyAttestation(check.vote, check.epc, a)
+		if len(out[i].Changed) > 0 {
+			votesChanged = true
+		}
+	}
+	if votesChanged {
+		// Publish reorgs by votes, like those by blocks. Without a viable head, the change is published later.
+		_, _ = uc.updateHead()
+	}
+	return out
+}
+
+// checkAttestation checks the attestation data against the current slot and the chain,
+// and returns the entry that gets the vote, with the epochs context of the epoch of the attestation.
+// The chain is not modified: entries of empty slots up to the epoch of the attestation are computed, not inserted.
+func (uc *UnfinalizedChain) checkAttestation(ctx context.Context, a *common.AttestationEnvelope) (*HotEntry, *common.EpochsContext, error) {
+	epoch := uc.Spec.SlotToEpoch(a.Slot)
+	if a.Target.Epoch != epoch {
+		return nil, nil, fmt.Errorf("attestation at slot %d has target epoch %d, expected %d", a.Slot, a.Target.Epoch, epoch)
+	}
+	// Like validate_on_attestation of the spec: only attestations of the current and previous epoch count,
+	// and an attestation cannot be from the future.
+	currentSlot := uc.ForkChoice.CurrentSlot()
+	if a.Slot > currentSlot {
+		return nil, nil, fmt.Errorf("attestation slot %d is after current slot %d", a.Slot, currentSlot)
+	}
+	if currentEpoch := uc.Spec.SlotToEpoch(currentSlot); epoch+1 < currentEpoch {
+		return nil, nil, fmt.Errorf("attestation epoch %d is before the previous epoch of current epoch %d", epoch, currentEpoch)
+	}
+	epochStart, err := uc.Spec.EpochStartSlot(epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	blockSlot, ok := uc.ForkChoice.GetSlot(a.BeaconBlockRoot)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown block %s", a.BeaconBlockRoot)
+	}
+	if blockSlot > a.Slot {
+		return nil, nil, fmt.Errorf("block %s at slot %d is after attestation slot %d", a.BeaconBlockRoot, blockSlot, a.Slot)
+	}
+	closest, ok := uc.closest(a.BeaconBlockRoot, a.Slot)
+	if !ok {
+		return nil, nil, fmt.Errorf("no entry of block %s up to slot %d", a.BeaconBlockRoot, a.Slot)
+	}
+	vote := closest.(*HotEntry)
+	// The committee and the checkpoints are those of the epoch of the attestation.
+	entry := vote
+	if entry.self.Slot < epochStart {
+		entries, err := uc.transitionSlots(ctx, entry, epochStart)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to process block %s up to epoch %d: %v", a.BeaconBlockRoot, epoch, err)
+		}
+		entry = entries[len(entries)-1]
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := entry.self.Root
+	if entry.self.Slot > epochStart {
+		target, err = common.GetBlockRootAtSlot(uc.Spec, state, epochStart)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if a.Target.Root != target {
+		return nil, nil, fmt.Errorf("attestation has target %s, but block %s has checkpoint %s in epoch %d",
+			a.Target.Root, a.BeaconBlockRoot, target, epoch)
+	}
+	justified, err := state.CurrentJustifiedCheckpoint()
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.Source != justified {
+		return nil, nil, fmt.Errorf("attestation has source %s, but block %s has justified checkpoint %s",
+			&a.Source, a.BeaconBlockRoot, &justified)
+	}
+	return vote, entry.epc, nil
+}
+
+// applyAttestation applies the votes of the attesting indices to the forkchoice, on the node of the given entry.
+// The committee is looked up in the epochs context of the epoch of the attestation.
+func (uc *UnfinalizedChain) applyAttestation(entry *HotEntry, epc *common.EpochsContext, a *common.AttestationEnvelope) ([]ValidatorIndex, error) {
+	var committee []ValidatorIndex
+	if !a.Indexed() {
+		var err error
+		committee, err = epc.GetBeaconCommittee(a.Slot, a.CommitteeIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	indices, err := a.Indices(committee)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indices {
+		if _, ok := epc.ValidatorPubkeyCache.Pubkey(index); !ok {
+			return nil, fmt.Errorf("unknown attesting validator %d", index)
+		}
+	}
+	var changed []ValidatorIndex
+	for _, index := range indices {
+		// The vote is for the latest node of the block up to the attestation slot.
+		if _, voteChanged := uc.ForkChoice.ProcessAttestation(index, entry.self.Root, entry.self.Slot); voteChanged {
+			changed = append(changed, index)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,171 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+func TestAddAttestations(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := testBlock(t, spec, ch, genesis.BlockRoot(), 1, 0)
+	if err := ch.AddBlock(ctx, blockA); err != nil {
+		t.Fatal(err)
+	}
+	blockB := testBlock(t, spec, ch, blockA.BlockRoot, 2, 0)
+	if err := ch.AddBlock(ctx, blockB); err != nil {
+		t.Fatal(err)
+	}
+	blockC := testBlock(t, spec, ch, blockA.BlockRoot, 2, 1)
+	if err := ch.AddBlock(ctx, blockC); err != nil {
+		t.Fatal(err)
+	}
+	committee := func(root Root, slot Slot) []ValidatorIndex {
+		entry, err := ch.Towards(ctx, root, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		epc, err := entry.EpochsContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		comm, err := epc.GetBeaconCommittee(slot, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return comm
+	}
+	attestation := func(root Root, slot Slot, target Checkpoint, comm []ValidatorIndex) *phase0.Attestation {
+		bits := phase0.AttestationBits(make([]byte, len(comm)/8+1))
+		for i := range comm {
+			bits.SetBit(uint64(i), true)
+		}
+		bits[len(comm)/8] |= 1 << (len(comm) % 8)
+		return &phase0.Attestation{
+			AggregationBits: bits,
+			Data: phase0.AttestationData{
+				Slot:            slot,
+				BeaconBlockRoot: root,
+				Target:          target,
+			},
+		}
+	}
+	genesisTarget := Checkpoint{Root: genesis.BlockRoot(), Epoch: 0}
+	tick := func(slot Slot) {
+		t.Helper()
+		if err := uc.OnTick(ctx, ch.Genesis().Time+common.Timestamp(slot)*spec.SECONDS_PER_SLOT); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An attestation of a future slot is rejected before processing any slots.
+	entryCount := len(uc.Entries)
+	future, _ := spec.EpochStartSlot(10)
+	if _, err := uc.AddAttestation(ctx, attestation(blockB.BlockRoot, future, Checkpoint{Root: blockB.BlockRoot, Epoch: 10}, nil)); err == nil {
+		t.Fatal("expected attestation of future slot to fail")
+	}
+	if len(uc.Entries) != entryCount {
+		t.Fatalf("expected rejected attestation to not add entries, got %d, expected %d", len(uc.Entries), entryCount)
+	}
+	tick(3)
+
+	commB := committee(blockB.BlockRoot, 2)
+	changed, err := uc.AddAttestation(ctx, attestation(blockB.BlockRoot, 2, genesisTarget, commB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != len(commB) {
+		t.Fatalf("expected %d changed votes, got %v", len(commB), changed)
+	}
+	// the same votes again do not change anything
+	changed, err = uc.AddAttestation(ctx, attestation(blockB.BlockRoot, 2, genesisTarget, commB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("expected no changed votes, got %v", changed)
+	}
+
+	// an indexed attestation of a later slot, for the other fork
+	commC := committee(blockC.BlockRoot, 3)
+	indexed := &phase0.IndexedAttestation{
+		AttestingIndices: commC[:2],
+		Data: phase0.AttestationData{
+			Slot:            3,
+			BeaconBlockRoot: blockC.BlockRoot,
+			Target:          genesisTarget,
+		},
+	}
+	badTarget := attestation(blockC.BlockRoot, 3, Checkpoint{Root: blockA.BlockRoot}, commC)
+	badSource := attestation(blockC.BlockRoot, 3, genesisTarget, commC)
+	badSource.Data.Source = Checkpoint{Root: blockA.BlockRoot}
+	unknown := attestation(Root{0x42}, 3, genesisTarget, commC)
+	early := attestation(blockC.BlockRoot, 1, genesisTarget, committee(blockA.BlockRoot, 1))
+	results := uc.AddAttestations(ctx, []common.AttestationEnvelopeBuilder{badTarget, indexed, badSource, unknown, early})
+	for i, res := range results {
+		if (res.Err == nil) != (i == 1) {
+			t.Fatalf("unexpected result of attestation %d: %v", i, res.Err)
+		}
+	}
+	if changed := results[1].Changed; len(changed) != 2 || changed[0] != commC[0] || changed[1] != commC[1] {
+		t.Fatalf("unexpected changed votes: %v", changed)
+	}
+
+	// a vote in the next epoch checks the target against the start of the epoch
+	slot, _ := spec.EpochStartSlot(1)
+	slot += 1
+	epochTarget := Checkpoint{Root: blockB.BlockRoot, Epoch: 1}
+	commNext := committee(blockB.BlockRoot, slot)
+	tick(slot + 3)
+	changed, err = uc.AddAttestation(ctx, attestation(blockB.BlockRoot, slot, epochTarget, commNext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != len(commNext) {
+		t.Fatalf("expected %d changed votes, got %v", len(commNext), changed)
+	}
+	if _, err := uc.AddAttestation(ctx, attestation(blockB.BlockRoot, slot, genesisTarget, commNext)); err == nil {
+		t.Fatal("expected attestation with target of previous epoch to fail")
+	}
+
+	// Votes of later committees move the head to C, which is published without computing the head explicitly.
+	events := make(chan ChainEvent, 10)
+	sub := ch.Subscribe(events)
+	defer sub.Unsubscribe()
+	var reorg []common.AttestationEnvelopeBuilder
+	for i := Slot(1); i <= 3; i++ {
+		reorg = append(reorg, attestation(blockC.BlockRoot, slot+i, Checkpoint{Root: blockC.BlockRoot, Epoch: 1},
+			committee(blockC.BlockRoot, slot+i)))
+	}
+	for i, res := range uc.AddAttestations(ctx, reorg) {
+		if res.Err != nil {
+			t.Fatalf("failed to process attestation %d: %v", i, res.Err)
+		}
+	}
+	ev, ok := nextEvent(t, events).(*HeadEvent)
+	if !ok || ev.Head.BlockRoot() != blockC.BlockRoot || ev.PrevHead.Root != blockB.BlockRoot || !ev.Reorg() {
+		t.Fatalf("expected reorg to C, got %v", ev)
+	}
+
+	// Attestations of epochs before the previous epoch are rejected.
+	epoch2, _ := spec.EpochStartSlot(2)
+	tick(epoch2 + spec.SLOTS_PER_EPOCH)
+	if _, err := uc.AddAttestation(ctx, attestation(blockC.BlockRoot, slot+4, Checkpoint{Root: blockC.BlockRoot, Epoch: 1},
+		committee(blockC.BlockRoot, slot+4))); err == nil {
+		t.Fatal("expected attestation of old epoch to fail")
+	}
+}
@@ -0,0 +1,320 @@
+package chain
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/tree"
+	"sync"
+)
+
+// HotStateStore bounds the number of hot states that are kept in memory.
+// When more states than the budget are resident, the least recently used states are evicted:
+// spilled to a states.DB, or dropped and regenerated by replaying blocks on top of an earlier state.
+// Evicted states are reloaded transparently when the state of the entry is requested.
+//
+// States of the same chain share most of their tree backing, the real memory usage per state varies.
+// The budget is a number of states, as the size of a single state is not tracked.
+type HotStateStore struct {
+	mu sync.Mutex
+	// Maximum number of states to keep in memory
+	maxResident int
+	// DB to spill evicted states to. If nil, evicted states are dropped.
+	db states.DB
+	// Resident states, least recently used at the back. Elements are *HotEntry
+	resident *list.List
+	spec     *common.Spec
+}
+
+// NewHotStateStore creates a store that keeps up to maxResident hot states in memory.
+// If db is nil, evicted states are dropped, and regenerated by replaying the blocks of the hot chain.
+// The db must not be shared with the cold chain: states are removed from it when entries are pruned.
+func NewHotStateStore(spec *common.Spec, maxResident int, db states.DB) *HotStateStore {
+	if maxResident < 1 {
+		maxResident = 1
+	}
+	return &HotStateStore{
+		maxResident: maxResident,
+		db:          db,
+		resident:    list.New(),
+		spec:        spec,
+	}
+}
+
+// HotStateStats describes where the states of hot entries are kept.
+type HotStateStats struct {
+	// Resident states are kept in memory
+	Resident int
+	// Spilled states are not in memory, and stored in the states DB of the HotStateStore
+	Spilled int
+	// Dropped states are not in memory, and regenerated by replaying blocks when requested
+	Dropped int
+}
+
+// add registers the entry with the store. The entry must have a state.
+func (s *HotStateStore) add(ctx context.Context, e *HotEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.store = s
+	e.refs++
+	if e.refs == 1 && e.state != nil {
+		s.touch(e)
+		s.evict(ctx, e)
+	}
+}
+
+// retain registers a copy of the chain that shares the entry, the copy releases the entry when it is closed.
+func (s *HotStateStore) retain(e *HotEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.refs++
+}
+
+// release unregisters a chain from the entry.
+// When no chain uses the entry anymore, it no longer counts towards the budget, and any spilled state is removed.
+func (s *HotStateStore) release(e *HotEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.refs--
+	if e.refs > 0 {
+		return nil
+	}
+	if e.elem != nil {
+		s.resident.Remove(e.elem)
+		e.elem = nil
+	}
+	if e.spilled && s.db != nil {
+		e.spilled = false
+		if err := s.db.Remove(e.stateRoot); err != nil {
+			return fmt.Errorf("failed to remove spilled state %s: %v", e.stateRoot, err)
+		}
+	}
+	return nil
+}
+
+// state returns a copy of the state of the entry, and reloads it if necessary.
+func (s *HotStateStore) state(ctx context.Context, e *HotEntry) (common.BeaconState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.load(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+	return state.CopyState()
+}
+
+// stats adds the state location of the given entry to the stats.
+func (s *HotStateStore) stats(e *HotEntry, out *HotStateStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.state != nil {
+		out.Resident++
+	} else if e.spilled {
+		out.Spilled++
+	} else {
+		out.Dropped++
+	}
+}
+
+func (s *HotStateStore) touch(e *HotEntry) {
+	if e.elem != nil {
+		s.resident.MoveToFront(e.elem)
+	} else {
+		e.elem = s.resident.PushFront(e)
+	}
+}
+
+// evictable returns true if the state of the entry can be reloaded after eviction.
+func (s *HotStateStore) evictable(e *HotEntry) bool {
+	return s.db != nil || (e.prev != nil && (e.block != nil || !e.hasBlock()))
+}
+
+// evict removes states from memory, least recently used first, until the budget is met.
+// Eviction is best-effort: states that cannot be spilled stay in memory.
+func (s *HotStateStore) evict(ctx context.Context, keep *HotEntry) {
+	elem := s.resident.Back()
+	for s.resident.Len() > s.maxResident && elem != nil {
+		e := elem.Value.(*HotEntry)
+		elem = elem.Prev()
+		if e == keep || !s.evictable(e) {
+			continue
+		}
+		if s.db != nil && !e.spilled {
+			if err := s.db.Store(ctx, e.state); err != nil {
+				continue
+			}
+			e.spilled = true
+		}
+		s.resident.Remove(e.elem)
+		e.elem = nil
+		e.state = nil
+	}
+}
+
+// load makes the state of the entry resident, and returns it. The returned state may not be modified.
+func (s *HotStateStore) load(ctx context.Context, e *HotEntry) (common.BeaconState, error) {
+	if e.state != nil {
+		if e.elem != nil {
+			s.touch(e)
+		}
+		return e.state, nil
+	}
+	var state common.BeaconState
+	if e.spilled {
+		var err error
+		state, err = s.db.Get(ctx, e.stateRoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reload spilled state %s: %v", e.stateRoot, err)
+		}
+		if state == nil {
+			return nil, fmt.Errorf("spilled state %s is missing", e.stateRoot)
+		}
+	} else {
+		var err error
+		state, err = s.regen(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.state = state
+	if e.refs > 0 {
+		s.touch(e)
+		s.evict(ctx, e)
+	}
+	return state, nil
+}
+
+// regen regenerates a dropped state, by replaying slots and blocks on top of the closest earlier available state.
+func (s *HotStateStore) regen(ctx context.Context, e *HotEntry) (common.BeaconState, error) {
+	var path []*HotEntry
+	base := e
+	for base.state == nil && !base.spilled {
+		if base.prev == nil || (base.block == nil && base.hasBlock()) {
+			return nil, fmt.Errorf("no earlier state to regenerate hot state %s (slot %d) from",
+				e.stateRoot, e.self.Slot)
+		}
+		path = append(path, base)
+		base = base.prev
+	}
+	baseState := base.state
+	if baseState == nil {
+		var err error
+		baseState, err = s.db.Get(ctx, base.stateRoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reload spilled state %s: %v", base.stateRoot, err)
+		}
+		if baseState == nil {
+			return nil, fmt.Errorf("spilled state %s is missing", base.stateRoot)
+		}
+	}
+	// Both the resident state and the spilled state (the DB may return the stored object) must not be modified.
+	state, err := baseState.CopyState()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		next := path[i]
+		epc := next.prev.epc.Clone()
+		if next.block != nil {
+			// The block was verified when it was imported, and the resulting state root is verified.
+			if err := common.PostSlotTransition(ctx, s.spec, epc, state, next.block, false); err != nil {
+				return nil, fmt.Errorf("failed to replay block %s to regenerate hot state: %v", next.self.Root, err)
+			}
+		} else {
+			var err error
+			state, err = processNextSlot(ctx, s.spec, epc, state)
+			if err != nil {
+				return nil, fmt.Errorf("failed to process slot %d to regenerate hot state: %v", next.self.Slot, err)
+			}
+		}
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != e.stateRoot {
+		return nil, fmt.Errorf("regenerated hot state has root %s, expected %s", root, e.stateRoot)
+	}
+	return state, nil
+}
+
+// reanchor anchors the remaining entries that were derived from pruned entries,
+// so their states can still be regenerated after the pruned entries are released.
+func (s *HotStateStore) reanchor(ctx context.Context, remaining map[BlockSlotKey]*HotEntry, pruned []*HotEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prunedSet := make(map[*HotEntry]struct{}, len(pruned))
+	for _, e := range pruned {
+		prunedSet[e] = struct{}{}
+	}
+	for _, e := range remaining {
+		if e.prev == nil {
+			continue
+		}
+		if _, ok := prunedSet[e.prev]; !ok {
+			continue
+		}
+		if _, err := s.load(ctx, e); err != nil {
+			return fmt.Errorf("failed to anchor hot state %s: %v", e.stateRoot, err)
+		}
+		e.prev = nil
+		e.block = nil
+	}
+	return nil
+}
+
+// SetStateStore makes the hot chain keep its states in the given store, to bound the memory usage.
+// The existing entries are added to the store. This must be set before the chain is copied.
+func (uc *UnfinalizedChain) SetStateStore(ctx context.Context, store *HotStateStore) {
+	uc.Lock()
+	defer uc.Unlock()
+	uc.states = store
+	for _, e := range uc.Entries {
+		store.add(ctx, e)
+	}
+}
+
+// StateStats returns where the states of the hot entries are kept.
+func (uc *UnfinalizedChain) StateStats() HotStateStats {
+	uc.RLock()
+	defer uc.RUnlock()
+	if uc.states == nil {
+		return HotStateStats{Resident: len(uc.Entries)}
+	}
+	var out HotStateStats
+	for _, e := range uc.Entries {
+		uc.states.stats(e, &out)
+	}
+	return out
+}
+
+// Close releases the states of the entries that this chain shares with the chain it was copied from.
+// The chain can still be used, but the states of the shared entries may no longer be available.
+func (uc *UnfinalizedChain) Close() error {
+	uc.Lock()
+	defer uc.Unlock()
+	retained := uc.retained
+	uc.retained = nil
+	for _, e := range retained {
+		if err := e.store.release(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releasePruned releases the states of the entries that were pruned from the chain.
+func (uc *UnfinalizedChain) releasePruned(ctx context.Context) error {
+	if len(uc.pruned) == 0 {
+		return nil
+	}
+	pruned := uc.pruned
+	uc.pruned = nil
+	if err := uc.states.reanchor(ctx, uc.Entries, pruned); err != nil {
+		return err
+	}
+	for _, e := range pruned {
+		if err := uc.states.release(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func testHotStateStore(t *testing.T, spill bool) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	var spillDB states.DB
+	if spill {
+		spillDB = states.NewMemDB(spec)
+	}
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	uc.SetStateStore(ctx, NewHotStateStore(spec, 3, spillDB))
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := head.BlockRoot()
+	for _, slot := range []Slot{1, 2, 4, 5, 6, 7} {
+		benv := testBlock(t, spec, ch, parent, slot, 0)
+		if err := ch.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		parent = benv.BlockRoot
+	}
+	stats := uc.StateStats()
+	if stats.Resident > 3 {
+		t.Fatalf("expected at most 3 resident states, got %d", stats.Resident)
+	}
+	if total := stats.Resident + stats.Spilled + stats.Dropped; total != len(uc.Entries) {
+		t.Fatalf("stats cover %d entries, expected %d", total, len(uc.Entries))
+	}
+	if spill && (stats.Spilled == 0 || stats.Dropped != 0) {
+		t.Fatalf("expected spilled states only, got %+v", stats)
+	}
+	if !spill && (stats.Dropped == 0 || stats.Spilled != 0) {
+		t.Fatalf("expected dropped states only, got %+v", stats)
+	}
+	checkStates := func() {
+		for key, entry := range uc.Entries {
+			state, err := entry.State(ctx)
+			if err != nil {
+				t.Fatalf("failed to reload state of %s:%d: %v", key.Root, key.Slot, err)
+			}
+			if root := state.HashTreeRoot(tree.GetHashFn()); root != entry.StateRoot() {
+				t.Fatalf("reloaded state of %s:%d has root %s, expected %s", key.Root, key.Slot, root, entry.StateRoot())
+			}
+		}
+	}
+	checkStates()
+
+	// pruned entries move to the cold chain, the remaining states can still be reloaded.
+	before := len(uc.Entries)
+	testFinalize(t, uc, parent, 1)
+	if len(uc.Entries) >= before {
+		t.Fatal("expected finalization to prune hot entries")
+	}
+	cold, ok := ch.ColdChain.ByCanonStep(AsStep(7, true))
+	if !ok {
+		t.Fatal("expected finalized block in cold chain")
+	}
+	coldState, err := cold.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := coldState.HashTreeRoot(tree.GetHashFn()); root != cold.StateRoot() {
+		t.Fatalf("cold state has root %s, expected %s", root, cold.StateRoot())
+	}
+	checkStates()
+	if stats := uc.StateStats(); stats.Resident > 3 {
+		t.Fatalf("expected at most 3 resident states after pruning, got %d", stats.Resident)
+	}
+}
+
+func TestHotStateStoreDrop(t *testing.T) {
+	testHotStateStore(t, false)
+}
+
+func TestHotStateStoreSpill(t *testing.T) {
+	testHotStateStore(t, true)
+}
+
+func TestHotStateStoreRegenFromSpilled(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	store := NewHotStateStore(spec, 2, states.NewMemDB(spec))
+	uc.SetStateStore(ctx, store)
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := head.BlockRoot()
+	// Gap slots: the empty slot states can be regenerated, with a spilled state as base.
+	for _, slot := range []Slot{1, 6} {
+		benv := testBlock(t, spec, ch, parent, slot, 0)
+		if err := ch.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		parent = benv.BlockRoot
+	}
+	// Drop the states of two entries after a spilled state, to regenerate both from the same spilled state.
+	var child, grandchild *HotEntry
+	store.mu.Lock()
+	for _, e := range uc.Entries {
+		if e.hasBlock() || e.prev == nil || e.prev.hasBlock() || e.prev.prev == nil {
+			continue
+		}
+		if base := e.prev.prev; base.spilled && base.state == nil {
+			child, grandchild = e.prev, e
+			break
+		}
+	}
+	if grandchild == nil {
+		store.mu.Unlock()
+		t.Fatal("expected entries after a spilled state")
+	}
+	for _, e := range []*HotEntry{child, grandchild} {
+		if e.elem != nil {
+			store.resident.Remove(e.elem)
+			e.elem = nil
+		}
+		e.state = nil
+		e.spilled = false
+	}
+	store.mu.Unlock()
+	for _, e := range []*HotEntry{grandchild, child} {
+		state, err := e.State(ctx)
+		if err != nil {
+			t.Fatalf("failed to regenerate state of %s:%d: %v", e.self.Root, e.self.Slot, err)
+		}
+		if root := state.HashTreeRoot(tree.GetHashFn()); root != e.StateRoot() {
+			t.Fatalf("regenerated state of %s:%d has root %s, expected %s", e.self.Root, e.self.Slot, root, e.StateRoot())
+		}
+	}
+	// The spilled state itself is not modified by the regeneration.
+	base := child.prev
+	state, err := base.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := state.HashTreeRoot(tree.GetHashFn()); root != base.StateRoot() {
+		t.Fatalf("spilled state has root %s, expected %s", root, base.StateRoot())
+	}
+}
+
+func TestHotStateStoreCopy(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	store := NewHotStateStore(spec, 2, states.NewMemDB(spec))
+	uc.SetStateStore(ctx, store)
+	head, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := head.BlockRoot()
+	for _, slot := range []Slot{1, 2} {
+		benv := testBlock(t, spec, ch, parent, slot, 0)
+		if err := ch.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		parent = benv.BlockRoot
+	}
+	checkRefs := func(refs int) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		for key, e := range uc.Entries {
+			if e.refs != refs {
+				t.Fatalf("entry %s:%d has %d refs, expected %d", key.Root, key.Slot, e.refs, refs)
+			}
+		}
+	}
+	copied := uc.Copy(BlockSinkFn(func(ctx context.Context, entry ChainEntry, canonical bool, finalized Checkpoint) error {
+		return nil
+	}))
+	checkRefs(2)
+	resident := store.resident.Len()
+	// Entries added by the copy do not take the budget of the store, and do not evict states of the chain.
+	benv := testBlock(t, spec, ch, parent, 4, 0)
+	if err := copied.AddBlock(ctx, benv); err != nil {
+		t.Fatal(err)
+	}
+	for key, e := range copied.Entries {
+		if _, ok := uc.Entries[key]; !ok && (e.store != nil || e.prev != nil) {
+			t.Fatalf("entry %s:%d of copy is managed by the store of the chain", key.Root, key.Slot)
+		}
+	}
+	if n := store.resident.Len(); n != resident {
+		t.Fatalf("expected %d resident states after import in copy, got %d", resident, n)
+	}
+	if err := copied.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(1)
+	// closing again does not release the entries twice
+	if err := copied.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkRefs(1)
+}
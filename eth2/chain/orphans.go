@@ -0,0 +1,147 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type OrphanReason uint8
+
+const (
+	// OrphanFinalizedConflict is the reason for entries that got pruned because they conflict with finalization.
+	OrphanFinalizedConflict OrphanReason = iota
+)
+
+func (r OrphanReason) String() string {
+	switch r {
+	case OrphanFinalizedConflict:
+		return "finalized_conflict"
+	default:
+		return fmt.Sprintf("unknown_%d", uint8(r))
+	}
+}
+
+// OrphanEntry describes a non-canonical block that was pruned from the hot chain.
+type OrphanEntry struct {
+	BlockRoot     Root
+	Slot          Slot
+	ParentRoot    Root
+	StateRoot     Root
+	ProposerIndex ValidatorIndex
+	// Reason why the block was pruned
+	Reason OrphanReason
+	// The finalized checkpoint that caused the block to be pruned
+	PrunedBy Checkpoint
+}
+
+type OrphanStore interface {
+	// AddOrphan records a pruned non-canonical entry. Entries without a block are ignored.
+	AddOrphan(ctx context.Context, entry ChainEntry, reason OrphanReason, prunedBy Checkpoint) error
+	// Orphan gets the orphaned block with the given root.
+	Orphan(root Root) (orphan OrphanEntry, ok bool)
+	// OrphansBySlot gets the orphaned blocks with a slot in the given range (inclusive start, exclusive end),
+	// ordered by slot.
+	OrphansBySlot(start Slot, end Slot) []OrphanEntry
+	// OrphansByProposer gets the orphaned blocks of the given proposer, ordered by slot.
+	OrphansByProposer(proposer ValidatorIndex) []OrphanEntry
+}
+
+// MemOrphanStore keeps orphaned blocks in memory.
+type MemOrphanStore struct {
+	sync.RWMutex
+	// Orphans, ordered by slot
+	orphans []OrphanEntry
+	roots   map[Root]OrphanEntry
+}
+
+var _ OrphanStore = (*MemOrphanStore)(nil)
+
+func NewMemOrphanStore() *MemOrphanStore {
+	return &MemOrphanStore{roots: make(map[Root]OrphanEntry)}
+}
+
+func (st *MemOrphanStore) AddOrphan(ctx context.Context, entry ChainEntry, reason OrphanReason, prunedBy Checkpoint) error {
+	if !entry.Step().Block() {
+		return nil
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get state of orphan %s: %v", entry.BlockRoot(), err)
+	}
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		return fmt.Errorf("failed to get block header of orphan %s: %v", entry.BlockRoot(), err)
+	}
+	orphan := OrphanEntry{
+		BlockRoot:     entry.BlockRoot(),
+		Slot:          entry.Step().Slot(),
+		ParentRoot:    entry.ParentRoot(),
+		StateRoot:     entry.StateRoot(),
+		ProposerIndex: header.ProposerIndex,
+		Reason:        reason,
+		PrunedBy:      prunedBy,
+	}
+
+	st.Lock()
+	defer st.Unlock()
+	if _, ok := st.roots[orphan.BlockRoot]; ok {
+		return nil
+	}
+	st.roots[orphan.BlockRoot] = orphan
+	// insert after any orphans of the same slot
+	i := sort.Search(len(st.orphans), func(i int) bool {
+		return st.orphans[i].Slot > orphan.Slot
+	})
+	st.orphans = append(st.orphans, OrphanEntry{})
+	copy(st.orphans[i+1:], st.orphans[i:])
+	st.orphans[i] = orphan
+	return nil
+}
+
+func (st *MemOrphanStore) Copy() *MemOrphanStore {
+	st.RLock()
+	defer st.RUnlock()
+	out := &MemOrphanStore{
+		orphans: append([]OrphanEntry(nil), st.orphans...),
+		roots:   make(map[Root]OrphanEntry, len(st.roots)),
+	}
+	for k, v := range st.roots {
+		out.roots[k] = v
+	}
+	return out
+}
+
+func (st *MemOrphanStore) Orphan(root Root) (orphan OrphanEntry, ok bool) {
+	st.RLock()
+	defer st.RUnlock()
+	orphan, ok = st.roots[root]
+	return orphan, ok
+}
+
+func (st *MemOrphanStore) OrphansBySlot(start Slot, end Slot) []OrphanEntry {
+	st.RLock()
+	defer st.RUnlock()
+	i := sort.Search(len(st.orphans), func(i int) bool {
+		return st.orphans[i].Slot >= start
+	})
+	j := sort.Search(len(st.orphans), func(i int) bool {
+		return st.orphans[i].Slot >= end
+	})
+	if i >= j {
+		return nil
+	}
+	return append([]OrphanEntry(nil), st.orphans[i:j]...)
+}
+
+func (st *MemOrphanStore) OrphansByProposer(proposer ValidatorIndex) (out []OrphanEntry) {
+	st.RLock()
+	defer st.RUnlock()
+	for _, o := range st.orphans {
+		if o.ProposerIndex == proposer {
+			out = append(out, o)
+		}
+	}
+	return out
+}
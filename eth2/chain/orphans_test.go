@@ -0,0 +1,109 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/forkchoice"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// addTestBlockEntry adds an entry to the hot chain as if a block was processed,
+// without running a block transition.
+func addTestBlockEntry(t *testing.T, uc *UnfinalizedChain, parent Root, root Root, slot Slot, proposer ValidatorIndex) {
+	ctx := context.Background()
+	pre, err := uc.Towards(ctx, parent, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := pre.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := pre.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SetLatestBlockHeader(&common.BeaconBlockHeader{
+		Slot:          slot,
+		ProposerIndex: proposer,
+		ParentRoot:    parent,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	justified, finalized, err := stateJustFin(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc.Lock()
+	defer uc.Unlock()
+	if !uc.ForkChoice.ProcessBlock(parent, root, slot, justified.Epoch, finalized.Epoch, justified.Epoch, finalized.Epoch,
+		forkchoice.ExecutionInfo{}) {
+		t.Fatalf("failed to add block %s to forkchoice", root)
+	}
+	key := BlockSlotKey{Slot: slot, Root: root}
+	uc.Entries[key] = NewHotEntry(key, parent, state, epc)
+	uc.State2Key[state.HashTreeRoot(tree.GetHashFn())] = key
+}
+
+func TestOrphanedBlocks(t *testing.T) {
+	spec := chaintest.Spec()
+	ch, err := NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := ch.HotChain.(*UnfinalizedChain)
+	genesis, err := ch.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := genesis.BlockRoot()
+	// Two conflicting blocks, A at slot 1 and B at slot 2, both building on genesis.
+	a, b := Root{0xaa}, Root{0xbb}
+	addTestBlockEntry(t, uc, g, a, 1, 3)
+	addTestBlockEntry(t, uc, g, b, 2, 5)
+
+	// Finalize the epoch start of A, B is pruned and orphaned.
+	checkpoint := testFinalize(t, uc, a, 1)
+
+	if _, ok := ch.HotChain.ByBlock(b); ok {
+		t.Fatal("expected B to be pruned from hot chain")
+	}
+	if entry, ok := ch.ColdChain.ByBlock(a); !ok || entry.Step() != AsStep(1, true) {
+		t.Fatal("expected A to be in the cold chain")
+	}
+	orphan, ok := ch.Orphan(b)
+	if !ok {
+		t.Fatal("expected B to be orphaned")
+	}
+	expected := OrphanEntry{
+		BlockRoot:     b,
+		Slot:          2,
+		ParentRoot:    g,
+		StateRoot:     orphan.StateRoot,
+		ProposerIndex: 5,
+		Reason:        OrphanFinalizedConflict,
+		PrunedBy:      checkpoint,
+	}
+	if orphan != expected {
+		t.Fatalf("unexpected orphan: %+v", orphan)
+	}
+	if _, ok := ch.Orphan(a); ok {
+		t.Fatal("canonical block A must not be orphaned")
+	}
+	if got := ch.OrphansBySlot(0, 2); len(got) != 0 {
+		t.Fatalf("unexpected orphans before slot 2: %v", got)
+	}
+	if got := ch.OrphansBySlot(2, 3); len(got) != 1 || got[0].BlockRoot != b {
+		t.Fatalf("unexpected orphans at slot 2: %v", got)
+	}
+	if got := ch.OrphansByProposer(5); len(got) != 1 || got[0].BlockRoot != b {
+		t.Fatalf("unexpected orphans of proposer 5: %v", got)
+	}
+	if got := ch.OrphansByProposer(3); len(got) != 0 {
+		t.Fatalf("unexpected orphans of proposer 3: %v", got)
+	}
+}
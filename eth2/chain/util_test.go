@@ -0,0 +1,66 @@
+package chain
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+// testAnchor transitions the genesis state to the start of the given epoch, upgrading at fork boundaries.
+func testAnchor(t testing.TB, spec *common.Spec, epoch common.Epoch) common.BeaconState {
+	state := chaintest.Genesis(t, spec)
+	if epoch == 0 {
+		return state
+	}
+	epc, err := common.NewEpochsContext(spec, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, _ := spec.EpochStartSlot(epoch)
+	upgradeable := &beacon.StandardUpgradeableBeaconState{BeaconState: state}
+	if err := common.ProcessSlots(context.Background(), spec, epc, upgradeable, slot); err != nil {
+		t.Fatal(err)
+	}
+	return upgradeable.BeaconState
+}
+
+// testBlock builds a signed phase0 block on top of the given parent block.
+// The graffiti can be used to produce different blocks for the same slot and parent.
+func testBlock(t testing.TB, spec *common.Spec, ch HotChain, parent common.Root, slot common.Slot, graffiti byte) *common.BeaconBlockEnvelope {
+	pre, err := ch.Towards(context.Background(), parent, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chaintest.Block(t, spec, pre, parent, slot, graffiti)
+}
+
+// testFinalize makes the hot chain justify and finalize the given block as checkpoint of the given epoch,
+// as if the epoch transition did, and prunes the hot chain accordingly.
+func testFinalize(t testing.TB, uc *UnfinalizedChain, root common.Root, epoch common.Epoch) common.Checkpoint {
+	ctx := context.Background()
+	slot, _ := uc.Spec.EpochStartSlot(epoch)
+	anchor, err := uc.Towards(ctx, root, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchorState, err := anchor.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchorEpc, err := anchor.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := common.Checkpoint{Root: root, Epoch: epoch}
+	uc.Lock()
+	defer uc.Unlock()
+	if err := uc.updateJustified(ctx, root, checkpoint, checkpoint, func() ([]common.Gwei, error) {
+		return forkchoiceBalances(anchorEpc, anchorState)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint
+}
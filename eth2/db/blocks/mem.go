@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
-	"github.com/protolambda/zrnt/eth2/beacon/phase0"
 	"github.com/protolambda/ztyp/codec"
 	"io"
 	"sync"
@@ -14,7 +13,7 @@ import (
 )
 
 type MemDB struct {
-	// beacon.Root -> []byte (fork digest ++ serialized SignedBeaconBlock)
+	// beacon.Root -> []byte (fork digest ++ serialized SignedBeaconBlock), not shared with the block pool
 	data        sync.Map
 	removalLock sync.Mutex
 	stats       DBStats
@@ -29,8 +28,8 @@ func NewMemDB(spec *common.Spec, dec *beacon.ForkDecoder) *MemDB {
 }
 
 func (db *MemDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (exists bool, err error) {
-	// Released when the block is removed from the DB
 	buf := getPoolBlockBuf()
+	defer dbBlockPool.Put(buf)
 	if _, err := buf.Write(benv.ForkDigest[:]); err != nil {
 		return false, err
 	}
@@ -38,14 +37,14 @@ func (db *MemDB) Store(ctx context.Context, benv *common.BeaconBlockEnvelope) (e
 	if err != nil {
 		return false, fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
 	}
-	existing, loaded := db.data.LoadOrStore(benv.BlockRoot, buf.Bytes())
+	// The pooled buffer is reused, store a copy of the contents.
+	data := append([]byte(nil), buf.Bytes()...)
+	existing, loaded := db.data.LoadOrStore(benv.BlockRoot, data)
 	if loaded {
-		existingBlock := existing.(*phase0.SignedBeaconBlock)
-		sigDifference := existingBlock.Signature != benv.Signature
-		dbBlockPool.Put(buf) // put it back, we didn't store it
-		if sigDifference {
-			return true, fmt.Errorf("block %s already exists, but its signature %x does not match new signature %s",
-				benv.BlockRoot, existingBlock.Signature, benv.Signature)
+		// Same block root, so any difference is in the signature (the last bytes of the block container).
+		if !bytes.Equal(existing.([]byte), data) {
+			return true, fmt.Errorf("block %s already exists, but its signature does not match new signature %s",
+				benv.BlockRoot, benv.Signature)
 		}
 	} else {
 		atomic.AddInt64(&db.stats.Count, 1)
@@ -76,7 +75,7 @@ func (db *MemDB) Get(ctx context.Context, root common.Root) (envelope *common.Be
 	if !ok {
 		return nil, nil
 	}
-	buf := dat.(*bytes.Buffer)
+	buf := bytes.NewReader(dat.([]byte))
 	var digest common.ForkDigest
 	if _, err := buf.Read(digest[:]); err != nil {
 		return nil, err
@@ -85,7 +84,7 @@ func (db *MemDB) Get(ctx context.Context, root common.Root) (envelope *common.Be
 	if err != nil {
 		return nil, err
 	}
-	return decodeOpaqueBlock(block, db.spec, digest, uint64(len(buf.Bytes())), buf)
+	return decodeOpaqueBlock(block, db.spec, digest, uint64(buf.Len()), buf)
 }
 
 func (db *MemDB) Size(root common.Root) (size uint64, exists bool) {
@@ -93,8 +92,7 @@ func (db *MemDB) Size(root common.Root) (size uint64, exists bool) {
 	if !ok {
 		return 0, false
 	}
-	buf := dat.(*bytes.Buffer)
-	s := uint64(len(buf.Bytes()))
+	s := uint64(len(dat.([]byte)))
 	if s < 4 {
 		// block is corrupt, expected fork digest
 		return 0, false
@@ -115,7 +113,7 @@ func (db *MemDB) Stream(root common.Root) (digest common.ForkDigest, r io.ReadCl
 	if !ok {
 		return common.ForkDigest{}, nil, 0, false, nil
 	}
-	buf := dat.(*bytes.Buffer)
+	buf := bytes.NewReader(dat.([]byte))
 	if _, err := buf.Read(digest[:]); err != nil {
 		return common.ForkDigest{}, nil, 0, false, err
 	}
@@ -125,9 +123,8 @@ func (db *MemDB) Stream(root common.Root) (digest common.ForkDigest, r io.ReadCl
 func (db *MemDB) Remove(root common.Root) (exists bool, err error) {
 	db.removalLock.Lock()
 	defer db.removalLock.Unlock()
-	v, ok := db.data.Load(root)
+	_, ok := db.data.Load(root)
 	if ok {
-		dbBlockPool.Put(v) // release it back to pool, it's not used in the DB anymore.
 		atomic.AddInt64(&db.stats.Count, -1)
 	}
 	db.data.Delete(root)
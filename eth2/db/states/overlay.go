@@ -0,0 +1,52 @@
+package states
+
+import (
+	"context"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/ztyp/tree"
+	"sync"
+)
+
+// OverlayDB keeps new states in memory, on top of a base DB that is only read from.
+// States that are removed from the overlay are hidden, but not removed from the base.
+type OverlayDB struct {
+	*MemDB
+	Base DB
+	// beacon.Root -> struct{}, states of the base that are hidden
+	removed sync.Map
+}
+
+var _ DB = (*OverlayDB)(nil)
+
+func NewOverlayDB(spec *common.Spec, base DB) *OverlayDB {
+	return &OverlayDB{MemDB: NewMemDB(spec), Base: base}
+}
+
+func (db *OverlayDB) Store(ctx context.Context, state common.BeaconState) error {
+	if err := db.MemDB.Store(ctx, state); err != nil {
+		return err
+	}
+	db.removed.Delete(state.HashTreeRoot(tree.GetHashFn()))
+	return nil
+}
+
+func (db *OverlayDB) Get(ctx context.Context, root common.Root) (state common.BeaconState, err error) {
+	state, err = db.MemDB.Get(ctx, root)
+	if err != nil || state != nil {
+		return state, err
+	}
+	if _, ok := db.removed.Load(root); ok {
+		return nil, nil
+	}
+	return db.Base.Get(ctx, root)
+}
+
+func (db *OverlayDB) Remove(root common.Root) error {
+	db.removed.Store(root, struct{}{})
+	return db.MemDB.Remove(root)
+}
+
+// Close releases the overlay, the base DB is not closed.
+func (db *OverlayDB) Close() error {
+	return db.MemDB.Close()
+}
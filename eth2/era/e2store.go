@@ -0,0 +1,111 @@
+package era
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+)
+
+// EntryType identifies the contents of an e2store entry.
+type EntryType [2]byte
+
+func (t EntryType) String() string {
+	return fmt.Sprintf("0x%02x%02x", t[0], t[1])
+}
+
+var (
+	// TypeVersion starts every era file, with empty data.
+	TypeVersion = EntryType{0x65, 0x32}
+	// TypeCompressedSignedBeaconBlock is a snappy-framed SSZ SignedBeaconBlock, of the fork of its slot.
+	TypeCompressedSignedBeaconBlock = EntryType{0x01, 0x00}
+	// TypeCompressedBeaconState is a snappy-framed SSZ BeaconState, of the fork of its slot.
+	TypeCompressedBeaconState = EntryType{0x02, 0x00}
+	// TypeSlotIndex is the index of the entries of a range of slots, see SlotIndex.
+	TypeSlotIndex = EntryType{0x69, 0x32}
+)
+
+// headerSize is the size of the entry header: 2 bytes type, 4 bytes little-endian length, 2 reserved zero bytes.
+const headerSize = 8
+
+// MaxEntrySize limits the size of the data of entries that are read, to not allocate arbitrary amounts of memory.
+const MaxEntrySize = 1 << 30
+
+// E2Writer writes e2store entries, and tracks the offset of every entry.
+type E2Writer struct {
+	w      io.Writer
+	offset int64
+}
+
+// NewE2Writer writes entries to w, which is expected to be at offset 0 of the file.
+func NewE2Writer(w io.Writer) *E2Writer {
+	return &E2Writer{w: w}
+}
+
+// Offset returns the offset of the next entry.
+func (w *E2Writer) Offset() int64 {
+	return w.offset
+}
+
+// WriteEntry writes an entry, and returns the offset it was written at.
+func (w *E2Writer) WriteEntry(typ EntryType, data []byte) (offset int64, err error) {
+	if uint64(len(data)) > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("entry data of %d bytes is too large", len(data))
+	}
+	var header [headerSize]byte
+	copy(header[0:2], typ[:])
+	binary.LittleEndian.PutUint32(header[2:6], uint32(len(data)))
+	offset = w.offset
+	if _, err := w.w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return 0, err
+	}
+	w.offset += headerSize + int64(len(data))
+	return offset, nil
+}
+
+// ReadEntry reads the entry at the given offset, and returns the offset of the next entry.
+func ReadEntry(r io.ReaderAt, offset int64) (typ EntryType, data []byte, next int64, err error) {
+	var header [headerSize]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return typ, nil, 0, err
+	}
+	copy(typ[:], header[0:2])
+	length := binary.LittleEndian.Uint32(header[2:6])
+	if header[6] != 0 || header[7] != 0 {
+		return typ, nil, 0, fmt.Errorf("entry at offset %d has non-zero reserved header bytes", offset)
+	}
+	if length > MaxEntrySize {
+		return typ, nil, 0, fmt.Errorf("entry at offset %d is too large: %d bytes", offset, length)
+	}
+	data = make([]byte, length)
+	if _, err := r.ReadAt(data, offset+headerSize); err != nil {
+		return typ, nil, 0, fmt.Errorf("failed to read data of entry at offset %d: %v", offset, err)
+	}
+	return typ, data, offset + headerSize + int64(length), nil
+}
+
+// compress compresses the data in the snappy framing format.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses data in the snappy framing format.
+func decompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(snappy.NewReader(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,272 @@
+package era
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/ztyp/codec"
+	"github.com/protolambda/ztyp/tree"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type Root = common.Root
+type Slot = common.Slot
+
+// SlotIndex locates the entries of a range of slots in an era file.
+// The offsets are relative to the start of the slot index entry, and zero for slots without entry.
+type SlotIndex struct {
+	StartSlot Slot
+	Offsets   []int64
+}
+
+// Encode encodes the index as data of a TypeSlotIndex entry:
+// the starting slot, an offset per slot, and the number of offsets, all as little-endian int64.
+func (idx *SlotIndex) Encode() []byte {
+	out := make([]byte, 8*(len(idx.Offsets)+2))
+	binary.LittleEndian.PutUint64(out[0:8], uint64(idx.StartSlot))
+	for i, offset := range idx.Offsets {
+		binary.LittleEndian.PutUint64(out[8*(i+1):8*(i+2)], uint64(offset))
+	}
+	binary.LittleEndian.PutUint64(out[len(out)-8:], uint64(len(idx.Offsets)))
+	return out
+}
+
+// Decode decodes the data of a TypeSlotIndex entry.
+func (idx *SlotIndex) Decode(data []byte) error {
+	if len(data) < 16 || len(data)%8 != 0 {
+		return fmt.Errorf("invalid slot index length: %d", len(data))
+	}
+	count := binary.LittleEndian.Uint64(data[len(data)-8:])
+	if count != uint64(len(data)/8-2) {
+		return fmt.Errorf("slot index has %d offsets, but count is %d", len(data)/8-2, count)
+	}
+	idx.StartSlot = Slot(binary.LittleEndian.Uint64(data[0:8]))
+	idx.Offsets = make([]int64, count)
+	for i := range idx.Offsets {
+		idx.Offsets[i] = int64(binary.LittleEndian.Uint64(data[8*(i+1) : 8*(i+2)]))
+	}
+	return nil
+}
+
+// HistoricalRoot computes the historical root of the era that ends at the given era state,
+// as appended to the historical roots of the state by the epoch transition into the era boundary.
+func HistoricalRoot(state common.BeaconState) (Root, error) {
+	blockRoots, err := state.BlockRoots()
+	if err != nil {
+		return Root{}, err
+	}
+	stateRoots, err := state.StateRoots()
+	if err != nil {
+		return Root{}, err
+	}
+	hFn := tree.GetHashFn()
+	return tree.Hash(blockRoots.HashTreeRoot(hFn), stateRoots.HashTreeRoot(hFn)), nil
+}
+
+// Filename is the name of the file of an era:
+// the network name, the era number, and the first 4 bytes of the historical root of the era.
+// For era 0 the genesis validators root is used instead of the historical root.
+func Filename(network string, era uint64, root Root) string {
+	return fmt.Sprintf("%s-%05d-%x.era", network, era, root[:4])
+}
+
+// Exporter writes the finalized history of a chain as era files.
+//
+// An era file contains the blocks of the SLOTS_PER_HISTORICAL_ROOT slots before the era boundary,
+// and the state at the era boundary slot, before any block of that slot.
+// Era 0 only contains the genesis state.
+type Exporter struct {
+	Spec *common.Spec
+	// Decoder provides the fork digests, to check that blocks have the type of the fork of their slot.
+	Decoder *beacon.ForkDecoder
+	// Chain provides the finalized entries and their states, e.g. a chain.FinalizedChain.
+	Chain chain.ColdChain
+	// Blocks provides the finalized blocks.
+	Blocks blocks.DB
+}
+
+func NewExporter(spec *common.Spec, dec *beacon.ForkDecoder, ch chain.ColdChain, blocksDB blocks.DB) *Exporter {
+	return &Exporter{Spec: spec, Decoder: dec, Chain: ch, Blocks: blocksDB}
+}
+
+// stateStep is the step of the state of an era: the genesis state includes the genesis block.
+func (x *Exporter) stateStep(era uint64) chain.Step {
+	slot := Slot(era) * x.Spec.SLOTS_PER_HISTORICAL_ROOT
+	return chain.AsStep(slot, slot == 0)
+}
+
+// Available returns true if the chain covers all slots of the era, up to and including the era state.
+// Availability of the states and blocks themselves is checked when the era is written.
+func (x *Exporter) Available(era uint64) bool {
+	start := x.stateStep(era)
+	if era > 0 {
+		// Only the block steps of the slots are read.
+		start = chain.AsStep(Slot(era-1)*x.Spec.SLOTS_PER_HISTORICAL_ROOT, true)
+	}
+	return x.Chain.ColdStart() <= start && x.stateStep(era) < x.Chain.ColdEnd()
+}
+
+// WriteEra writes the era to w, and returns the root to name the era file with, see Filename.
+func (x *Exporter) WriteEra(ctx context.Context, era uint64, w io.Writer) (Root, error) {
+	if !x.Available(era) {
+		return Root{}, fmt.Errorf("era %d is not available in the chain", era)
+	}
+	e2 := NewE2Writer(w)
+	if _, err := e2.WriteEntry(TypeVersion, nil); err != nil {
+		return Root{}, err
+	}
+	sphr := x.Spec.SLOTS_PER_HISTORICAL_ROOT
+	var blockIndex *SlotIndex
+	if era > 0 {
+		blockIndex = &SlotIndex{StartSlot: Slot(era-1) * sphr, Offsets: make([]int64, sphr)}
+		for i := range blockIndex.Offsets {
+			if err := ctx.Err(); err != nil {
+				return Root{}, err
+			}
+			slot := blockIndex.StartSlot + Slot(i)
+			offset, err := x.writeBlock(e2, slot)
+			if err != nil {
+				return Root{}, err
+			}
+			blockIndex.Offsets[i] = offset
+		}
+	}
+
+	entry, ok := x.Chain.ByCanonStep(x.stateStep(era))
+	if !ok {
+		return Root{}, fmt.Errorf("missing entry of state of era %d", era)
+	}
+	state, err := entry.State(ctx)
+	if err != nil {
+		return Root{}, fmt.Errorf("failed to get state of era %d: %v", era, err)
+	}
+	var root Root
+	if era == 0 {
+		root, err = state.GenesisValidatorsRoot()
+	} else {
+		root, err = HistoricalRoot(state)
+	}
+	if err != nil {
+		return Root{}, err
+	}
+	var buf bytes.Buffer
+	if err := state.Serialize(codec.NewEncodingWriter(&buf)); err != nil {
+		return Root{}, fmt.Errorf("failed to encode state of era %d: %v", era, err)
+	}
+	data, err := compress(buf.Bytes())
+	if err != nil {
+		return Root{}, err
+	}
+	stateOffset, err := e2.WriteEntry(TypeCompressedBeaconState, data)
+	if err != nil {
+		return Root{}, err
+	}
+
+	if blockIndex != nil {
+		if err := writeIndex(e2, blockIndex); err != nil {
+			return Root{}, err
+		}
+	}
+	stateIndex := &SlotIndex{StartSlot: Slot(era) * sphr, Offsets: []int64{stateOffset}}
+	if err := writeIndex(e2, stateIndex); err != nil {
+		return Root{}, err
+	}
+	return root, nil
+}
+
+// writeBlock writes the block of the slot, if any, and returns its offset, or 0 if the slot has no block.
+func (x *Exporter) writeBlock(e2 *E2Writer, slot Slot) (int64, error) {
+	// The genesis block is not signed, and not part of any era.
+	if slot == 0 {
+		return 0, nil
+	}
+	entry, ok := x.Chain.ByCanonStep(chain.AsStep(slot, true))
+	if !ok {
+		return 0, fmt.Errorf("missing entry of slot %d", slot)
+	}
+	if entry.ParentRoot() == entry.BlockRoot() {
+		return 0, nil
+	}
+	root := entry.BlockRoot()
+	digest, r, _, exists, err := x.Blocks.Stream(root)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read block %s of slot %d: %v", root, slot, err)
+	}
+	if !exists {
+		return 0, fmt.Errorf("missing block %s of slot %d", root, slot)
+	}
+	defer r.Close()
+	if expected := x.Decoder.ForkDigest(slot); digest != expected {
+		return 0, fmt.Errorf("block %s of slot %d has fork digest %s, expected %s", root, slot, digest, expected)
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read block %s of slot %d: %v", root, slot, err)
+	}
+	data, err := compress(raw)
+	if err != nil {
+		return 0, err
+	}
+	return e2.WriteEntry(TypeCompressedSignedBeaconBlock, data)
+}
+
+// writeIndex writes the index, with the absolute offsets made relative to the index entry.
+func writeIndex(e2 *E2Writer, idx *SlotIndex) error {
+	start := e2.Offset()
+	rel := &SlotIndex{StartSlot: idx.StartSlot, Offsets: make([]int64, len(idx.Offsets))}
+	for i, offset := range idx.Offsets {
+		if offset != 0 {
+			rel.Offsets[i] = offset - start
+		}
+	}
+	_, err := e2.WriteEntry(TypeSlotIndex, rel.Encode())
+	return err
+}
+
+// ExportEra writes the era to a file in the given directory, named with Filename, and returns the path.
+// The file is only created once the era is written completely.
+func (x *Exporter) ExportEra(ctx context.Context, dir string, network string, era uint64) (string, error) {
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf("%s-%05d-*.era.tmp", network, era))
+	if err != nil {
+		return "", err
+	}
+	root, err := x.WriteEra(ctx, era, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	p := filepath.Join(dir, Filename(network, era, root))
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return p, nil
+}
+
+// Export writes all eras from the given era onwards that are available in the chain,
+// and returns the paths of the written files.
+func (x *Exporter) Export(ctx context.Context, dir string, network string, from uint64) ([]string, error) {
+	if !x.Available(from) {
+		return nil, fmt.Errorf("era %d is not available in the chain", from)
+	}
+	var paths []string
+	for era := from; x.Available(era); era++ {
+		p, err := x.ExportEra(ctx, dir, network, era)
+		if err != nil {
+			return paths, fmt.Errorf("failed to export era %d: %v", era, err)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
@@ -0,0 +1,241 @@
+package era
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/ztyp/codec"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	spec := testSpec()
+	sphr := spec.SLOTS_PER_HISTORICAL_ROOT
+	fin, blocksDB, benvs := testChain(t, spec, []common.Slot{1, 2, 5, sphr + 1, sphr + 6}, 2*sphr+3)
+	genesis, _ := fin.ByCanonStep(fin.ColdStart())
+	genesisState, err := genesis.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := genesisState.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewExporter(spec, beacon.NewForkDecoder(spec, genesisValRoot), fin, blocksDB)
+	if !x.Available(2) || x.Available(3) {
+		t.Fatal("expected eras 0 to 2 to be available")
+	}
+	dir := t.TempDir()
+	paths, err := x.Export(ctx, dir, "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("expected 3 eras, got %v", paths)
+	}
+	if name := filepath.Base(paths[0]); name != Filename("test", 0, genesisValRoot) {
+		t.Fatalf("unexpected name of era 0: %s", name)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+		t.Fatalf("unexpected temporary files: %v", matches)
+	}
+
+	// check the contents of era 2
+	f, err := os.Open(paths[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ, data, _, err := ReadEntry(f, 0); err != nil || typ != TypeVersion || len(data) != 0 {
+		t.Fatalf("expected version entry first, got %s (err: %v)", typ, err)
+	}
+	stateIndexOffset := info.Size() - headerSize - 3*8
+	blockIndexOffset := stateIndexOffset - headerSize - int64(sphr+2)*8
+	readIndex := func(offset int64) *SlotIndex {
+		typ, data, _, err := ReadEntry(f, offset)
+		if err != nil || typ != TypeSlotIndex {
+			t.Fatalf("expected slot index at %d, got %s (err: %v)", offset, typ, err)
+		}
+		var idx SlotIndex
+		if err := idx.Decode(data); err != nil {
+			t.Fatal(err)
+		}
+		return &idx
+	}
+	blockIndex := readIndex(blockIndexOffset)
+	if blockIndex.StartSlot != sphr || len(blockIndex.Offsets) != int(sphr) {
+		t.Fatalf("unexpected block index: start %d, %d offsets", blockIndex.StartSlot, len(blockIndex.Offsets))
+	}
+	expected := map[common.Slot]*common.BeaconBlockEnvelope{benvs[3].Slot: benvs[3], benvs[4].Slot: benvs[4]}
+	for i, offset := range blockIndex.Offsets {
+		slot := blockIndex.StartSlot + common.Slot(i)
+		benv, ok := expected[slot]
+		if !ok {
+			if offset != 0 {
+				t.Fatalf("unexpected block at slot %d", slot)
+			}
+			continue
+		}
+		typ, data, _, err := ReadEntry(f, blockIndexOffset+offset)
+		if err != nil || typ != TypeCompressedSignedBeaconBlock {
+			t.Fatalf("expected block of slot %d, got %s (err: %v)", slot, typ, err)
+		}
+		raw, err := decompress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := benv.SignedBlock.Serialize(spec, codec.NewEncodingWriter(&buf)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, buf.Bytes()) {
+			t.Fatalf("block of slot %d does not match", slot)
+		}
+	}
+	stateIndex := readIndex(stateIndexOffset)
+	if stateIndex.StartSlot != 2*sphr || len(stateIndex.Offsets) != 1 {
+		t.Fatalf("unexpected state index: start %d, %d offsets", stateIndex.StartSlot, len(stateIndex.Offsets))
+	}
+	typ, data, _, err := ReadEntry(f, stateIndexOffset+stateIndex.Offsets[0])
+	if err != nil || typ != TypeCompressedBeaconState {
+		t.Fatalf("expected state, got %s (err: %v)", typ, err)
+	}
+	raw, err := decompress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := fin.ByCanonStep(chain.AsStep(2*sphr, false))
+	state, err := entry.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := state.Serialize(codec.NewEncodingWriter(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, buf.Bytes()) {
+		t.Fatal("era state does not match")
+	}
+	root, err := HistoricalRoot(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := filepath.Base(paths[2]); name != Filename("test", 2, root) {
+		t.Fatalf("unexpected name of era 2: %s", name)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	spec := testSpec()
+	sphr := spec.SLOTS_PER_HISTORICAL_ROOT
+	src, srcBlocks, benvs := testChain(t, spec, []common.Slot{1, 2, 5, sphr + 1, sphr + 6}, 2*sphr+3)
+	genesis, _ := src.ByCanonStep(src.ColdStart())
+	genesisState, err := genesis.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := genesisState.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := beacon.NewForkDecoder(spec, genesisValRoot)
+	paths, err := NewExporter(spec, dec, src, srcBlocks).Export(ctx, t.TempDir(), "test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := chain.AsStep(2*sphr, false) + 1
+
+	checkChain := func(t *testing.T, fin *chain.FinalizedChain, blocksDB blocks.DB, start chain.Step) {
+		if fin.ColdStart() != start || fin.ColdEnd() != end {
+			t.Fatalf("expected steps %s to %s, got %s to %s", start, end, fin.ColdStart(), fin.ColdEnd())
+		}
+		for step := start; step < end; step++ {
+			expected, _ := src.ByCanonStep(step)
+			entry, ok := fin.ByCanonStep(step)
+			if !ok {
+				t.Fatalf("missing entry at step %s", step)
+			}
+			if entry.BlockRoot() != expected.BlockRoot() {
+				t.Fatalf("unexpected block root at step %s: %s <> %s", step, entry.BlockRoot(), expected.BlockRoot())
+			}
+		}
+		for _, benv := range benvs {
+			if stored, err := blocksDB.Get(ctx, benv.BlockRoot); err != nil || stored == nil {
+				t.Fatalf("missing block %s (err: %v)", benv.BlockRoot, err)
+			}
+		}
+	}
+
+	t.Run("forward", func(t *testing.T) {
+		fin := chain.NewFinalizedChain(spec, states.NewMemDB(spec))
+		blocksDB := blocks.NewMemDB(spec, dec)
+		im := NewImporter(spec, dec, fin, blocksDB)
+		if err := im.ImportFiles(ctx, paths[0], paths[2]); err == nil {
+			t.Fatal("expected era 2 to not connect to era 0")
+		}
+		if err := im.ImportFiles(ctx, paths[1:]...); err != nil {
+			t.Fatal(err)
+		}
+		checkChain(t, fin, blocksDB, src.ColdStart())
+		for step := fin.ColdStart(); step < end; step++ {
+			expected, _ := src.ByCanonStep(step)
+			entry, _ := fin.ByCanonStep(step)
+			if entry.StateRoot() != expected.StateRoot() {
+				t.Fatalf("unexpected state root at step %s", step)
+			}
+		}
+		// importing an era again only checks it
+		if err := im.ImportFiles(ctx, paths[1]); err != nil {
+			t.Fatal(err)
+		}
+		if fin.ColdEnd() != end {
+			t.Fatalf("unexpected end after re-import: %s", fin.ColdEnd())
+		}
+	})
+
+	t.Run("backward", func(t *testing.T) {
+		fin := chain.NewFinalizedChain(spec, states.NewMemDB(spec))
+		blocksDB := blocks.NewMemDB(spec, dec)
+		im := NewImporter(spec, dec, fin, blocksDB)
+		if err := im.ImportFiles(ctx, paths[2], paths[1], paths[0]); err != nil {
+			t.Fatal(err)
+		}
+		// The genesis block is not part of any era, the chain starts with the parent of the first block.
+		checkChain(t, fin, blocksDB, chain.AsStep(1, false))
+		if err := im.ImportFiles(ctx, paths[2]); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("capella", func(t *testing.T) {
+		// Era 2 has slots in the capella fork, which cannot be decoded, and is rejected before reading it.
+		capellaSpec := *spec
+		capellaSpec.CAPELLA_FORK_EPOCH = capellaSpec.SlotToEpoch(2 * sphr)
+		fin := chain.NewFinalizedChain(&capellaSpec, states.NewMemDB(&capellaSpec))
+		im := NewImporter(&capellaSpec, beacon.NewForkDecoder(&capellaSpec, genesisValRoot), fin, nil)
+		if err := im.ImportFiles(ctx, paths[1]); err != nil {
+			t.Fatal(err)
+		}
+		err := im.ImportFiles(ctx, paths[2])
+		if err == nil || !strings.Contains(err.Error(), paths[2]) || !strings.Contains(err.Error(), "capella") {
+			t.Fatalf("expected capella error naming the file, got %v", err)
+		}
+		if fin.ColdEnd() != chain.AsStep(sphr, false)+1 {
+			t.Fatalf("unexpected end after rejected era: %s", fin.ColdEnd())
+		}
+	})
+}
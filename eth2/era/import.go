@@ -0,0 +1,410 @@
+package era
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/ztyp/codec"
+	"github.com/protolambda/ztyp/tree"
+	"os"
+)
+
+// Importer reads era files into a finalized chain and a blocks DB, e.g. to seed a node offline.
+//
+// The first era that is imported into an empty chain becomes the anchor of the chain.
+// Later eras are replayed on top of the chain, and earlier eras are backfilled, without states.
+// The blocks and state of an era are checked against the block roots, state roots and historical roots
+// of the era state, and the blocks must link to the chain.
+//
+// Capella blocks and states cannot be decoded yet: eras with slots in the Capella fork are rejected before reading them.
+type Importer struct {
+	Spec *common.Spec
+	// Decoder decodes the blocks and states, by the fork of their slot.
+	Decoder *beacon.ForkDecoder
+	// Chain to import the eras into.
+	Chain *chain.FinalizedChain
+	// Blocks stores the imported blocks, if not nil. This may be the BlocksDB of the chain.
+	Blocks blocks.DB
+}
+
+func NewImporter(spec *common.Spec, dec *beacon.ForkDecoder, ch *chain.FinalizedChain, blocksDB blocks.DB) *Importer {
+	return &Importer{Spec: spec, Decoder: dec, Chain: ch, Blocks: blocksDB}
+}
+
+// eraStateStep is the step of the state of an era: the genesis state includes the genesis block.
+func eraStateStep(spec *common.Spec, era uint64) chain.Step {
+	slot := Slot(era) * spec.SLOTS_PER_HISTORICAL_ROOT
+	return chain.AsStep(slot, slot == 0)
+}
+
+// ImportFiles imports the era files at the given paths, in the given order.
+func (im *Importer) ImportFiles(ctx context.Context, paths ...string) error {
+	for _, p := range paths {
+		if err := im.importFile(ctx, p); err != nil {
+			return fmt.Errorf("failed to import %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (im *Importer) importFile(ctx context.Context, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r, err := NewReader(f, info.Size())
+	if err != nil {
+		return err
+	}
+	return im.ImportEra(ctx, r)
+}
+
+// ImportEra checks the era, and adds it to the chain.
+// The era must connect to the chain: it extends the end of the chain, or precedes the start of the chain.
+// Importing an era that the chain already covers only checks the era against the chain, and stores the blocks.
+func (im *Importer) ImportEra(ctx context.Context, r *Reader) error {
+	sphr := im.Spec.SLOTS_PER_HISTORICAL_ROOT
+	stateSlot := r.StateSlot()
+	if stateSlot%sphr != 0 {
+		return fmt.Errorf("era state slot %d is not an era boundary", stateSlot)
+	}
+	era := uint64(stateSlot / sphr)
+	if err := im.checkFork(r); err != nil {
+		return fmt.Errorf("unsupported era %d: %v", era, err)
+	}
+	state, err := im.readState(r)
+	if err != nil {
+		return fmt.Errorf("invalid state of era %d: %v", era, err)
+	}
+	if err := im.checkHistoricalRoots(ctx, era, state); err != nil {
+		return fmt.Errorf("invalid historical roots in state of era %d: %v", era, err)
+	}
+	benvs, err := im.readBlocks(r, state)
+	if err != nil {
+		return fmt.Errorf("invalid blocks of era %d: %v", era, err)
+	}
+	header, err := state.LatestBlockHeader()
+	if err != nil {
+		return err
+	}
+	stateRoot := state.HashTreeRoot(tree.GetHashFn())
+	// The state root of the header is only filled in by the next slot processing, i.e. for the genesis state.
+	if header.StateRoot == (Root{}) {
+		header.StateRoot = stateRoot
+	}
+	latestRoot := header.HashTreeRoot(tree.GetHashFn())
+
+	stateStep := eraStateStep(im.Spec, era)
+	startStep := stateStep
+	if era > 0 {
+		startStep = eraStateStep(im.Spec, era-1)
+	}
+	// The chain covers the era if it has the era state, and the pre-block steps of all blocks of the era.
+	covered := stateStep
+	if len(benvs) > 0 {
+		covered = chain.AsStep(benvs[0].Slot, false)
+	}
+	ch := im.Chain
+	coldStart, coldEnd := ch.ColdStart(), ch.ColdEnd()
+	switch {
+	case coldStart == coldEnd:
+		var parentRoot Root
+		if era > 0 {
+			parentRoot = latestRoot
+		}
+		epc, err := common.NewEpochsContext(im.Spec, state)
+		if err != nil {
+			return fmt.Errorf("failed to create context of era %d state: %v", era, err)
+		}
+		anchor := &stateEntry{step: stateStep, blockRoot: latestRoot, parentRoot: parentRoot,
+			stateRoot: stateRoot, state: state, epc: epc}
+		if err := ch.OnFinalizedEntry(ctx, anchor); err != nil {
+			return fmt.Errorf("failed to anchor chain at era %d: %v", era, err)
+		}
+		if err := ch.Backfill(ctx, reverse(benvs)); err != nil {
+			return fmt.Errorf("failed to backfill blocks of era %d: %v", era, err)
+		}
+	case coldStart <= covered && stateStep < coldEnd:
+		if err := im.checkCovered(benvs, stateStep, latestRoot, stateRoot); err != nil {
+			return fmt.Errorf("era %d does not match chain: %v", era, err)
+		}
+	case stateStep <= coldStart:
+		target, _, err := ch.BackfillTarget(ctx)
+		if err != nil {
+			return err
+		}
+		if target != latestRoot {
+			return fmt.Errorf("era %d ends with block %s, but chain needs block %s", era, latestRoot, target)
+		}
+		if err := ch.Backfill(ctx, reverse(benvs)); err != nil {
+			return fmt.Errorf("failed to backfill blocks of era %d: %v", era, err)
+		}
+	case startStep <= coldEnd-1 && coldEnd-1 < stateStep:
+		// Blocks that the chain already has must match, the others are replayed.
+		i := 0
+		for i < len(benvs) && chain.AsStep(benvs[i].Slot, true) < coldEnd {
+			i++
+		}
+		if err := im.checkCovered(benvs[:i], coldEnd-1, Root{}, Root{}); err != nil {
+			return fmt.Errorf("era %d does not match chain: %v", era, err)
+		}
+		if err := ch.Extend(ctx, benvs[i:], stateSlot); err != nil {
+			return fmt.Errorf("failed to replay era %d: %v", era, err)
+		}
+		entry, ok := ch.ByCanonStep(stateStep)
+		if !ok {
+			return fmt.Errorf("missing replayed state of era %d", era)
+		}
+		if entry.StateRoot() != stateRoot {
+			return fmt.Errorf("replayed state of era %d has root %s, but era state has root %s",
+				era, entry.StateRoot(), stateRoot)
+		}
+	default:
+		return fmt.Errorf("era %d (steps %s to %s) does not connect to chain (steps %s to %s)",
+			era, startStep, stateStep, coldStart, coldEnd)
+	}
+
+	if im.Blocks != nil {
+		for _, benv := range benvs {
+			if _, err := im.Blocks.Store(ctx, benv); err != nil {
+				return fmt.Errorf("failed to store block %s: %v", benv.BlockRoot, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkFork rejects eras with blocks or a state in the Capella fork, which the decoder does not support.
+func (im *Importer) checkFork(r *Reader) error {
+	start, _ := r.BlockSlots()
+	startEpoch, endEpoch := im.Spec.SlotToEpoch(start), im.Spec.SlotToEpoch(r.StateSlot())
+	capella, sharding := im.Spec.CAPELLA_FORK_EPOCH, im.Spec.SHARDING_FORK_EPOCH
+	if capella < sharding && startEpoch < sharding && endEpoch >= capella {
+		return fmt.Errorf("epochs %d to %d overlap with the capella fork (epochs %d to %d), which is not supported",
+			startEpoch, endEpoch, capella, sharding)
+	}
+	return nil
+}
+
+// readState decodes the era state, with the type of the fork of the state slot.
+func (im *Importer) readState(r *Reader) (common.BeaconState, error) {
+	raw, err := r.State()
+	if err != nil {
+		return nil, err
+	}
+	digest := im.Decoder.ForkDigest(r.StateSlot())
+	state, err := im.Decoder.DecodeState(digest, uint64(len(raw)), bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	slot, err := state.Slot()
+	if err != nil {
+		return nil, err
+	}
+	if slot != r.StateSlot() {
+		return nil, fmt.Errorf("state has slot %d, but is indexed at slot %d", slot, r.StateSlot())
+	}
+	fork, err := state.Fork()
+	if err != nil {
+		return nil, err
+	}
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		return nil, err
+	}
+	if actual := common.ComputeForkDigest(fork.CurrentVersion, genesisValRoot); actual != digest {
+		return nil, fmt.Errorf("state has fork digest %s, expected %s", actual, digest)
+	}
+	return state, nil
+}
+
+// checkHistoricalRoots checks that the last historical root of the era state commits to the era,
+// and that the historical roots agree with the state of the previous era, if the chain has it.
+func (im *Importer) checkHistoricalRoots(ctx context.Context, era uint64, state common.BeaconState) error {
+	histRoots, err := state.HistoricalRoots()
+	if err != nil {
+		return err
+	}
+	count, err := histRoots.Length()
+	if err != nil {
+		return err
+	}
+	if count != era {
+		return fmt.Errorf("expected %d historical roots, got %d", era, count)
+	}
+	if era == 0 {
+		return nil
+	}
+	expected, err := HistoricalRoot(state)
+	if err != nil {
+		return err
+	}
+	if last, err := histRoots.GetRoot(era - 1); err != nil {
+		return err
+	} else if last != expected {
+		return fmt.Errorf("last historical root %s does not match era root %s", last, expected)
+	}
+	entry, ok := im.Chain.ByCanonStep(eraStateStep(im.Spec, era-1))
+	if !ok || entry.StateRoot() == (Root{}) {
+		return nil
+	}
+	prev, err := entry.State(ctx)
+	if err != nil {
+		// Backfilled entries have no state to compare with
+		return nil
+	}
+	prevRoots, err := prev.HistoricalRoots()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i+1 < era; i++ {
+		a, err := prevRoots.GetRoot(i)
+		if err != nil {
+			return err
+		}
+		b, err := histRoots.GetRoot(i)
+		if err != nil {
+			return err
+		}
+		if a != b {
+			return fmt.Errorf("historical root %d is %s, but the state of the previous era has %s", i, b, a)
+		}
+	}
+	return nil
+}
+
+// readBlocks decodes the blocks of the era, ordered by slot, and checks them against the roots of the era state.
+func (im *Importer) readBlocks(r *Reader, state common.BeaconState) ([]*common.BeaconBlockEnvelope, error) {
+	blockRoots, err := state.BlockRoots()
+	if err != nil {
+		return nil, err
+	}
+	stateRoots, err := state.StateRoots()
+	if err != nil {
+		return nil, err
+	}
+	var out []*common.BeaconBlockEnvelope
+	start, end := r.BlockSlots()
+	var prevRoot Root
+	for slot := start; slot < end; slot++ {
+		root, err := blockRoots.GetRoot(slot)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := r.Block(slot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block of slot %d: %v", slot, err)
+		}
+		if raw == nil {
+			if slot > start && root != prevRoot {
+				return nil, fmt.Errorf("slot %d has no block, but state has block root %s", slot, root)
+			}
+			prevRoot = root
+			continue
+		}
+		digest := im.Decoder.ForkDigest(slot)
+		block, err := im.Decoder.AllocBlock(digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := block.Deserialize(im.Spec, codec.NewDecodingReader(bytes.NewReader(raw), uint64(len(raw)))); err != nil {
+			return nil, fmt.Errorf("failed to decode block of slot %d: %v", slot, err)
+		}
+		benv := block.Envelope(im.Spec, digest)
+		if benv.Slot != slot {
+			return nil, fmt.Errorf("block %s has slot %d, but is indexed at slot %d", benv.BlockRoot, benv.Slot, slot)
+		}
+		if benv.BlockRoot != root {
+			return nil, fmt.Errorf("block of slot %d has root %s, but state has block root %s", slot, benv.BlockRoot, root)
+		}
+		if slot > start && benv.ParentRoot != prevRoot {
+			return nil, fmt.Errorf("block %s of slot %d has parent %s, expected %s", benv.BlockRoot, slot, benv.ParentRoot, prevRoot)
+		}
+		if stateRoot, err := stateRoots.GetRoot(slot); err != nil {
+			return nil, err
+		} else if benv.StateRoot != stateRoot {
+			return nil, fmt.Errorf("block %s of slot %d has state root %s, but state has state root %s",
+				benv.BlockRoot, slot, benv.StateRoot, stateRoot)
+		}
+		out = append(out, benv)
+		prevRoot = root
+	}
+	return out, nil
+}
+
+// checkCovered checks the blocks against the entries of the chain,
+// and the chain entry at the given step against the given roots, if not zero.
+func (im *Importer) checkCovered(benvs []*common.BeaconBlockEnvelope, step chain.Step, blockRoot Root, stateRoot Root) error {
+	for _, benv := range benvs {
+		entry, ok := im.Chain.ByCanonStep(chain.AsStep(benv.Slot, true))
+		if !ok {
+			return fmt.Errorf("chain has no entry for block %s of slot %d", benv.BlockRoot, benv.Slot)
+		}
+		if entry.BlockRoot() != benv.BlockRoot {
+			return fmt.Errorf("chain has block %s at slot %d, but era has block %s", entry.BlockRoot(), benv.Slot, benv.BlockRoot)
+		}
+	}
+	entry, ok := im.Chain.ByCanonStep(step)
+	if !ok {
+		return fmt.Errorf("chain has no entry at step %s", step)
+	}
+	if blockRoot != (Root{}) && entry.BlockRoot() != blockRoot {
+		return fmt.Errorf("chain has block %s at step %s, but era has block %s", entry.BlockRoot(), step, blockRoot)
+	}
+	// Backfilled entries may not have a state root
+	if stateRoot != (Root{}) && entry.StateRoot() != (Root{}) && entry.StateRoot() != stateRoot {
+		return fmt.Errorf("chain has state %s at step %s, but era has state %s", entry.StateRoot(), step, stateRoot)
+	}
+	return nil
+}
+
+func reverse(benvs []*common.BeaconBlockEnvelope) []*common.BeaconBlockEnvelope {
+	out := make([]*common.BeaconBlockEnvelope, len(benvs))
+	for i, benv := range benvs {
+		out[len(out)-1-i] = benv
+	}
+	return out
+}
+
+// stateEntry is the era state as chain entry, to anchor an empty chain with.
+type stateEntry struct {
+	step       chain.Step
+	blockRoot  Root
+	parentRoot Root
+	stateRoot  Root
+	state      common.BeaconState
+	epc        *common.EpochsContext
+}
+
+func (e *stateEntry) Step() chain.Step {
+	return e.step
+}
+
+func (e *stateEntry) BlockRoot() Root {
+	return e.blockRoot
+}
+
+func (e *stateEntry) ParentRoot() Root {
+	return e.parentRoot
+}
+
+func (e *stateEntry) StateRoot() Root {
+	return e.stateRoot
+}
+
+func (e *stateEntry) EpochsContext(ctx context.Context) (*common.EpochsContext, error) {
+	return e.epc.Clone(), nil
+}
+
+func (e *stateEntry) State(ctx context.Context) (common.BeaconState, error) {
+	return e.state.CopyState()
+}
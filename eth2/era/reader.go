@@ -0,0 +1,123 @@
+package era
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Reader reads the blocks and state of an era file, using the slot indices at the end of the file.
+type Reader struct {
+	r io.ReaderAt
+	// Block index with absolute offsets, nil for era 0
+	blockIndex *SlotIndex
+	// State index with the absolute offset of the era state
+	stateIndex *SlotIndex
+}
+
+// NewReader reads the slot indices of the era file of the given size.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	typ, _, _, err := ReadEntry(r, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version entry: %v", err)
+	}
+	if typ != TypeVersion {
+		return nil, fmt.Errorf("expected version entry at start of era file, got %s", typ)
+	}
+	// The state index has a single offset, and is the last entry.
+	stateIndexOffset := size - headerSize - 3*8
+	stateIndex, err := readIndex(r, stateIndexOffset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state index: %v", err)
+	}
+	if len(stateIndex.Offsets) != 1 {
+		return nil, fmt.Errorf("expected 1 state in era file, got %d", len(stateIndex.Offsets))
+	}
+	out := &Reader{r: r, stateIndex: stateIndex}
+	if stateIndex.StartSlot == 0 {
+		return out, nil
+	}
+	// The block index precedes the state index, its size follows from the count at the end of it.
+	var count [8]byte
+	if _, err := r.ReadAt(count[:], stateIndexOffset-8); err != nil {
+		return nil, fmt.Errorf("failed to read size of block index: %v", err)
+	}
+	n := binary.LittleEndian.Uint64(count[:])
+	if n > uint64(stateIndexOffset)/8 {
+		return nil, fmt.Errorf("invalid block index size: %d", n)
+	}
+	blockIndex, err := readIndex(r, stateIndexOffset-headerSize-int64(n+2)*8)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block index: %v", err)
+	}
+	if blockIndex.StartSlot+Slot(len(blockIndex.Offsets)) != stateIndex.StartSlot {
+		return nil, fmt.Errorf("block index of slots %d to %d does not end at state slot %d",
+			blockIndex.StartSlot, blockIndex.StartSlot+Slot(len(blockIndex.Offsets)), stateIndex.StartSlot)
+	}
+	out.blockIndex = blockIndex
+	return out, nil
+}
+
+// readIndex reads the slot index entry at the given offset, and makes its offsets absolute.
+func readIndex(r io.ReaderAt, offset int64) (*SlotIndex, error) {
+	typ, data, _, err := ReadEntry(r, offset)
+	if err != nil {
+		return nil, err
+	}
+	if typ != TypeSlotIndex {
+		return nil, fmt.Errorf("expected slot index at offset %d, got %s", offset, typ)
+	}
+	var idx SlotIndex
+	if err := idx.Decode(data); err != nil {
+		return nil, err
+	}
+	for i, rel := range idx.Offsets {
+		if rel != 0 {
+			idx.Offsets[i] = offset + rel
+		}
+	}
+	return &idx, nil
+}
+
+// StateSlot returns the slot of the era state, the end of the era.
+func (r *Reader) StateSlot() Slot {
+	return r.stateIndex.StartSlot
+}
+
+// BlockSlots returns the range of slots of the blocks of the era, the end is exclusive.
+// The range is empty for era 0.
+func (r *Reader) BlockSlots() (start Slot, end Slot) {
+	if r.blockIndex == nil {
+		return r.StateSlot(), r.StateSlot()
+	}
+	return r.blockIndex.StartSlot, r.StateSlot()
+}
+
+// Block returns the SSZ encoded signed block of the slot, or nil if the slot has no block.
+func (r *Reader) Block(slot Slot) ([]byte, error) {
+	start, end := r.BlockSlots()
+	if slot < start || slot >= end {
+		return nil, fmt.Errorf("slot %d is not in the era, the era has slots %d to %d", slot, start, end)
+	}
+	offset := r.blockIndex.Offsets[slot-start]
+	if offset == 0 {
+		return nil, nil
+	}
+	return r.read(offset, TypeCompressedSignedBeaconBlock)
+}
+
+// State returns the SSZ encoded era state.
+func (r *Reader) State() ([]byte, error) {
+	return r.read(r.stateIndex.Offsets[0], TypeCompressedBeaconState)
+}
+
+func (r *Reader) read(offset int64, expected EntryType) ([]byte, error) {
+	typ, data, _, err := ReadEntry(r.r, offset)
+	if err != nil {
+		return nil, err
+	}
+	if typ != expected {
+		return nil, fmt.Errorf("expected entry of type %s at offset %d, got %s", expected, offset, typ)
+	}
+	return decompress(data)
+}
@@ -0,0 +1,86 @@
+package era
+
+import (
+	"context"
+	"testing"
+
+	"github.com/protolambda/zrnt/eth2/beacon"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/zrnt/eth2/db/blocks"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+)
+
+// testSpec is the minimal spec, with Altair in the middle of era 2.
+func testSpec() *common.Spec {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 12
+	return &spec
+}
+
+// testBlock builds a signed phase0 block on top of the given parent block.
+func testBlock(t testing.TB, spec *common.Spec, ch chain.HotChain, parent common.Root, slot common.Slot) *common.BeaconBlockEnvelope {
+	pre, err := ch.Towards(context.Background(), parent, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chaintest.Block(t, spec, pre, parent, slot, 0)
+}
+
+// testChain builds a finalized chain from genesis with blocks at the given slots, up to and including the end slot.
+// The blocks are stored in the returned blocks DB.
+func testChain(t testing.TB, spec *common.Spec, blockSlots []common.Slot, end common.Slot) (*chain.FinalizedChain, *blocks.MemDB, []*common.BeaconBlockEnvelope) {
+	ctx := context.Background()
+	genesisState := chaintest.Genesis(t, spec)
+	genesisValRoot, err := genesisState.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocksDB := blocks.NewMemDB(spec, beacon.NewForkDecoder(spec, genesisValRoot))
+	hot, err := chain.NewHotColdChain(genesisState, spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := hot.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fin := chain.NewFinalizedChain(spec, states.NewMemDB(spec))
+	if err := fin.OnFinalizedEntry(ctx, genesis); err != nil {
+		t.Fatal(err)
+	}
+	var benvs []*common.BeaconBlockEnvelope
+	parent := genesis.BlockRoot()
+	for slot := common.Slot(1); slot <= end; slot++ {
+		pre, err := hot.Towards(ctx, parent, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fin.OnFinalizedEntry(ctx, pre); err != nil {
+			t.Fatal(err)
+		}
+		if len(blockSlots) == 0 || blockSlots[0] != slot {
+			continue
+		}
+		blockSlots = blockSlots[1:]
+		benv := testBlock(t, spec, hot.HotChain, parent, slot)
+		if err := hot.AddBlock(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := blocksDB.Store(ctx, benv); err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := hot.ByBlock(benv.BlockRoot)
+		if !ok {
+			t.Fatalf("missing block %s", benv.BlockRoot)
+		}
+		if err := fin.OnFinalizedEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+		benvs = append(benvs, benv)
+		parent = benv.BlockRoot
+	}
+	return fin, blocksDB, benvs
+}
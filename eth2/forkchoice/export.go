@@ -0,0 +1,99 @@
+package forkchoice
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// SlotRange is an inclusive range of slots, to export only part of the graph.
+type SlotRange struct {
+	Start Slot
+	End   Slot
+}
+
+// Contains checks if the slot is within the range. A nil range contains every slot.
+func (r *SlotRange) Contains(slot Slot) bool {
+	return r == nil || (slot >= r.Start && slot <= r.End)
+}
+
+// NodeInfo is a snapshot of a node of the forkchoice graph, to inspect or visualize the graph with.
+type NodeInfo struct {
+	NodeRef
+	ParentRoot Root `json:"parent_root"`
+	// Block is true for the node of a block, false for the node of an empty slot after a block.
+	Block bool `json:"block"`
+	// Nil if the node is the first node of the graph.
+	TransitionParent *NodeRef `json:"transition_parent"`
+	// Nil if the node is the first node of the graph.
+	ForkchoiceParent *NodeRef        `json:"forkchoice_parent"`
+	JustifiedEpoch   Epoch           `json:"justified_epoch"`
+	FinalizedEpoch   Epoch           `json:"finalized_epoch"`
+	Weight           SignedGwei      `json:"weight"`
+	BestChild        *NodeRef        `json:"best_child"`
+	BestDescendant   *NodeRef        `json:"best_descendant"`
+	Execution        ExecutionStatus `json:"execution"`
+	// Viable is true if the node itself is viable for the head.
+	Viable bool `json:"viable"`
+	// Canonical is true if the node is on the chain of the head.
+	Canonical bool `json:"canonical"`
+}
+
+// WriteNodesJSON writes the nodes as an indented JSON array.
+func WriteNodesJSON(w io.Writer, nodes []NodeInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(nodes)
+}
+
+// WriteNodesDOT writes the nodes as a Graphviz DOT graph, ordered by slot from left to right.
+// Edges point to the transition parent, and with a dashed line to the forkchoice parent if that is different.
+// Edges to nodes that are not included are omitted.
+// Block nodes are boxes, empty slot nodes are dashed ellipses, canonical nodes are bold,
+// nodes that are not viable for the head are grey, and nodes with an invalid execution payload are red.
+func WriteNodesDOT(w io.Writer, nodes []NodeInfo) error {
+	bw := bufio.NewWriter(w)
+	included := make(map[NodeRef]struct{}, len(nodes))
+	for i := range nodes {
+		included[nodes[i].NodeRef] = struct{}{}
+	}
+	fmt.Fprintln(bw, "digraph forkchoice {")
+	fmt.Fprintln(bw, "\trankdir=RL;")
+	fmt.Fprintln(bw, "\tnode [fontname=\"monospace\"];")
+	for i := range nodes {
+		n := &nodes[i]
+		label := fmt.Sprintf("%x\\nslot %d\\nweight %d\\nj %d f %d", n.Root[:4], n.Slot, n.Weight, n.JustifiedEpoch, n.FinalizedEpoch)
+		if n.Execution != ExecutionIrrelevant {
+			label += "\\n" + n.Execution.String()
+		}
+		attrs := "shape=box"
+		if !n.Block {
+			attrs = "shape=ellipse, style=dashed"
+		}
+		if n.Canonical {
+			attrs += ", penwidth=3"
+		}
+		if n.Execution == ExecutionInvalid {
+			attrs += ", color=red"
+		} else if !n.Viable {
+			attrs += ", color=grey, fontcolor=grey"
+		}
+		fmt.Fprintf(bw, "\t\"%s\" [label=\"%s\", %s];\n", n.NodeRef, label, attrs)
+	}
+	for i := range nodes {
+		n := &nodes[i]
+		if p := n.TransitionParent; p != nil {
+			if _, ok := included[*p]; ok {
+				fmt.Fprintf(bw, "\t\"%s\" -> \"%s\";\n", n.NodeRef, *p)
+			}
+		}
+		if p := n.ForkchoiceParent; p != nil && (n.TransitionParent == nil || *p != *n.TransitionParent) {
+			if _, ok := included[*p]; ok {
+				fmt.Fprintf(bw, "\t\"%s\" -> \"%s\" [style=dashed];\n", n.NodeRef, *p)
+			}
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
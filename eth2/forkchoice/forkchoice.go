@@ -19,20 +19,40 @@ type ProtoForkChoice struct {
 	justified Checkpoint
 	finalized Checkpoint
 	spec      *common.Spec
+
+	// The highest unrealized checkpoints, realized at the start of the next epoch.
+	unrealizedJustified Checkpoint
+	unrealizedFinalized Checkpoint
+	// The balances of the unrealized justified state, to use when it is realized.
+	unrealizedBalances []Gwei
+
+	genesisTime Timestamp
+	// The latest time seen by OnTick or OnBlockArrival.
+	time Timestamp
+	// The epoch of the latest OnTick, the unrealized checkpoints are realized up to this epoch.
+	epoch Epoch
+	// The timely block of the current slot, zero if there is none.
+	proposerBoost NodeRef
+	// True if the proposer boost or the epoch changed since the last score update.
+	scoresChanged bool
 }
 
 var _ Forkchoice = (*ProtoForkChoice)(nil)
 
-func NewForkChoice(spec *common.Spec, finalized Checkpoint, justified Checkpoint,
+func NewForkChoice(spec *common.Spec, genesisTime Timestamp, finalized Checkpoint, justified Checkpoint,
 	anchorRoot Root, anchorSlot Slot, graph ForkchoiceGraph, votes VoteStore,
 	initialBalances []Gwei) (Forkchoice, error) {
 	fc := &ProtoForkChoice{
-		protoArray: graph,
-		voteStore:  votes,
-		balances:   nil,
-		justified:  justified,
-		finalized:  finalized,
-		spec:       spec,
+		protoArray:  graph,
+		voteStore:   votes,
+		balances:    nil,
+		justified:   justified,
+		finalized:   finalized,
+		spec:        spec,
+		genesisTime: genesisTime,
+
+		unrealizedJustified: justified,
+		unrealizedFinalized: finalized,
 	}
 	if err := fc.SetPin(anchorRoot, anchorSlot); err != nil {
 		return nil, err
@@ -45,6 +65,36 @@ func NewForkChoice(spec *common.Spec, finalized Checkpoint, justified Checkpoint
 	return fc, nil
 }
 
+func (fc *ProtoForkChoice) Copy(sink NodeSink) Forkchoice {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	var pin *NodeRef
+	if fc.pin != nil {
+		p := *fc.pin
+		pin = &p
+	}
+	return &ProtoForkChoice{
+		protoArray: fc.protoArray.Copy(sink),
+		voteStore:  fc.voteStore.Copy(),
+		// balances are replaced, never modified, and can be shared.
+		balances:  fc.balances,
+		pin:       pin,
+		justified: fc.justified,
+		finalized: fc.finalized,
+		spec:      fc.spec,
+
+		unrealizedJustified: fc.unrealizedJustified,
+		unrealizedFinalized: fc.unrealizedFinalized,
+		unrealizedBalances:  fc.unrealizedBalances,
+
+		genesisTime:   fc.genesisTime,
+		time:          fc.time,
+		epoch:         fc.epoch,
+		proposerBoost: fc.proposerBoost,
+		scoresChanged: fc.scoresChanged,
+	}
+}
+
 func (fc *ProtoForkChoice) Pin() *NodeRef {
 	fc.mu.RLock()
 	defer fc.mu.RUnlock()
@@ -76,13 +126,18 @@ func (fc *ProtoForkChoice) UpdateJustified(ctx context.Context, trigger Root, ju
 	justifiedStateBalances func() ([]Gwei, error)) error {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
+	return fc.updateJustifiedAndPrune(ctx, trigger, justified, finalized, justifiedStateBalances)
+}
+
+func (fc *ProtoForkChoice) updateJustifiedAndPrune(ctx context.Context, trigger Root, justified Checkpoint, finalized Checkpoint,
+	justifiedStateBalances func() ([]Gwei, error)) error {
 	// Old/same data? Ignore the change.
 	if fc.justified.Epoch >= justified.Epoch && fc.finalized.Epoch >= finalized.Epoch {
 		return nil
 	}
 	if fc.pin != nil && trigger != fc.pin.Root {
 		// check trigger against pin, to ensure no justification/finalization of data that conflicts with the pin.
-		if unknown, inSubtree := fc.InSubtree(fc.pin.Root, trigger); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.pin.Root, trigger); unknown {
 			return fmt.Errorf("cannot justify/finalize with unknown trigger when forkchoice is pinned")
 		} else if !inSubtree {
 			return fmt.Errorf("cannot justify/finalize outside of pinned forkchoice tree")
@@ -91,7 +146,7 @@ func (fc *ProtoForkChoice) UpdateJustified(ctx context.Context, trigger Root, ju
 
 	prevFinalized := fc.finalized
 
-	if err := fc.updateJustified(justified, finalized, justifiedStateBalances); err != nil {
+	if err := fc.updateJustified(finalized, justified, justifiedStateBalances); err != nil {
 		return err
 	}
 
@@ -114,7 +169,7 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 
 	// check if new finalized checkpoint is valid
 	if fc.finalized != finalized {
-		if unknown, inSubtree := fc.InSubtree(fc.finalized.Root, finalized.Root); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.finalized.Root, finalized.Root); unknown {
 			return fmt.Errorf("unknown finalized checkpoint: %s", finalized)
 		} else if !inSubtree || fc.finalized.Epoch > finalized.Epoch {
 			return fmt.Errorf("new finalized checkpoint %s is outside of finalized subtree: %s",
@@ -122,7 +177,7 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 		}
 	}
 	if fc.justified != justified {
-		if unknown, inSubtree := fc.InSubtree(fc.finalized.Root, justified.Root); unknown {
+		if unknown, inSubtree := fc.protoArray.InSubtree(fc.finalized.Root, justified.Root); unknown {
 			return fmt.Errorf("unknown justified checkpoint: %s", justified)
 		} else if !inSubtree || fc.finalized.Epoch > justified.Epoch {
 			return fmt.Errorf("new justified checkpoint %s is outside of finalized subtree: %s",
@@ -138,27 +193,257 @@ func (fc *ProtoForkChoice) updateJustified(finalized Checkpoint, justified Check
 
 	deltas := fc.voteStore.ComputeDeltas(fc.protoArray.Indices(), oldBals, newBals)
 
-	if err := fc.protoArray.ApplyScoreChanges(deltas, justified.Epoch, finalized.Epoch); err != nil {
+	filter := fc.headFilter()
+	filter.JustifiedEpoch = justified.Epoch
+	filter.FinalizedEpoch = finalized.Epoch
+	if err := fc.protoArray.ApplyScoreChanges(deltas, fc.boost(newBals), filter); err != nil {
 		return err
 	}
+	fc.scoresChanged = false
 
 	fc.balances = newBals
 	fc.justified = justified
 	fc.finalized = finalized
+	// The realized checkpoints may be ahead of what was seen as unrealized.
+	if justified.Epoch > fc.unrealizedJustified.Epoch {
+		fc.unrealizedJustified = justified
+		fc.unrealizedBalances = newBals
+	}
+	if finalized.Epoch > fc.unrealizedFinalized.Epoch {
+		fc.unrealizedFinalized = finalized
+	}
+
+	return nil
+}
 
+// headFilter returns the justification and finalization that head candidates are filtered by.
+func (fc *ProtoForkChoice) headFilter() HeadFilter {
+	start, _ := fc.spec.EpochStartSlot(fc.epoch)
+	return HeadFilter{
+		JustifiedEpoch:    fc.justified.Epoch,
+		FinalizedEpoch:    fc.finalized.Epoch,
+		CurrentEpoch:      fc.epoch,
+		CurrentEpochStart: start,
+	}
+}
+
+func (fc *ProtoForkChoice) UpdateUnrealized(ctx context.Context, blockRoot Root, blockSlot Slot,
+	justified Checkpoint, finalized Checkpoint, justifiedStateBalances func() ([]Gwei, error)) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if justified.Epoch > fc.unrealizedJustified.Epoch {
+		balances, err := justifiedStateBalances()
+		if err != nil {
+			return err
+		}
+		fc.unrealizedJustified = justified
+		fc.unrealizedBalances = balances
+	}
+	if finalized.Epoch > fc.unrealizedFinalized.Epoch {
+		fc.unrealizedFinalized = finalized
+	}
+	// The epoch of the block is over, its checkpoints would have been realized already.
+	if fc.spec.SlotToEpoch(blockSlot) < fc.epoch {
+		return fc.realize(ctx, blockRoot, justified, finalized, justifiedStateBalances)
+	}
 	return nil
 }
 
+// realize updates the justified and finalized checkpoints, if the given checkpoints are newer.
+func (fc *ProtoForkChoice) realize(ctx context.Context, trigger Root, justified Checkpoint, finalized Checkpoint,
+	justifiedStateBalances func() ([]Gwei, error)) error {
+	if justified.Epoch <= fc.justified.Epoch {
+		justified = fc.justified
+		justifiedStateBalances = func() ([]Gwei, error) {
+			return fc.balances, nil
+		}
+	}
+	if finalized.Epoch <= fc.finalized.Epoch {
+		finalized = fc.finalized
+	}
+	return fc.updateJustifiedAndPrune(ctx, trigger, justified, finalized, justifiedStateBalances)
+}
+
 // TODO: skip based on time (like rate limiting) or based on amount of changes
 //  (if not bigger than previous difference between head-node contenders)
 func (fc *ProtoForkChoice) updateVotesMaybe() error {
-	if !fc.voteStore.HasChanges() {
+	if !fc.voteStore.HasChanges() && !fc.scoresChanged {
 		return nil
 	}
+	return fc.updateScores()
+}
 
+func (fc *ProtoForkChoice) updateScores() error {
 	deltas := fc.voteStore.ComputeDeltas(fc.protoArray.Indices(), fc.balances, fc.balances)
 
-	return fc.protoArray.ApplyScoreChanges(deltas, fc.justified.Epoch, fc.finalized.Epoch)
+	if err := fc.protoArray.ApplyScoreChanges(deltas, fc.boost(fc.balances), fc.headFilter()); err != nil {
+		return err
+	}
+	fc.scoresChanged = false
+	return nil
+}
+
+// committeeWeight computes the average committee weight, approximated with the justified balances.
+func (fc *ProtoForkChoice) committeeWeight(balances []Gwei) Gwei {
+	var total Gwei
+	for _, b := range balances {
+		total += b
+	}
+	return total / Gwei(fc.spec.SLOTS_PER_EPOCH)
+}
+
+// boost computes the proposer boost: a fraction of the average committee weight.
+func (fc *ProtoForkChoice) boost(balances []Gwei) ProposerBoost {
+	if fc.proposerBoost == (NodeRef{}) {
+		return ProposerBoost{}
+	}
+	return ProposerBoost{
+		Ref:   fc.proposerBoost,
+		Score: SignedGwei(fc.committeeWeight(balances) * Gwei(fc.spec.PROPOSER_SCORE_BOOST) / 100),
+	}
+}
+
+func (fc *ProtoForkChoice) OnTick(ctx context.Context, now Timestamp) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.onTick(now)
+	epoch := fc.spec.SlotToEpoch(fc.spec.TimeToSlot(fc.time, fc.genesisTime))
+	if epoch <= fc.epoch {
+		return nil
+	}
+	// Nodes of the previous epoch are pulled up from now on, and so are the checkpoints.
+	fc.epoch = epoch
+	fc.scoresChanged = true
+	balances := fc.unrealizedBalances
+	return fc.realize(ctx, fc.unrealizedJustified.Root, fc.unrealizedJustified, fc.unrealizedFinalized,
+		func() ([]Gwei, error) {
+			if balances == nil {
+				return fc.balances, nil
+			}
+			return balances, nil
+		})
+}
+
+func (fc *ProtoForkChoice) onTick(now Timestamp) {
+	if now <= fc.time {
+		return
+	}
+	fc.time = now
+	// The boost only lasts for the slot of the block.
+	if fc.proposerBoost != (NodeRef{}) && fc.spec.TimeToSlot(now, fc.genesisTime) > fc.proposerBoost.Slot {
+		fc.proposerBoost = NodeRef{}
+		fc.scoresChanged = true
+	}
+}
+
+func (fc *ProtoForkChoice) OnBlockArrival(blockRoot Root, blockSlot Slot, arrival Timestamp) (boosted bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.onTick(arrival)
+	if slot, ok := fc.protoArray.GetSlot(blockRoot); !ok || slot != blockSlot {
+		return false
+	}
+	// Only the first timely block of the slot is boosted, equivocating proposers do not get a second boost.
+	if fc.proposerBoost != (NodeRef{}) {
+		return false
+	}
+	slotStart, err := fc.spec.TimeAtSlot(blockSlot, fc.genesisTime)
+	if err != nil || arrival < slotStart || fc.spec.TimeToSlot(fc.time, fc.genesisTime) != blockSlot {
+		return false
+	}
+	if arrival-slotStart >= fc.spec.SECONDS_PER_SLOT/IntervalsPerSlot {
+		return false
+	}
+	fc.proposerBoost = NodeRef{Root: blockRoot, Slot: blockSlot}
+	fc.scoresChanged = true
+	return true
+}
+
+func (fc *ProtoForkChoice) ProposerBoost() NodeRef {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.proposerBoost
+}
+
+func (fc *ProtoForkChoice) CurrentSlot() Slot {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.spec.TimeToSlot(fc.time, fc.genesisTime)
+}
+
+func (fc *ProtoForkChoice) ProposerHead(now Timestamp, headArrival Timestamp) (NodeRef, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.updateVotesMaybe(); err != nil {
+		return NodeRef{}, err
+	}
+	anchor := fc.headAnchor()
+	head, err := fc.protoArray.FindHead(anchor.Root, anchor.Slot)
+	if err != nil {
+		return NodeRef{}, err
+	}
+	if parent, ok := fc.reorgParent(head, now, headArrival); ok {
+		return parent, nil
+	}
+	return head, nil
+}
+
+// reorgParent returns the parent block node of the head, if the head can be re-orged by the proposer at the given time.
+func (fc *ProtoForkChoice) reorgParent(head NodeRef, now Timestamp, headArrival Timestamp) (NodeRef, bool) {
+	spec := fc.spec
+	slot := spec.TimeToSlot(now, fc.genesisTime)
+	// Only a block of the previous slot is re-orged, not an empty slot.
+	if head.Slot+1 != slot {
+		return NodeRef{}, false
+	}
+	if headSlot, ok := fc.protoArray.GetSlot(head.Root); !ok || headSlot != head.Slot {
+		return NodeRef{}, false
+	}
+	// The head must have missed the attestation deadline, and must not be boosted.
+	headSlotStart, err := spec.TimeAtSlot(head.Slot, fc.genesisTime)
+	if err != nil || headArrival < headSlotStart+spec.SECONDS_PER_SLOT/IntervalsPerSlot || fc.proposerBoost == head {
+		return NodeRef{}, false
+	}
+	// The proposal must be on time, for the proposer boost to overpower the head.
+	slotStart, err := spec.TimeAtSlot(slot, fc.genesisTime)
+	if err != nil || now-slotStart > spec.SECONDS_PER_SLOT/IntervalsPerSlot/2 {
+		return NodeRef{}, false
+	}
+	// The proposer shuffling could change at an epoch boundary.
+	if slot%spec.SLOTS_PER_EPOCH == 0 {
+		return NodeRef{}, false
+	}
+	// Only re-org if the chain is finalizing.
+	if spec.SlotToEpoch(slot) > fc.finalized.Epoch+ReorgMaxEpochsSinceFinalization {
+		return NodeRef{}, false
+	}
+	// The parent must be the block of the slot before the head: a single slot re-org.
+	parent, err := fc.protoArray.Ancestor(head.Root, head.Slot-1)
+	if err != nil || parent.Slot+1 != head.Slot {
+		return NodeRef{}, false
+	}
+	if parentSlot, ok := fc.protoArray.GetSlot(parent.Root); !ok || parentSlot != parent.Slot {
+		return NodeRef{}, false
+	}
+	// The parent must be as competitive in justification as the head.
+	headJustified, _, ok := fc.protoArray.GetUnrealized(head.Root)
+	if !ok {
+		return NodeRef{}, false
+	}
+	if parentJustified, _, ok := fc.protoArray.GetUnrealized(parent.Root); !ok || parentJustified != headJustified {
+		return NodeRef{}, false
+	}
+	// The head must be weak, and the votes must be on the parent instead.
+	committeeWeight := fc.committeeWeight(fc.balances)
+	headWeight, ok := fc.protoArray.GetWeight(head.Root)
+	if !ok || headWeight >= SignedGwei(committeeWeight*ReorgHeadWeightThreshold/100) {
+		return NodeRef{}, false
+	}
+	parentWeight, ok := fc.protoArray.GetWeight(parent.Root)
+	if !ok || parentWeight <= SignedGwei(committeeWeight*ReorgParentWeightThreshold/100) {
+		return NodeRef{}, false
+	}
+	return parent, true
 }
 
 func (fc *ProtoForkChoice) Justified() Checkpoint {
@@ -173,21 +458,69 @@ func (fc *ProtoForkChoice) Finalized() Checkpoint {
 	return fc.finalized
 }
 
-func (fc *ProtoForkChoice) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
+func (fc *ProtoForkChoice) UnrealizedJustified() Checkpoint {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.unrealizedJustified
+}
+
+func (fc *ProtoForkChoice) UnrealizedFinalized() Checkpoint {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.unrealizedFinalized
+}
+
+func (fc *ProtoForkChoice) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool, changed bool) {
 	fc.mu.Lock()
-	fc.mu.Unlock()
+	defer fc.mu.Unlock()
 	// only add the vote if we can. Don't add if it's not within view.
+	// The head slot may be a gap slot after the block, but not before it.
 	blockSlot, ok := fc.protoArray.GetSlot(blockRoot)
-	if !ok || blockSlot < headSlot {
-		return false
+	if !ok || blockSlot > headSlot {
+		return false, false
 	}
 	return fc.voteStore.ProcessAttestation(index, blockRoot, headSlot)
 }
 
+func (fc *ProtoForkChoice) ProcessEquivocation(index ValidatorIndex) (changed bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.voteStore.ProcessEquivocation(index)
+}
+
+func (fc *ProtoForkChoice) Equivocating() []ValidatorIndex {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.voteStore.Equivocating()
+}
+
+// ProcessAttesterSlashing is the equivalent of the `on_attester_slashing` handler in the eth2 spec.
+func (fc *ProtoForkChoice) ProcessAttesterSlashing(a common.AttestationEnvelopeBuilder, b common.AttestationEnvelopeBuilder) (marked []ValidatorIndex, err error) {
+	envA, envB := a.AttestationEnvelope(), b.AttestationEnvelope()
+	if !envA.Indexed() || !envB.Indexed() {
+		return nil, fmt.Errorf("attester slashing requires indexed attestations")
+	}
+	if !envA.IsSlashable(envB) {
+		return nil, fmt.Errorf("attester slashing attestations are not slashable")
+	}
+	attestedA := make(map[ValidatorIndex]struct{}, len(envA.AttestingIndices))
+	for _, index := range envA.AttestingIndices {
+		attestedA[index] = struct{}{}
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for _, index := range envB.AttestingIndices {
+		if _, ok := attestedA[index]; ok && fc.voteStore.ProcessEquivocation(index) {
+			marked = append(marked, index)
+		}
+	}
+	return marked, nil
+}
+
 func (fc *ProtoForkChoice) CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]ExtendedNodeRef, error) {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
-	return fc.CanonicalChain(anchorRoot, anchorSlot)
+	return fc.protoArray.CanonicalChain(anchorRoot, anchorSlot)
 }
 
 func (fc *ProtoForkChoice) ProcessSlot(parentRoot Root, slot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) {
@@ -196,10 +529,46 @@ func (fc *ProtoForkChoice) ProcessSlot(parentRoot Root, slot Slot, justifiedEpoc
 	fc.protoArray.ProcessSlot(parentRoot, slot, justifiedEpoch, finalizedEpoch)
 }
 
-func (fc *ProtoForkChoice) ProcessBlock(parentRoot Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool) {
+func (fc *ProtoForkChoice) ProcessBlock(parentRoot Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch,
+	unrealizedJustifiedEpoch Epoch, unrealizedFinalizedEpoch Epoch, execution ExecutionInfo) (ok bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.protoArray.ProcessBlock(parentRoot, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch,
+		unrealizedJustifiedEpoch, unrealizedFinalizedEpoch, execution)
+}
+
+func (fc *ProtoForkChoice) GetExecution(blockRoot Root) (info ExecutionInfo, ok bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.protoArray.GetExecution(blockRoot)
+}
+
+func (fc *ProtoForkChoice) Ancestor(root Root, slot Slot) (NodeRef, error) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.protoArray.Ancestor(root, slot)
+}
+
+func (fc *ProtoForkChoice) CommonAncestor(a NodeRef, b NodeRef) (NodeRef, error) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.protoArray.CommonAncestor(a, b)
+}
+
+func (fc *ProtoForkChoice) OnPayloadValid(blockRoot Root) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.protoArray.OnPayloadValid(blockRoot)
+}
+
+func (fc *ProtoForkChoice) OnPayloadInvalid(blockRoot Root, latestValidHash *Root) error {
 	fc.mu.Lock()
 	defer fc.mu.Unlock()
-	return fc.protoArray.ProcessBlock(parentRoot, blockRoot, blockSlot, justifiedEpoch, finalizedEpoch)
+	if err := fc.protoArray.OnPayloadInvalid(blockRoot, latestValidHash); err != nil {
+		return err
+	}
+	// Remove the weight of the invalidated nodes right away.
+	return fc.updateScores()
 }
 
 func (fc *ProtoForkChoice) InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool) {
@@ -247,11 +616,87 @@ func (fc *ProtoForkChoice) Head() (NodeRef, error) {
 	if err := fc.updateVotesMaybe(); err != nil {
 		return NodeRef{}, err
 	}
-	root := fc.justified.Root
-	slot, _ := fc.spec.EpochStartSlot(fc.justified.Epoch)
+	anchor := fc.headAnchor()
+	return fc.protoArray.FindHead(anchor.Root, anchor.Slot)
+}
+
+func (fc *ProtoForkChoice) SafeHead() (NodeRef, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.updateVotesMaybe(); err != nil {
+		return NodeRef{}, err
+	}
+	anchor := fc.headAnchor()
+	head, err := fc.protoArray.FindHead(anchor.Root, anchor.Slot)
+	if err != nil {
+		return NodeRef{}, err
+	}
+	// Like the spec, the safe head starts at the checkpoint: the start slot of the justified epoch.
+	// The slot known for the justified block is not used, it may be that of a pruning anchor.
+	justifiedSlot, err := fc.spec.EpochStartSlot(fc.justified.Epoch)
+	if err != nil {
+		return NodeRef{}, err
+	}
+	safe := NodeRef{Root: fc.justified.Root, Slot: justifiedSlot}
+	// The blocks from the head back to the justified block, to confirm starting with the oldest.
+	var blocks []NodeRef
+	for root := head.Root; root != fc.justified.Root; {
+		slot, ok := fc.protoArray.GetSlot(root)
+		if !ok || slot <= justifiedSlot {
+			// The head does not descend from the justified block, e.g. when pinned to another subtree.
+			return safe, nil
+		}
+		blocks = append(blocks, NodeRef{Root: root, Slot: slot})
+		parent, err := fc.protoArray.Ancestor(root, slot-1)
+		if err != nil {
+			return safe, nil
+		}
+		root = parent.Root
+	}
+	currentSlot := fc.spec.TimeToSlot(fc.time, fc.genesisTime)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if !fc.oneConfirmed(blocks[i].Root, safe.Slot, currentSlot) {
+			break
+		}
+		safe = blocks[i]
+	}
+	return safe, nil
+}
+
+// oneConfirmed checks if the block has enough support from the committees of the slots after its parent,
+// up to the current slot, to not be re-orged by the byzantine part of those committees and a proposer boost.
+func (fc *ProtoForkChoice) oneConfirmed(blockRoot Root, parentSlot Slot, currentSlot Slot) bool {
+	weight, ok := fc.protoArray.GetWeight(blockRoot)
+	if !ok || weight <= 0 || currentSlot <= parentSlot+1 {
+		return false
+	}
+	// Every validator votes once per epoch, more slots do not add more support.
+	slots := currentSlot - 1 - parentSlot
+	if slots > fc.spec.SLOTS_PER_EPOCH {
+		slots = fc.spec.SLOTS_PER_EPOCH
+	}
+	committeeWeight := fc.committeeWeight(fc.balances)
+	maxSupport := committeeWeight * Gwei(slots)
+	proposerScore := committeeWeight * Gwei(fc.spec.PROPOSER_SCORE_BOOST) / 100
+	// support / maxSupport > 1/2 * (1 + proposerScore / maxSupport) + threshold / 100, in integers.
+	return 100*Gwei(weight) > 50*maxSupport+50*proposerScore+ConfirmationByzantineThreshold*maxSupport
+}
+
+// headAnchor returns the node to find the head from: the pin, or else the justified checkpoint.
+func (fc *ProtoForkChoice) headAnchor() NodeRef {
 	if fc.pin != nil {
-		root = fc.pin.Root
-		slot = fc.pin.Slot
+		return *fc.pin
+	}
+	slot, _ := fc.spec.EpochStartSlot(fc.justified.Epoch)
+	return NodeRef{Root: fc.justified.Root, Slot: slot}
+}
+
+func (fc *ProtoForkChoice) ExportNodes(slots *SlotRange) ([]NodeInfo, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := fc.updateVotesMaybe(); err != nil {
+		return nil, err
 	}
-	return fc.protoArray.FindHead(root, slot)
+	anchor := fc.headAnchor()
+	return fc.protoArray.ExportNodes(anchor.Root, anchor.Slot, slots)
 }
@@ -2,7 +2,9 @@ package forkchoice
 
 import (
 	"context"
+	"fmt"
 	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"io"
 )
 
 type Root = common.Root
@@ -10,57 +12,244 @@ type Epoch = common.Epoch
 type Slot = common.Slot
 type ValidatorIndex = common.ValidatorIndex
 type Gwei = common.Gwei
+type Timestamp = common.Timestamp
 type Checkpoint = common.Checkpoint
 type NodeRef = common.NodeRef
 type ExtendedNodeRef = common.ExtendedNodeRef
 type SignedGwei int64
 type NodeIndex uint64
 
+// IntervalsPerSlot is the number of intervals in a slot: a block is timely if it arrives in the first interval.
+const IntervalsPerSlot = 3
+
+// The conditions to re-org a late block, see Forkchoice.ProposerHead.
+const (
+	// ReorgHeadWeightThreshold is the percentage of the committee weight that a late head must stay below.
+	ReorgHeadWeightThreshold = 20
+	// ReorgParentWeightThreshold is the percentage of the committee weight that the parent of the late head must exceed.
+	ReorgParentWeightThreshold = 160
+	// ReorgMaxEpochsSinceFinalization is the number of epochs since the finalized epoch, up to which late blocks may be re-orged.
+	ReorgMaxEpochsSinceFinalization = 2
+)
+
+// ConfirmationByzantineThreshold is the percentage of the committee weight that the confirmation rule
+// assumes to be byzantine, see Forkchoice.SafeHead.
+const ConfirmationByzantineThreshold = 33
+
+// ProposerBoost is the temporary weight of the timely block of the current slot.
+// The zero value is no boost.
+type ProposerBoost struct {
+	Ref   NodeRef
+	Score SignedGwei
+}
+
+// HeadFilter is the justification and finalization that nodes must match to be viable for the head.
+type HeadFilter struct {
+	JustifiedEpoch Epoch
+	FinalizedEpoch Epoch
+	// CurrentEpoch is the epoch of the current time, see Forkchoice.OnTick.
+	CurrentEpoch Epoch
+	// CurrentEpochStart is the first slot of the current epoch. Nodes before it are pulled up:
+	// they are filtered by their unrealized justification and finalization.
+	CurrentEpochStart Slot
+}
+
+// ExecutionStatus is the status of the execution payload of a block, see the optimistic sync spec.
+type ExecutionStatus uint8
+
+const (
+	// ExecutionIrrelevant is the status of blocks without execution payload, from before the merge.
+	ExecutionIrrelevant ExecutionStatus = iota
+	// ExecutionOptimistic is the status of a payload that is not verified by the execution engine yet.
+	ExecutionOptimistic
+	ExecutionValid
+	// ExecutionInvalid blocks, and their descendants, are not viable for the head, and their votes do not count.
+	ExecutionInvalid
+)
+
+func (s ExecutionStatus) String() string {
+	switch s {
+	case ExecutionIrrelevant:
+		return "irrelevant"
+	case ExecutionOptimistic:
+		return "optimistic"
+	case ExecutionValid:
+		return "valid"
+	case ExecutionInvalid:
+		return "invalid"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+func (s ExecutionStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ExecutionStatus) UnmarshalText(text []byte) error {
+	for _, v := range []ExecutionStatus{ExecutionIrrelevant, ExecutionOptimistic, ExecutionValid, ExecutionInvalid} {
+		if string(text) == v.String() {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown execution status: %q", text)
+}
+
+// ExecutionInfo is the execution payload of a block, as tracked by the forkchoice.
+// The zero value is a block without execution payload.
+type ExecutionInfo struct {
+	BlockHash Root
+	Status    ExecutionStatus
+}
+
+type NodeSinkFn func(ctx context.Context, ref NodeRef, canonical bool) error
+
+func (fn NodeSinkFn) OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error {
+	return fn(ctx, ref, canonical)
+}
+
+type NodeSink interface {
+	OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error
+}
+
 type ForkchoiceView interface {
 	CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]ExtendedNodeRef, error)
 	ClosestToSlot(anchor Root, slot Slot) (closest NodeRef, err error)
 	CanonAtSlot(anchor Root, slot Slot, withBlock bool) (at NodeRef, err error)
 	GetSlot(blockRoot Root) (slot Slot, ok bool)
+	// GetExecution returns the execution payload information of the block.
+	GetExecution(blockRoot Root) (info ExecutionInfo, ok bool)
 	FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef, error)
 	InSubtree(anchor Root, root Root) (unknown bool, inSubtree bool)
 	Search(anchor NodeRef, parentRoot *Root, slot *Slot) (nonCanon []NodeRef, canon []NodeRef, err error)
+	// Ancestor returns the latest node at or before the slot on the chain of the block.
+	// The root of the node is that of the latest block at or before the slot.
+	Ancestor(root Root, slot Slot) (NodeRef, error)
+	// CommonAncestor returns the latest node that both nodes are, or descend from.
+	CommonAncestor(a NodeRef, b NodeRef) (NodeRef, error)
 }
 
 type ForkchoiceNodeInput interface {
 	ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch)
-	ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool)
+	// ProcessBlock adds the block, with the justification and finalization of the post-block state,
+	// and the unrealized justification and finalization: that of the post-block state after processing
+	// the justification and finalization of the epoch of the block.
+	ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch,
+		unrealizedJustifiedEpoch Epoch, unrealizedFinalizedEpoch Epoch, execution ExecutionInfo) (ok bool)
+}
+
+type ForkchoiceExecutionInput interface {
+	// OnPayloadValid marks the payload of the block as valid, and the payloads of all optimistic ancestors with it.
+	OnPayloadValid(blockRoot Root) error
+	// OnPayloadInvalid marks the payload of the block, and all descendants, as invalid.
+	// If the latest valid payload hash is known, the optimistic ancestors after the block with that payload
+	// are invalidated as well, and the block with that payload is marked as valid.
+	// A zero latest valid hash invalidates all optimistic ancestors, up to the first pre-merge or valid block.
+	OnPayloadInvalid(blockRoot Root, latestValidHash *Root) error
 }
 
 type ForkchoiceGraph interface {
 	ForkchoiceView
 	ForkchoiceNodeInput
+	ForkchoiceExecutionInput
 	Indices() map[NodeRef]NodeIndex
-	ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch) error
+	// ApplyScoreChanges applies the vote deltas, and replaces the previously applied proposer boost with the given boost.
+	// The filter decides which nodes are viable for the head.
+	ApplyScoreChanges(deltas []SignedGwei, boost ProposerBoost, filter HeadFilter) error
 	OnPrune(ctx context.Context, anchorRoot Root, anchorSlot Slot) error
+	// GetWeight returns the weight of the block: the votes for the block and its descendants,
+	// as of the last applied score changes.
+	GetWeight(blockRoot Root) (weight SignedGwei, ok bool)
+	// GetUnrealized returns the unrealized justified and finalized epochs of the block.
+	GetUnrealized(blockRoot Root) (justifiedEpoch Epoch, finalizedEpoch Epoch, ok bool)
+	// Copy returns an independent copy of the graph. Pruned nodes of the copy go to the given sink.
+	Copy(sink NodeSink) ForkchoiceGraph
+	// Serialize writes the graph, to restore it later.
+	Serialize(w io.Writer) error
+	// ExportNodes returns a snapshot of the nodes within the slot range, or all nodes if the range is nil.
+	// Canonical nodes are those on the chain of the head of the anchor.
+	ExportNodes(anchorRoot Root, anchorSlot Slot, slots *SlotRange) ([]NodeInfo, error)
 }
 
 type VoteInput interface {
 	// ProcessAttestation overrides any previous vote, and applies voting weight to the new root/slot.
 	// If the root/slot combination does not exist, no changes are made, and ok=false is returned.
 	// It is up to the caller if nodes should be added, to then process the attestation.
-	ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool)
+	// The vote is only changed if it is newer than the previous vote of the validator, changed=true is returned if so.
+	ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool, changed bool)
+	// ProcessEquivocation marks the validator as equivocating: the weight of its vote is removed,
+	// and its future votes are ignored. changed=false is returned if the validator was already marked.
+	ProcessEquivocation(index ValidatorIndex) (changed bool)
+	// Equivocating returns the sorted indices of the validators that are marked as equivocating.
+	Equivocating() []ValidatorIndex
 }
 
 type VoteStore interface {
 	VoteInput
 	HasChanges() bool
 	ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalances []Gwei, newBalances []Gwei) []SignedGwei
+	// Copy returns an independent copy of the votes.
+	Copy() VoteStore
+	// Serialize writes the votes, to restore them later.
+	Serialize(w io.Writer) error
 }
 
 type Forkchoice interface {
 	ForkchoiceView
 	ForkchoiceNodeInput
+	ForkchoiceExecutionInput
 	VoteInput
 	UpdateJustified(ctx context.Context, trigger Root, justified Checkpoint, finalized Checkpoint,
 		justifiedStateBalances func() ([]Gwei, error)) error
 	Pin() *NodeRef
 	SetPin(root Root, slot Slot) error
+	// UpdateUnrealized tracks the unrealized justified and finalized checkpoints of a block:
+	// the checkpoints of the post-block state after processing the justification and finalization of its epoch.
+	// These are realized with UpdateJustified at the start of the next epoch (see OnTick),
+	// or right away if the block is from before the current epoch.
+	UpdateUnrealized(ctx context.Context, blockRoot Root, blockSlot Slot, justified Checkpoint, finalized Checkpoint,
+		justifiedStateBalances func() ([]Gwei, error)) error
 	Justified() Checkpoint
 	Finalized() Checkpoint
+	// UnrealizedJustified returns the highest unrealized justified checkpoint, it is never lower than Justified.
+	UnrealizedJustified() Checkpoint
+	// UnrealizedFinalized returns the highest unrealized finalized checkpoint, it is never lower than Finalized.
+	UnrealizedFinalized() Checkpoint
 	Head() (NodeRef, error)
+	// SafeHead returns the block node of the latest confirmed block on the chain of the head: a block that
+	// is unlikely to be re-orged. The justified block is safe, and each descendant block is confirmed
+	// if its weight exceeds half of the committee weight of the slots since its parent, plus the proposer boost,
+	// plus the byzantine threshold, and its parent is confirmed. The current slot is that of the last OnTick.
+	SafeHead() (NodeRef, error)
+	// ProcessAttesterSlashing marks the validators that attested to both of the conflicting indexed attestations
+	// as equivocating, and returns the newly marked validators.
+	// Warning: the attestation signatures are not verified, it is up to the caller to verify.
+	ProcessAttesterSlashing(a common.AttestationEnvelopeBuilder, b common.AttestationEnvelopeBuilder) (marked []ValidatorIndex, err error)
+	// OnTick updates the current time of the forkchoice, the proposer boost is reset at the start of a new slot.
+	// At the start of a new epoch, the unrealized justified and finalized checkpoints are realized,
+	// which may trigger pruning.
+	OnTick(ctx context.Context, now Timestamp) error
+	// OnBlockArrival updates the current time, like OnTick but without realizing checkpoints,
+	// and boosts the known block if it arrived in the first interval of its slot,
+	// and no other block of the slot was boosted already.
+	OnBlockArrival(blockRoot Root, blockSlot Slot, arrival Timestamp) (boosted bool)
+	// ProposerBoost returns the boosted block node, or a zero ref if there is none.
+	ProposerBoost() NodeRef
+	// CurrentSlot returns the slot of the latest time seen by OnTick or OnBlockArrival.
+	CurrentSlot() Slot
+	// ProposerHead returns the block node that the proposer of the slot at the given time should build on.
+	// This is the head, or the parent of the head if the head is a weak block that arrived late in the previous slot,
+	// following the get_proposer_head conditions of the spec: the proposal is on time, the re-org is a single slot,
+	// not at an epoch boundary, finalization is recent, and the parent is strong and as justified as the head.
+	// The arrival time of the head block is tracked by the caller.
+	ProposerHead(now Timestamp, headArrival Timestamp) (NodeRef, error)
+	// Copy returns an independent copy of the forkchoice, to process hypothetical blocks and votes with.
+	// Pruned nodes of the copy go to the given sink.
+	Copy(sink NodeSink) Forkchoice
+	// Serialize writes the complete forkchoice state, to restore it after a restart.
+	Serialize(w io.Writer) error
+	// ExportNodes returns a snapshot of the graph nodes within the slot range, or all nodes if the range is nil,
+	// with the votes applied. Canonical nodes are those on the chain of the current head.
+	ExportNodes(slots *SlotRange) ([]NodeInfo, error)
 }
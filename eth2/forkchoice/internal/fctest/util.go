@@ -184,10 +184,15 @@ type OpProcessBlock struct {
 	BlockSlot      forkchoice.Slot
 	JustifiedEpoch forkchoice.Epoch
 	FinalizedEpoch forkchoice.Epoch
+	// Defaults to the justified and finalized epochs if lower.
+	UnrealizedJustifiedEpoch forkchoice.Epoch
+	UnrealizedFinalizedEpoch forkchoice.Epoch
+	Execution                forkchoice.ExecutionInfo
 }
 
 func (op *OpProcessBlock) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	fc.ProcessBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch)
+	fc.ProcessBlock(op.Parent, op.BlockRoot, op.BlockSlot, op.JustifiedEpoch, op.FinalizedEpoch,
+		op.UnrealizedJustifiedEpoch, op.UnrealizedFinalizedEpoch, op.Execution)
 	return nil
 }
 
@@ -199,7 +204,7 @@ type OpProcessAttestation struct {
 }
 
 func (op *OpProcessAttestation) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	res := fc.ProcessAttestation(op.ValidatorIndex, op.BlockRoot, op.HeadSlot)
+	res, _ := fc.ProcessAttestation(op.ValidatorIndex, op.BlockRoot, op.HeadSlot)
 	if res != op.CanAdd {
 		return fmt.Errorf("processing attestation different result: canAdd %v <> %v", res, op.CanAdd)
 	}
@@ -225,7 +230,7 @@ type OpUpdateJustified struct {
 }
 
 func (op *OpUpdateJustified) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkchoice) error {
-	err := fc.UpdateJustified(context.Background(), op.Trigger, op.Finalized, op.Justified, op.JustifiedStateBalances)
+	err := fc.UpdateJustified(context.Background(), op.Trigger, op.Justified, op.Finalized, op.JustifiedStateBalances)
 	if op.Ok && err != nil {
 		return fmt.Errorf("unexpected error: %v", err)
 	}
@@ -237,6 +242,7 @@ func (op *OpUpdateJustified) Apply(ft *ForkChoiceTestTarget, fc forkchoice.Forkc
 
 type ForkChoiceTestInit struct {
 	Spec         *common.Spec
+	GenesisTime  forkchoice.Timestamp
 	Finalized    forkchoice.Checkpoint
 	Justified    forkchoice.Checkpoint
 	AnchorRoot   forkchoice.Root
@@ -0,0 +1,171 @@
+package forkchoice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"io"
+)
+
+// serializationVersion is increased when the serialized forkchoice format changes.
+const serializationVersion = 1
+
+// serializedChunkItems is the number of items that is read at a time from a serialized forkchoice.
+const serializedChunkItems = 1 << 12
+
+// ReadChunked reads count items in chunks of at most a few thousand items, with the given function.
+// Allocations grow with the data that is actually read, a corrupt count does not allocate more than the input holds.
+func ReadChunked(count uint64, readChunk func(n int) error) error {
+	for count > 0 {
+		n := uint64(serializedChunkItems)
+		if count < n {
+			n = count
+		}
+		if err := readChunk(int(n)); err != nil {
+			return err
+		}
+		count -= n
+	}
+	return nil
+}
+
+type protoForkChoiceHeader struct {
+	Version                uint64
+	GenesisTime            Timestamp
+	Time                   Timestamp
+	Epoch                  Epoch
+	Justified              Checkpoint
+	Finalized              Checkpoint
+	UnrealizedJustified    Checkpoint
+	UnrealizedFinalized    Checkpoint
+	HasPin                 bool
+	Pin                    NodeRef
+	ProposerBoost          NodeRef
+	ScoresChanged          bool
+	BalanceCount           uint64
+	UnrealizedBalanceCount uint64
+}
+
+// Serialize writes the forkchoice state, followed by the graph and the vote store.
+func (fc *ProtoForkChoice) Serialize(w io.Writer) error {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	header := protoForkChoiceHeader{
+		Version:                serializationVersion,
+		GenesisTime:            fc.genesisTime,
+		Time:                   fc.time,
+		Epoch:                  fc.epoch,
+		Justified:              fc.justified,
+		Finalized:              fc.finalized,
+		UnrealizedJustified:    fc.unrealizedJustified,
+		UnrealizedFinalized:    fc.unrealizedFinalized,
+		ProposerBoost:          fc.proposerBoost,
+		ScoresChanged:          fc.scoresChanged,
+		BalanceCount:           uint64(len(fc.balances)),
+		UnrealizedBalanceCount: uint64(len(fc.unrealizedBalances)),
+	}
+	if fc.pin != nil {
+		header.HasPin = true
+		header.Pin = *fc.pin
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, fc.balances); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, fc.unrealizedBalances); err != nil {
+		return err
+	}
+	if err := fc.protoArray.Serialize(w); err != nil {
+		return fmt.Errorf("failed to write forkchoice graph: %v", err)
+	}
+	if err := fc.voteStore.Serialize(w); err != nil {
+		return fmt.Errorf("failed to write forkchoice votes: %v", err)
+	}
+	return nil
+}
+
+// LoadForkChoice restores a forkchoice written with Serialize.
+// The graph and the votes are read with the given functions, matching the serialized implementations.
+func LoadForkChoice(spec *common.Spec, r io.Reader,
+	loadGraph func(r io.Reader) (ForkchoiceGraph, error),
+	loadVotes func(r io.Reader) (VoteStore, error)) (Forkchoice, error) {
+	var header protoForkChoiceHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("failed to read forkchoice header: %v", err)
+	}
+	if header.Version != serializationVersion {
+		return nil, fmt.Errorf("unsupported forkchoice serialization version %d", header.Version)
+	}
+	balances, err := readBalances(r, header.BalanceCount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balances: %v", err)
+	}
+	var unrealizedBalances []Gwei
+	if header.UnrealizedBalanceCount > 0 {
+		unrealizedBalances, err = readBalances(r, header.UnrealizedBalanceCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read unrealized balances: %v", err)
+		}
+	}
+	graph, err := loadGraph(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forkchoice graph: %v", err)
+	}
+	votes, err := loadVotes(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forkchoice votes: %v", err)
+	}
+	// The checkpoints and the pin must be in the graph, a mismatch would only fail later when finding the head.
+	if _, ok := graph.GetSlot(header.Justified.Root); !ok {
+		return nil, fmt.Errorf("justified checkpoint %s is not in the forkchoice graph", &header.Justified)
+	}
+	if _, ok := graph.GetSlot(header.Finalized.Root); !ok {
+		return nil, fmt.Errorf("finalized checkpoint %s is not in the forkchoice graph", &header.Finalized)
+	}
+	if header.HasPin {
+		if _, ok := graph.Indices()[header.Pin]; !ok {
+			return nil, fmt.Errorf("pin %s is not in the forkchoice graph", header.Pin)
+		}
+		if _, inSubtree := graph.InSubtree(header.Finalized.Root, header.Pin.Root); !inSubtree {
+			return nil, fmt.Errorf("pin %s does not descend from finalized checkpoint %s", header.Pin, &header.Finalized)
+		}
+	}
+	fc := &ProtoForkChoice{
+		protoArray: graph,
+		voteStore:  votes,
+		balances:   balances,
+		justified:  header.Justified,
+		finalized:  header.Finalized,
+		spec:       spec,
+
+		unrealizedJustified: header.UnrealizedJustified,
+		unrealizedFinalized: header.UnrealizedFinalized,
+		unrealizedBalances:  unrealizedBalances,
+
+		genesisTime:   header.GenesisTime,
+		time:          header.Time,
+		epoch:         header.Epoch,
+		proposerBoost: header.ProposerBoost,
+		scoresChanged: header.ScoresChanged,
+	}
+	if header.HasPin {
+		pin := header.Pin
+		fc.pin = &pin
+	}
+	return fc, nil
+}
+
+func readBalances(r io.Reader, count uint64) ([]Gwei, error) {
+	balances := make([]Gwei, 0)
+	err := ReadChunked(count, func(n int) error {
+		chunk := make([]Gwei, n)
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return err
+		}
+		balances = append(balances, chunk...)
+		return nil
+	})
+	return balances, err
+}
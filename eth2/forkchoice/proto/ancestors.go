@@ -0,0 +1,103 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+// The transition ancestors of every node are linked like a skew-binary list:
+// each node links to its transition parent, and jumps to an ancestor further back.
+// The jump distances are chosen such that any ancestor can be reached in a logarithmic number of steps,
+// while each new node only needs to look at its parent to compute its own jump.
+
+var AncestorUnknownErr = errors.New("ancestor unknown, it may have been pruned")
+
+// jumpLinks computes the depth and jump of a new node with the given transition parent.
+func (pr *ProtoArray) jumpLinks(parentIndex NodeIndex) (depth uint64, jump NodeIndex) {
+	if parentIndex == NONE {
+		return 0, NONE
+	}
+	parent := &pr.nodes[parentIndex]
+	jump = parentIndex
+	if parent.Jump != NONE {
+		// If the parent jumps as far as its jump target does, the two jumps are combined into one.
+		target := &pr.nodes[parent.Jump]
+		if target.Jump != NONE && parent.Depth-target.Depth == target.Depth-pr.nodes[target.Jump].Depth {
+			jump = target.Jump
+		}
+	}
+	return parent.Depth + 1, jump
+}
+
+// climb walks back from the given node, and returns the first node (possibly the node itself) that is not above.
+// The above condition must hold for a node if it holds for any of its transition descendants.
+func (pr *ProtoArray) climb(index NodeIndex, above func(node *ProtoNode) bool) (NodeIndex, error) {
+	for {
+		node := &pr.nodes[index]
+		if !above(node) {
+			return index, nil
+		}
+		if node.Jump != NONE && above(&pr.nodes[node.Jump]) {
+			index = node.Jump
+		} else if node.TransitionParent != NONE {
+			index = node.TransitionParent
+		} else {
+			return NONE, AncestorUnknownErr
+		}
+	}
+}
+
+// Ancestor returns the latest node at or before the given slot on the chain of the block.
+// The root of the node is that of the latest block at or before the slot.
+// If the slot is at or after the block, the node of the block itself is returned.
+func (pr *ProtoArray) Ancestor(root Root, slot Slot) (NodeRef, error) {
+	blockSlot, ok := pr.blockSlots[root]
+	if !ok {
+		return NodeRef{}, fmt.Errorf("unknown block %s", root)
+	}
+	index, err := pr.climb(pr.indices[NodeRef{Root: root, Slot: blockSlot}], func(node *ProtoNode) bool {
+		return node.Ref.Slot > slot
+	})
+	if err != nil {
+		return NodeRef{}, err
+	}
+	return pr.nodes[index].Ref, nil
+}
+
+// CommonAncestor returns the latest node that both nodes are, or descend from.
+// If one node descends from the other, the other node is returned.
+func (pr *ProtoArray) CommonAncestor(a NodeRef, b NodeRef) (NodeRef, error) {
+	aIndex, ok := pr.indices[a]
+	if !ok {
+		return NodeRef{}, fmt.Errorf("unknown node %s", a)
+	}
+	bIndex, ok := pr.indices[b]
+	if !ok {
+		return NodeRef{}, fmt.Errorf("unknown node %s", b)
+	}
+	// Walk back the deepest node, until both are at the same depth.
+	aDepth, bDepth := pr.nodes[aIndex].Depth, pr.nodes[bIndex].Depth
+	var err error
+	if aDepth > bDepth {
+		aIndex, err = pr.climb(aIndex, func(node *ProtoNode) bool { return node.Depth > bDepth })
+	} else if bDepth > aDepth {
+		bIndex, err = pr.climb(bIndex, func(node *ProtoNode) bool { return node.Depth > aDepth })
+	}
+	if err != nil {
+		return NodeRef{}, err
+	}
+	// Nodes at the same depth jump the same distance: take the jumps that do not meet yet, then step.
+	for aIndex != bIndex {
+		x, y := &pr.nodes[aIndex], &pr.nodes[bIndex]
+		if x.Jump != y.Jump {
+			aIndex, bIndex = x.Jump, y.Jump
+		} else if x.TransitionParent != NONE && y.TransitionParent != NONE {
+			aIndex, bIndex = x.TransitionParent, y.TransitionParent
+		} else {
+			// The nodes are in different trees, their common ancestor was pruned.
+			return NodeRef{}, AncestorUnknownErr
+		}
+	}
+	return pr.nodes[aIndex].Ref, nil
+}
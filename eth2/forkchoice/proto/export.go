@@ -0,0 +1,57 @@
+package proto
+
+import (
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+)
+
+func (pr *ProtoArray) ExportNodes(anchorRoot Root, anchorSlot Slot, slots *SlotRange) ([]NodeInfo, error) {
+	// Also brings the best child and descendant links up to date.
+	head, err := pr.FindHead(anchorRoot, anchorSlot)
+	if err != nil {
+		return nil, err
+	}
+	canonical := make(map[NodeIndex]struct{})
+	for i := pr.indices[head]; i != NONE; i = pr.nodes[i].TransitionParent {
+		canonical[i] = struct{}{}
+	}
+	ref := func(index NodeIndex) *NodeRef {
+		if index == NONE {
+			return nil
+		}
+		r := pr.nodes[index].Ref
+		return &r
+	}
+	var out []NodeInfo
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		if !slots.Contains(node.Ref.Slot) {
+			continue
+		}
+		_, isCanon := canonical[NodeIndex(i)]
+		out = append(out, NodeInfo{
+			NodeRef:          node.Ref,
+			ParentRoot:       node.ParentRoot,
+			Block:            pr.isBlockNode(node),
+			TransitionParent: ref(node.TransitionParent),
+			ForkchoiceParent: ref(node.ForkchoiceParent),
+			JustifiedEpoch:   node.JustifiedEpoch,
+			FinalizedEpoch:   node.FinalizedEpoch,
+			Weight:           node.Weight,
+			BestChild:        ref(node.BestChild),
+			BestDescendant:   ref(node.BestDescendant),
+			Execution:        node.Execution.Status,
+			Viable:           pr.isNodeViableForHead(node),
+			Canonical:        isCanon,
+		})
+	}
+	return out, nil
+}
+
+// isBlockNode checks if the node is that of a block, and not of an empty slot.
+// Empty slot nodes share the root of the node before them, and use it as parent root too.
+func (pr *ProtoArray) isBlockNode(node *ProtoNode) bool {
+	if node.TransitionParent == NONE {
+		return node.Ref.Root != node.ParentRoot
+	}
+	return pr.nodes[node.TransitionParent].Ref.Root != node.Ref.Root
+}
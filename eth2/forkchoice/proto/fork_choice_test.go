@@ -1,18 +1,27 @@
 package proto
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
 	"github.com/protolambda/zrnt/eth2/forkchoice"
 	"github.com/protolambda/zrnt/eth2/forkchoice/internal/fctest"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestProtoArray(t *testing.T) {
 	lhtest := fctest.LighthouseTestDef()
 	err := lhtest.Run(func(init *fctest.ForkChoiceTestInit, ft *fctest.ForkChoiceTestTarget) (forkchoice.Forkchoice, error) {
-		return NewProtoForkChoice(init.Spec, init.Finalized, init.Justified, init.AnchorRoot, init.AnchorSlot, init.AnchorParent, init.Balances,
-			NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+		return NewProtoForkChoice(init.Spec, init.GenesisTime, init.Finalized, init.Justified, init.AnchorRoot, init.AnchorSlot, init.AnchorParent, init.Balances,
+			forkchoice.NodeSinkFn(func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
 				// whenever something is pruned, check if it was allowed to be pruned,
 				// and if it's marked as canonical correctly.
 				expectedCanonical, ok := ft.Pruneable[ref]
@@ -29,3 +38,787 @@ func TestProtoArray(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestProposerBoost(t *testing.T) {
+	spec := configs.Minimal
+	genesisTime := forkchoice.Timestamp(1000)
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	// 16 validators: the boost is 70% of the weight of 2 validators, more than a single vote.
+	balances := make([]forkchoice.Gwei, 16)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, genesisTime, genesis, genesis, root(0), 0, forkchoice.Root{}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := forkchoice.NodeRef{Root: root(0xa), Slot: 1}
+	blockB := forkchoice.NodeRef{Root: root(0xb), Slot: 1}
+	blockC := forkchoice.NodeRef{Root: root(0xc), Slot: 1}
+	for _, b := range []forkchoice.NodeRef{blockA, blockB, blockC} {
+		if !fc.ProcessBlock(root(0), b.Root, b.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+			t.Fatalf("failed to add block %s", b)
+		}
+	}
+	if ok, _ := fc.ProcessAttestation(0, blockA.Root, blockA.Slot); !ok {
+		t.Fatal("failed to process attestation")
+	}
+	expectHead := func(expected forkchoice.NodeRef) {
+		t.Helper()
+		head, err := fc.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != expected {
+			t.Fatalf("expected head %s, got %s", expected, head)
+		}
+	}
+	expectHead(blockA)
+
+	slotStart := genesisTime + spec.SECONDS_PER_SLOT
+	if fc.OnBlockArrival(blockC.Root, blockC.Slot, slotStart+spec.SECONDS_PER_SLOT/forkchoice.IntervalsPerSlot) {
+		t.Fatal("late block must not be boosted")
+	}
+	if !fc.OnBlockArrival(blockB.Root, blockB.Slot, slotStart+1) {
+		t.Fatal("timely block must be boosted")
+	}
+	if fc.OnBlockArrival(blockC.Root, blockC.Slot, slotStart+1) {
+		t.Fatal("only the first timely block of the slot is boosted")
+	}
+	if fc.ProposerBoost() != blockB {
+		t.Fatalf("unexpected proposer boost %s", fc.ProposerBoost())
+	}
+	// The boost outweighs the vote for A
+	expectHead(blockB)
+
+	// The boost is removed in the next slot
+	if err := fc.OnTick(context.Background(), slotStart+spec.SECONDS_PER_SLOT); err != nil {
+		t.Fatal(err)
+	}
+	if fc.ProposerBoost() != (forkchoice.NodeRef{}) {
+		t.Fatal("expected proposer boost to be reset")
+	}
+	expectHead(blockA)
+}
+
+func TestProposerHead(t *testing.T) {
+	spec := configs.Minimal
+	genesisTime := forkchoice.Timestamp(1000)
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	// 64 validators: the committee weight is that of 8 validators.
+	// A head is weak with a single vote, and a parent is strong with more than 12 votes.
+	balances := make([]forkchoice.Gwei, 64)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, genesisTime, genesis, genesis, root(0), 0, forkchoice.Root{}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := forkchoice.NodeRef{Root: root(0xa), Slot: 1}
+	blockB := forkchoice.NodeRef{Root: root(0xb), Slot: 2}
+	fc.ProcessBlock(root(0), blockA.Root, blockA.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(blockA.Root, blockB.Root, blockB.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	for i := forkchoice.ValidatorIndex(0); i < 13; i++ {
+		fc.ProcessAttestation(i, blockA.Root, blockA.Slot)
+	}
+	fc.ProcessAttestation(13, blockB.Root, blockB.Slot)
+	if head, err := fc.Head(); err != nil || head != blockB {
+		t.Fatalf("expected head %s, got %s, %v", blockB, head, err)
+	}
+	expectProposerHead := func(now forkchoice.Timestamp, headArrival forkchoice.Timestamp, expected forkchoice.NodeRef) {
+		t.Helper()
+		ref, err := fc.ProposerHead(now, headArrival)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref != expected {
+			t.Fatalf("expected proposer head %s, got %s", expected, ref)
+		}
+	}
+	interval := spec.SECONDS_PER_SLOT / forkchoice.IntervalsPerSlot
+	slotB := genesisTime + 2*spec.SECONDS_PER_SLOT
+	slotC := genesisTime + 3*spec.SECONDS_PER_SLOT
+	// The late and weak head is re-orged.
+	expectProposerHead(slotC, slotB+interval, blockA)
+	// Not if the head was timely
+	expectProposerHead(slotC, slotB+interval-1, blockB)
+	// Not if the proposal is late
+	expectProposerHead(slotC+interval, slotB+interval, blockB)
+	// Not two slots later
+	expectProposerHead(slotC+spec.SECONDS_PER_SLOT, slotB+interval, blockB)
+	// Not if the head is not weak
+	fc.ProcessAttestation(14, blockB.Root, blockB.Slot)
+	expectProposerHead(slotC, slotB+interval, blockB)
+}
+
+func TestSafeHead(t *testing.T) {
+	spec := configs.Minimal
+	genesisTime := forkchoice.Timestamp(1000)
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	// 64 validators: the committee weight is that of 8 validators.
+	balances := make([]forkchoice.Gwei, 64)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, genesisTime, genesis, genesis, root(0), 0, forkchoice.Root{}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := forkchoice.NodeRef{Root: root(0xa), Slot: 1}
+	blockB := forkchoice.NodeRef{Root: root(0xb), Slot: 2}
+	blockC := forkchoice.NodeRef{Root: root(0xc), Slot: 3}
+	fc.ProcessBlock(root(0), blockA.Root, blockA.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(blockA.Root, blockB.Root, blockB.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(blockB.Root, blockC.Root, blockC.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	expectSafeHead := func(expected forkchoice.NodeRef) {
+		t.Helper()
+		ref, err := fc.SafeHead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref != expected {
+			t.Fatalf("expected safe head %s, got %s", expected, ref)
+		}
+	}
+	tick := func(slot forkchoice.Slot) {
+		t.Helper()
+		if err := fc.OnTick(context.Background(), genesisTime+forkchoice.Timestamp(slot)*spec.SECONDS_PER_SLOT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 20 votes confirm B and C in the slots after their parents,
+	// but not A, which needs more than 22.72 of the 24 votes of slots 1 to 3.
+	for i := forkchoice.ValidatorIndex(0); i < 20; i++ {
+		fc.ProcessAttestation(i, blockC.Root, blockC.Slot)
+	}
+	tick(4)
+	expectSafeHead(forkchoice.NodeRef{Root: root(0), Slot: 0})
+	for i := forkchoice.ValidatorIndex(20); i < 23; i++ {
+		fc.ProcessAttestation(i, blockC.Root, blockC.Slot)
+	}
+	expectSafeHead(blockC)
+	// Without votes in slot 4, the support of A is not enough anymore.
+	tick(5)
+	expectSafeHead(forkchoice.NodeRef{Root: root(0), Slot: 0})
+	for i := forkchoice.ValidatorIndex(23); i < 32; i++ {
+		fc.ProcessAttestation(i, blockC.Root, blockC.Slot)
+	}
+	expectSafeHead(blockC)
+
+	// Justify C at epoch 2 and finalize it at epoch 1: after pruning, the slot known for C is that of the epoch 1 anchor,
+	// the safe head starts at the justified checkpoint instead.
+	fc.ProcessSlot(blockC.Root, 8, 0, 0)
+	fc.ProcessSlot(blockC.Root, 16, 0, 0)
+	blockD := forkchoice.NodeRef{Root: root(0xd), Slot: 17}
+	fc.ProcessBlock(blockC.Root, blockD.Root, blockD.Slot, 2, 1, 2, 1, forkchoice.ExecutionInfo{})
+	if err := fc.UpdateJustified(context.Background(), blockD.Root,
+		forkchoice.Checkpoint{Root: blockC.Root, Epoch: 2}, forkchoice.Checkpoint{Root: blockC.Root, Epoch: 1},
+		func() ([]forkchoice.Gwei, error) { return balances, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if slot, _ := fc.GetSlot(blockC.Root); slot != 8 {
+		t.Fatalf("expected pruned block C to be known from slot 8, got %d", slot)
+	}
+	tick(18)
+	expectSafeHead(forkchoice.NodeRef{Root: blockC.Root, Slot: 16})
+}
+
+func TestAttesterSlashing(t *testing.T) {
+	spec := configs.Minimal
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	balances := make([]forkchoice.Gwei, 8)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, root(0), 0, forkchoice.Root{}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockA := forkchoice.NodeRef{Root: root(0xa), Slot: 1}
+	blockB := forkchoice.NodeRef{Root: root(0xb), Slot: 1}
+	for _, b := range []forkchoice.NodeRef{blockA, blockB} {
+		if !fc.ProcessBlock(root(0), b.Root, b.Slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+			t.Fatalf("failed to add block %s", b)
+		}
+	}
+	// A has 2 votes, B has 1 vote
+	for _, i := range []forkchoice.ValidatorIndex{0, 1} {
+		fc.ProcessAttestation(i, blockA.Root, blockA.Slot)
+	}
+	fc.ProcessAttestation(2, blockB.Root, blockB.Slot)
+	expectHead := func(expected forkchoice.NodeRef) {
+		t.Helper()
+		head, err := fc.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != expected {
+			t.Fatalf("expected head %s, got %s", expected, head)
+		}
+	}
+	expectHead(blockA)
+
+	voteA := &phase0.IndexedAttestation{
+		AttestingIndices: []common.ValidatorIndex{0, 1, 3},
+		Data:             phase0.AttestationData{Slot: 1, BeaconBlockRoot: blockA.Root},
+	}
+	voteB := &phase0.IndexedAttestation{
+		AttestingIndices: []common.ValidatorIndex{1, 3, 4},
+		Data:             phase0.AttestationData{Slot: 1, BeaconBlockRoot: blockB.Root},
+	}
+	if _, err := fc.ProcessAttesterSlashing(voteA, voteA); err == nil {
+		t.Fatal("expected equal attestations to not be slashable")
+	}
+	marked, err := fc.ProcessAttesterSlashing(voteA, voteB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marked) != 2 || marked[0] != 1 || marked[1] != 3 {
+		t.Fatalf("unexpected marked validators: %v", marked)
+	}
+	if !fc.ProcessEquivocation(0) || fc.ProcessEquivocation(1) {
+		t.Fatal("unexpected equivocation changes")
+	}
+	if eq := fc.Equivocating(); len(eq) != 3 || eq[0] != 0 || eq[1] != 1 || eq[2] != 3 {
+		t.Fatalf("unexpected equivocating validators: %v", eq)
+	}
+	// The votes for A are removed
+	expectHead(blockB)
+
+	// Votes of equivocating validators are ignored
+	if _, changed := fc.ProcessAttestation(0, blockA.Root, spec.SLOTS_PER_EPOCH); changed {
+		t.Fatal("expected vote of equivocating validator to be ignored")
+	}
+	expectHead(blockB)
+}
+
+func TestExecutionStatus(t *testing.T) {
+	spec := configs.Minimal
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	balances := make([]forkchoice.Gwei, 8)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, root(0), 0, forkchoice.Root{}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimistic := func(hash byte) forkchoice.ExecutionInfo {
+		return forkchoice.ExecutionInfo{BlockHash: root(hash), Status: forkchoice.ExecutionOptimistic}
+	}
+	// A <- B <- C, and A <- D
+	blockA := forkchoice.NodeRef{Root: root(0xa), Slot: 1}
+	blockB := forkchoice.NodeRef{Root: root(0xb), Slot: 2}
+	blockC := forkchoice.NodeRef{Root: root(0xc), Slot: 3}
+	blockD := forkchoice.NodeRef{Root: root(0xd), Slot: 2}
+	for _, b := range []struct {
+		parent forkchoice.Root
+		ref    forkchoice.NodeRef
+		hash   byte
+	}{{root(0), blockA, 0x1a}, {blockA.Root, blockB, 0x1b}, {blockB.Root, blockC, 0x1c}, {blockA.Root, blockD, 0x1d}} {
+		if !fc.ProcessBlock(b.parent, b.ref.Root, b.ref.Slot, 0, 0, 0, 0, optimistic(b.hash)) {
+			t.Fatalf("failed to add block %s", b.ref)
+		}
+	}
+	fc.ProcessAttestation(0, blockC.Root, blockC.Slot)
+	fc.ProcessAttestation(1, blockC.Root, blockC.Slot)
+	fc.ProcessAttestation(2, blockD.Root, blockD.Slot)
+	expectHead := func(expected forkchoice.NodeRef) {
+		t.Helper()
+		head, err := fc.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != expected {
+			t.Fatalf("expected head %s, got %s", expected, head)
+		}
+	}
+	expectStatus := func(blockRoot forkchoice.Root, expected forkchoice.ExecutionStatus) {
+		t.Helper()
+		info, ok := fc.GetExecution(blockRoot)
+		if !ok {
+			t.Fatalf("unknown block %s", blockRoot)
+		}
+		if info.Status != expected {
+			t.Fatalf("expected block %s to be %s, got %s", blockRoot, expected, info.Status)
+		}
+	}
+	expectHead(blockC)
+	expectStatus(root(0), forkchoice.ExecutionIrrelevant)
+
+	// Only the block and its optimistic ancestors become valid
+	if err := fc.OnPayloadValid(blockA.Root); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(blockA.Root, forkchoice.ExecutionValid)
+	expectStatus(blockB.Root, forkchoice.ExecutionOptimistic)
+
+	// The payloads after the latest valid hash are invalid, the head moves to the other fork
+	latestValid := root(0x1a)
+	if err := fc.OnPayloadInvalid(blockC.Root, &latestValid); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(blockA.Root, forkchoice.ExecutionValid)
+	expectStatus(blockB.Root, forkchoice.ExecutionInvalid)
+	expectStatus(blockC.Root, forkchoice.ExecutionInvalid)
+	expectStatus(blockD.Root, forkchoice.ExecutionOptimistic)
+	expectHead(blockD)
+
+	if err := fc.OnPayloadValid(blockB.Root); err == nil {
+		t.Fatal("expected error when marking an invalid payload as valid")
+	}
+	if err := fc.OnPayloadInvalid(root(0), nil); err == nil {
+		t.Fatal("expected error when marking a block without payload as invalid")
+	}
+}
+
+func TestUnrealizedJustification(t *testing.T) {
+	ctx := context.Background()
+	spec := configs.Minimal
+	genesisTime := forkchoice.Timestamp(1000)
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	balances := make([]forkchoice.Gwei, 8)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	getBalances := func() ([]forkchoice.Gwei, error) {
+		return balances, nil
+	}
+	epochTime := func(epoch forkchoice.Epoch) forkchoice.Timestamp {
+		slot, _ := spec.EpochStartSlot(epoch)
+		t, _ := spec.TimeAtSlot(slot, genesisTime)
+		return t
+	}
+	anchor := forkchoice.Checkpoint{Epoch: 1, Root: root(0)}
+	anchorSlot, _ := spec.EpochStartSlot(anchor.Epoch)
+	fc, err := NewProtoForkChoice(spec, genesisTime, anchor, anchor, root(0), anchorSlot, forkchoice.Root{0xff}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fc.OnTick(ctx, epochTime(2)); err != nil {
+		t.Fatal(err)
+	}
+	// Two blocks at the start of epoch 2, A justifies epoch 2 once the epoch is processed.
+	epoch2Slot, _ := spec.EpochStartSlot(2)
+	blockA := forkchoice.NodeRef{Root: root(0xa), Slot: epoch2Slot}
+	blockB := forkchoice.NodeRef{Root: root(0xb), Slot: epoch2Slot}
+	checkpointA := forkchoice.Checkpoint{Epoch: 2, Root: blockA.Root}
+	fc.ProcessBlock(root(0), blockA.Root, blockA.Slot, 1, 1, 2, 1, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(root(0), blockB.Root, blockB.Slot, 1, 1, 1, 1, forkchoice.ExecutionInfo{})
+	if err := fc.UpdateUnrealized(ctx, blockA.Root, blockA.Slot, checkpointA, anchor, getBalances); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Justified() != anchor || fc.UnrealizedJustified() != checkpointA {
+		t.Fatalf("unexpected checkpoints: justified %s, unrealized justified %s", fc.Justified(), fc.UnrealizedJustified())
+	}
+	fc.ProcessAttestation(0, blockA.Root, blockA.Slot)
+	fc.ProcessAttestation(1, blockB.Root, blockB.Slot)
+	fc.ProcessAttestation(2, blockB.Root, blockB.Slot)
+	expectHead := func(expected forkchoice.NodeRef) {
+		t.Helper()
+		head, err := fc.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != expected {
+			t.Fatalf("expected head %s, got %s", expected, head)
+		}
+	}
+	// Within the epoch, the justification of both blocks is the same.
+	expectHead(blockB)
+
+	// At the start of the next epoch, A is pulled up, and B is not viable anymore.
+	if err := fc.OnTick(ctx, epochTime(3)); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Justified() != checkpointA {
+		t.Fatalf("expected justified checkpoint %s, got %s", checkpointA, fc.Justified())
+	}
+	expectHead(blockA)
+
+	// A block of a previous epoch is realized right away.
+	blockC := forkchoice.NodeRef{Root: root(0xc), Slot: epoch2Slot + 1}
+	fc.ProcessBlock(blockA.Root, blockC.Root, blockC.Slot, 1, 1, 2, 2, forkchoice.ExecutionInfo{})
+	if err := fc.UpdateUnrealized(ctx, blockC.Root, blockC.Slot, checkpointA, checkpointA, getBalances); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Finalized() != checkpointA || fc.UnrealizedFinalized() != checkpointA {
+		t.Fatalf("expected finalized checkpoint %s, got %s", checkpointA, fc.Finalized())
+	}
+	// Only C is pulled up to the finalized epoch.
+	expectHead(blockC)
+}
+
+func TestSerializeForkChoice(t *testing.T) {
+	spec := configs.Minimal
+	genesisTime := forkchoice.Timestamp(1000)
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	balances := make([]forkchoice.Gwei, 16)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, genesisTime, genesis, genesis, root(0), 0, forkchoice.Root{}, balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fork at slot 1, a gap slot, and blocks at slot 3 on both sides.
+	fc.ProcessBlock(root(0), root(0xa), 1, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(root(0), root(0xb), 1, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessSlot(root(0xa), 2, 0, 0)
+	fc.ProcessBlock(root(0xa), root(0xc), 3, 0, 0, 0, 0, forkchoice.ExecutionInfo{BlockHash: root(0xcc), Status: forkchoice.ExecutionOptimistic})
+	fc.ProcessBlock(root(0xb), root(0xd), 3, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessAttestation(0, root(0xa), 2)
+	fc.ProcessAttestation(1, root(0xd), 3)
+	fc.ProcessAttestation(2, root(0xd), 3)
+	fc.ProcessEquivocation(2)
+	fc.OnBlockArrival(root(0xc), 3, genesisTime+3*spec.SECONDS_PER_SLOT)
+
+	var buf bytes.Buffer
+	if err := fc.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	restored, err := LoadProtoForkChoice(spec, bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := restored.Serialize(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again.Bytes()) {
+		t.Fatal("restored forkchoice serializes differently")
+	}
+
+	expectSameHead := func() {
+		t.Helper()
+		head, err := fc.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restoredHead, err := restored.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != restoredHead {
+			t.Fatalf("different heads: %s <> %s", head, restoredHead)
+		}
+	}
+	expectSameHead()
+	if restored.ProposerBoost() != fc.ProposerBoost() {
+		t.Fatal("different proposer boost")
+	}
+	if eq := restored.Equivocating(); len(eq) != 1 || eq[0] != 2 {
+		t.Fatalf("unexpected equivocating validators: %v", eq)
+	}
+	// Both continue the same
+	for _, f := range []forkchoice.Forkchoice{fc, restored} {
+		if err := f.OnTick(context.Background(), genesisTime+4*spec.SECONDS_PER_SLOT); err != nil {
+			t.Fatal(err)
+		}
+		f.ProcessAttestation(3, root(0xd), 4)
+	}
+	expectSameHead()
+
+	if _, err := LoadProtoForkChoice(spec, bytes.NewReader(data[:len(data)-1]), nil); err == nil {
+		t.Fatal("expected error on truncated input")
+	}
+	// A graph that does not have the checkpoints or the pin is rejected.
+	if err := fc.SetPin(root(0xd), 3); err != nil {
+		t.Fatal(err)
+	}
+	var pinned bytes.Buffer
+	if err := fc.Serialize(&pinned); err != nil {
+		t.Fatal(err)
+	}
+	loadWith := func(graph forkchoice.ForkchoiceGraph) error {
+		_, err := forkchoice.LoadForkChoice(spec, bytes.NewReader(pinned.Bytes()),
+			func(r io.Reader) (forkchoice.ForkchoiceGraph, error) {
+				if _, err := LoadProtoArray(r, nil); err != nil {
+					return nil, err
+				}
+				return graph, nil
+			},
+			func(r io.Reader) (forkchoice.VoteStore, error) {
+				return LoadProtoVoteStore(spec, r)
+			})
+		return err
+	}
+	if err := loadWith(NewProtoArray(forkchoice.Root{}, root(0x77), 0, 0, 0, nil)); err == nil ||
+		!strings.Contains(err.Error(), "checkpoint") {
+		t.Fatalf("expected error on unknown checkpoints, got %v", err)
+	}
+	if err := loadWith(NewProtoArray(forkchoice.Root{}, root(0), 0, 0, 0, nil)); err == nil ||
+		!strings.Contains(err.Error(), "pin") {
+		t.Fatalf("expected error on unknown pin, got %v", err)
+	}
+	// A corrupt vote count fails on the missing data, instead of allocating for every claimed vote.
+	var corrupt bytes.Buffer
+	if err := binary.Write(&corrupt, binary.LittleEndian, &protoVoteStoreHeader{VoteCount: 1 << 50}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProtoVoteStore(spec, &corrupt); err == nil {
+		t.Fatal("expected error on corrupt vote count")
+	}
+}
+
+func TestExportNodes(t *testing.T) {
+	spec := configs.Minimal
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	balances := make([]forkchoice.Gwei, 8)
+	for i := range balances {
+		balances[i] = spec.MAX_EFFECTIVE_BALANCE
+	}
+	genesis := forkchoice.Checkpoint{Root: root(0)}
+	fc, err := NewProtoForkChoice(spec, 0, genesis, genesis, root(0), 0, root(0xff), balances, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A fork at slot 1, and blocks at slot 3 on both sides, C is the head.
+	fc.ProcessBlock(root(0), root(0xa), 1, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(root(0), root(0xb), 1, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(root(0xa), root(0xc), 3, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessBlock(root(0xb), root(0xd), 3, 0, 0, 0, 0, forkchoice.ExecutionInfo{})
+	fc.ProcessAttestation(0, root(0xc), 3)
+	fc.ProcessAttestation(1, root(0xc), 3)
+	fc.ProcessAttestation(2, root(0xd), 3)
+
+	nodes, err := fc.ExportNodes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byRef := make(map[forkchoice.NodeRef]forkchoice.NodeInfo)
+	for _, n := range nodes {
+		byRef[n.NodeRef] = n
+	}
+	// Every block has an empty slot node before it, and every gap slot has a node.
+	if len(nodes) != 10 || len(byRef) != 10 {
+		t.Fatalf("expected 10 nodes, got %d", len(nodes))
+	}
+	ref := func(r byte, slot forkchoice.Slot) forkchoice.NodeRef {
+		return forkchoice.NodeRef{Root: root(r), Slot: slot}
+	}
+	blockC := byRef[ref(0xc, 3)]
+	if !blockC.Block || !blockC.Canonical || !blockC.Viable || blockC.Weight != 2*forkchoice.SignedGwei(spec.MAX_EFFECTIVE_BALANCE) {
+		t.Fatalf("unexpected node C: %+v", blockC)
+	}
+	if *blockC.TransitionParent != ref(0xa, 3) || *blockC.ForkchoiceParent != ref(0xa, 1) {
+		t.Fatalf("unexpected parents of C: %s, %s", blockC.TransitionParent, blockC.ForkchoiceParent)
+	}
+	if gap := byRef[ref(0xa, 2)]; gap.Block || !gap.Canonical {
+		t.Fatalf("unexpected gap node: %+v", gap)
+	}
+	if !byRef[ref(0, 0)].Block || byRef[ref(0, 0)].TransitionParent != nil {
+		t.Fatal("expected genesis to be the first block node")
+	}
+	if byRef[ref(0xd, 3)].Canonical || byRef[ref(0xb, 1)].Canonical {
+		t.Fatal("expected other fork to not be canonical")
+	}
+	if best := byRef[ref(0, 0)].BestDescendant; best == nil || *best != ref(0xc, 3) {
+		t.Fatalf("unexpected best descendant of genesis: %v", best)
+	}
+
+	window, err := fc.ExportNodes(&forkchoice.SlotRange{Start: 2, End: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(window) != 6 {
+		t.Fatalf("expected 6 nodes in slots 2 and 3, got %d", len(window))
+	}
+
+	var buf bytes.Buffer
+	if err := forkchoice.WriteNodesJSON(&buf, nodes); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []forkchoice.NodeInfo
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, nodes) {
+		t.Fatal("decoded JSON differs from the exported nodes")
+	}
+
+	buf.Reset()
+	if err := forkchoice.WriteNodesDOT(&buf, window); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph forkchoice {") {
+		t.Fatalf("unexpected DOT output:\n%s", dot)
+	}
+	// The edge to the gap node of the same block is included, that to the node before the window is not.
+	if !strings.Contains(dot, fmt.Sprintf("\"%s\" -> \"%s\";", ref(0xc, 3), ref(0xa, 3))) ||
+		strings.Contains(dot, fmt.Sprintf("\"%s\" -> \"%s\" [style=dashed];", ref(0xc, 3), ref(0xa, 1))) {
+		t.Fatalf("unexpected DOT edges:\n%s", dot)
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	blockRoot := func(fork byte, slot forkchoice.Slot) forkchoice.Root {
+		return forkchoice.Root{fork, byte(slot >> 8), byte(slot)}
+	}
+	pr := NewProtoArray(forkchoice.Root{}, blockRoot(1, 0), 0, 0, 0, nil)
+	// A long chain with a gap every 7 slots, and a sparse fork out of it at slot 200.
+	for slot := forkchoice.Slot(1); slot <= 400; slot++ {
+		if slot%7 == 0 {
+			continue
+		}
+		parent := slot - 1
+		if parent%7 == 0 && parent != 0 {
+			parent--
+		}
+		if !pr.ProcessBlock(blockRoot(1, parent), blockRoot(1, slot), slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+			t.Fatalf("failed to add block at slot %d", slot)
+		}
+	}
+	for slot := forkchoice.Slot(205); slot <= 400; slot += 3 {
+		parent := blockRoot(2, slot-3)
+		if slot == 205 {
+			parent = blockRoot(1, 200)
+		}
+		if !pr.ProcessBlock(parent, blockRoot(2, slot), slot, 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+			t.Fatalf("failed to add fork block at slot %d", slot)
+		}
+	}
+	// Walks back one node at a time, to compare the skip-pointer results with.
+	naive := func(root forkchoice.Root, slot forkchoice.Slot) (forkchoice.NodeRef, bool) {
+		for i := pr.indices[forkchoice.NodeRef{Root: root, Slot: pr.blockSlots[root]}]; i != NONE; i = pr.nodes[i].TransitionParent {
+			if pr.nodes[i].Ref.Slot <= slot {
+				return pr.nodes[i].Ref, true
+			}
+		}
+		return forkchoice.NodeRef{}, false
+	}
+	check := func(root forkchoice.Root) {
+		for slot := forkchoice.Slot(0); slot <= 410; slot++ {
+			got, err := pr.Ancestor(root, slot)
+			expected, ok := naive(root, slot)
+			if !ok {
+				if err != AncestorUnknownErr {
+					t.Fatalf("expected unknown ancestor of %s at slot %d, got %s, %v", root, slot, got, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("failed to find ancestor of %s at slot %d: %v", root, slot, err)
+			}
+			if got != expected {
+				t.Fatalf("ancestor of %s at slot %d: expected %s, got %s", root, slot, expected, got)
+			}
+		}
+	}
+	headA := forkchoice.NodeRef{Root: blockRoot(1, 400), Slot: 400}
+	headB := forkchoice.NodeRef{Root: blockRoot(2, 400), Slot: 400}
+	checkCommon := func() {
+		// The fork starts at slot 201, the node before block A 201, shared by both chains.
+		fork := forkchoice.NodeRef{Root: blockRoot(1, 200), Slot: 201}
+		if got, err := pr.CommonAncestor(headA, headB); err != nil || got != fork {
+			t.Fatalf("expected common ancestor %s, got %s, %v", fork, got, err)
+		}
+		if got, err := pr.CommonAncestor(headB, fork); err != nil || got != fork {
+			t.Fatalf("expected ancestor itself %s, got %s, %v", fork, got, err)
+		}
+		blockA := forkchoice.NodeRef{Root: blockRoot(1, 300), Slot: 300}
+		if got, err := pr.CommonAncestor(blockA, headA); err != nil || got != blockA {
+			t.Fatalf("expected ancestor itself %s, got %s, %v", blockA, got, err)
+		}
+	}
+	check(headA.Root)
+	check(headB.Root)
+	checkCommon()
+	if _, err := pr.Ancestor(forkchoice.Root{0xff}, 10); err == nil {
+		t.Fatal("expected unknown block error")
+	}
+
+	// The links are restored after pruning, the pruned ancestors are unknown.
+	if err := pr.OnPrune(context.Background(), blockRoot(1, 100), 100); err != nil {
+		t.Fatal(err)
+	}
+	check(headA.Root)
+	check(headB.Root)
+	checkCommon()
+	if _, err := pr.Ancestor(headA.Root, 50); err != AncestorUnknownErr {
+		t.Fatalf("expected pruned ancestor to be unknown, got %v", err)
+	}
+}
+
+func TestPruneLateFork(t *testing.T) {
+	root := func(i byte) forkchoice.Root {
+		return forkchoice.Root{i}
+	}
+	pruned := make(map[forkchoice.NodeRef]bool)
+	pr := NewProtoArray(root(0xff), root(0), 0, 0, 0, forkchoice.NodeSinkFn(
+		func(ctx context.Context, ref forkchoice.NodeRef, canonical bool) error {
+			pruned[ref] = canonical
+			return nil
+		}))
+	// Chain A at slots 1, 2 and 3, then a fork block X at slot 4 on top of slot 1, inserted after the anchor A3.
+	for i, parent := range []forkchoice.Root{root(0), root(0xa1), root(0xa2)} {
+		if !pr.ProcessBlock(parent, root(0xa1+byte(i)), forkchoice.Slot(i+1), 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+			t.Fatalf("failed to add block %d", i)
+		}
+	}
+	if !pr.ProcessBlock(root(0xa1), root(0xbb), 4, 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+		t.Fatal("failed to add fork block")
+	}
+	if !pr.ProcessBlock(root(0xa3), root(0xa4), 5, 0, 0, 0, 0, forkchoice.ExecutionInfo{}) {
+		t.Fatal("failed to add block on anchor")
+	}
+	if err := pr.OnPrune(context.Background(), root(0xa3), 3); err != nil {
+		t.Fatal(err)
+	}
+	// The fork conflicts with the anchor: it is pruned right away, as non-canonical.
+	for _, ref := range []forkchoice.NodeRef{{Root: root(0xa1), Slot: 4}, {Root: root(0xbb), Slot: 4}} {
+		canonical, ok := pruned[ref]
+		if !ok {
+			t.Fatalf("expected fork node %s to be pruned", ref)
+		}
+		if canonical {
+			t.Fatalf("expected fork node %s to be pruned as non-canonical", ref)
+		}
+	}
+	if !pruned[forkchoice.NodeRef{Root: root(0xa2), Slot: 3}] {
+		t.Fatal("expected node before the anchor to be pruned as canonical")
+	}
+	if _, ok := pr.GetSlot(root(0xbb)); ok {
+		t.Fatal("expected fork block to be unknown")
+	}
+	if _, ok := pr.GetSlot(root(0xa1)); ok {
+		t.Fatal("expected pruned block to be unknown")
+	}
+	// Only the anchor and its descendants remain, with consistent indices.
+	if len(pr.nodes) != 4 || len(pr.indices) != 4 {
+		t.Fatalf("expected 4 remaining nodes, got %d, %d indices", len(pr.nodes), len(pr.indices))
+	}
+	for ref, index := range pr.indices {
+		if pr.nodes[index].Ref != ref {
+			t.Fatalf("index of %s points to %s", ref, pr.nodes[index].Ref)
+		}
+	}
+	if got, err := pr.Ancestor(root(0xa4), 4); err != nil || got != (forkchoice.NodeRef{Root: root(0xa3), Slot: 4}) {
+		t.Fatalf("unexpected ancestor: %s, %v", got, err)
+	}
+}
@@ -0,0 +1,191 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	. "github.com/protolambda/zrnt/eth2/forkchoice"
+	"io"
+	"sort"
+)
+
+// LoadProtoForkChoice restores a ProtoForkChoice with a ProtoArray and ProtoVoteStore,
+// written with Serialize. Pruned nodes go to the given sink.
+func LoadProtoForkChoice(spec *common.Spec, r io.Reader, sink NodeSink) (Forkchoice, error) {
+	return LoadForkChoice(spec, r,
+		func(r io.Reader) (ForkchoiceGraph, error) {
+			return LoadProtoArray(r, sink)
+		},
+		func(r io.Reader) (VoteStore, error) {
+			return LoadProtoVoteStore(spec, r)
+		})
+}
+
+type protoArrayHeader struct {
+	Filter             HeadFilter
+	UpdatedConnections bool
+	ProposerBoost      ProposerBoost
+	NodeCount          uint64
+	BlockSlotCount     uint64
+}
+
+type blockSlot struct {
+	Root Root
+	Slot Slot
+}
+
+// Serialize writes the nodes and the known block slots.
+// The indices are not written, they are restored from the nodes.
+func (pr *ProtoArray) Serialize(w io.Writer) error {
+	header := protoArrayHeader{
+		Filter:             pr.filter,
+		UpdatedConnections: pr.updatedConnections,
+		ProposerBoost:      pr.proposerBoost,
+		NodeCount:          uint64(len(pr.nodes)),
+		BlockSlotCount:     uint64(len(pr.blockSlots)),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, pr.nodes); err != nil {
+		return err
+	}
+	// Sorted, for a deterministic output
+	slots := make([]blockSlot, 0, len(pr.blockSlots))
+	for root, slot := range pr.blockSlots {
+		slots = append(slots, blockSlot{Root: root, Slot: slot})
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return bytes.Compare(slots[i].Root[:], slots[j].Root[:]) < 0
+	})
+	return binary.Write(w, binary.LittleEndian, slots)
+}
+
+// LoadProtoArray reads a ProtoArray written with Serialize. Pruned nodes go to the given sink.
+func LoadProtoArray(r io.Reader, sink NodeSink) (*ProtoArray, error) {
+	var header protoArrayHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.NodeCount == 0 {
+		return nil, fmt.Errorf("invalid node count: %d", header.NodeCount)
+	}
+	if header.BlockSlotCount > header.NodeCount {
+		return nil, fmt.Errorf("more block slots than nodes: %d > %d", header.BlockSlotCount, header.NodeCount)
+	}
+	var nodes []ProtoNode
+	if err := ReadChunked(header.NodeCount, func(n int) error {
+		chunk := make([]ProtoNode, n)
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return err
+		}
+		nodes = append(nodes, chunk...)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read nodes: %v", err)
+	}
+	var slots []blockSlot
+	if err := ReadChunked(header.BlockSlotCount, func(n int) error {
+		chunk := make([]blockSlot, n)
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return err
+		}
+		slots = append(slots, chunk...)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read block slots: %v", err)
+	}
+	pr := &ProtoArray{
+		sink:               sink,
+		filter:             header.Filter,
+		nodes:              nodes,
+		indices:            make(map[NodeRef]NodeIndex, len(nodes)),
+		blockSlots:         make(map[Root]Slot, len(slots)),
+		updatedConnections: header.UpdatedConnections,
+		proposerBoost:      header.ProposerBoost,
+	}
+	valid := func(index NodeIndex) bool {
+		return index == NONE || index < NodeIndex(len(nodes))
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		if !valid(node.TransitionParent) || !valid(node.ForkchoiceParent) ||
+			!valid(node.BestChild) || !valid(node.BestDescendant) || !valid(node.Jump) {
+			return nil, fmt.Errorf("node %d (%s) links to unknown nodes", i, node.Ref)
+		}
+		if _, ok := pr.indices[node.Ref]; ok {
+			return nil, fmt.Errorf("duplicate node %s", node.Ref)
+		}
+		pr.indices[node.Ref] = NodeIndex(i)
+	}
+	for _, s := range slots {
+		if _, ok := pr.indices[NodeRef{Root: s.Root, Slot: s.Slot}]; !ok {
+			return nil, fmt.Errorf("block %s at slot %d has no node", s.Root, s.Slot)
+		}
+		pr.blockSlots[s.Root] = s.Slot
+	}
+	return pr, nil
+}
+
+type protoVoteStoreHeader struct {
+	Changed           bool
+	VoteCount         uint64
+	EquivocatingCount uint64
+}
+
+// Serialize writes the votes and the equivocating validators.
+func (st *ProtoVoteStore) Serialize(w io.Writer) error {
+	header := protoVoteStoreHeader{
+		Changed:           st.changed,
+		VoteCount:         uint64(len(st.votes)),
+		EquivocatingCount: uint64(len(st.equivocating)),
+	}
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, st.votes); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, st.Equivocating())
+}
+
+// LoadProtoVoteStore reads a ProtoVoteStore written with Serialize.
+func LoadProtoVoteStore(spec *common.Spec, r io.Reader) (*ProtoVoteStore, error) {
+	var header protoVoteStoreHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	votes := make([]VoteTracker, 0)
+	if err := ReadChunked(header.VoteCount, func(n int) error {
+		chunk := make([]VoteTracker, n)
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return err
+		}
+		votes = append(votes, chunk...)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read votes: %v", err)
+	}
+	var equivocating []ValidatorIndex
+	if err := ReadChunked(header.EquivocatingCount, func(n int) error {
+		chunk := make([]ValidatorIndex, n)
+		if err := binary.Read(r, binary.LittleEndian, chunk); err != nil {
+			return err
+		}
+		equivocating = append(equivocating, chunk...)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read equivocating validators: %v", err)
+	}
+	st := &ProtoVoteStore{
+		spec:         spec,
+		votes:        votes,
+		changed:      header.Changed,
+		equivocating: make(map[ValidatorIndex]struct{}, len(equivocating)),
+	}
+	for _, index := range equivocating {
+		st.equivocating[index] = struct{}{}
+	}
+	return st, nil
+}
@@ -18,25 +18,26 @@ type ProtoNode struct {
 	TransitionParent NodeIndex
 	// The forkchoice parent of a node is strictly one slot lower, it cannot be the same slot.
 	ForkchoiceParent NodeIndex
+	// The number of transition ancestors of the node that are still in the array.
+	Depth uint64
+	// A transition ancestor to skip to, to find ancestors in a logarithmic number of steps.
+	// NONE for nodes without transition parent.
+	Jump NodeIndex
 	// Duplicated to avoid pruning of this useful info.
 	ParentRoot     Root
 	JustifiedEpoch Epoch
 	FinalizedEpoch Epoch
-	Weight         SignedGwei
+	// The justification and finalization after processing that of the epoch of the node, i.e. "pulled up".
+	// Gap slot nodes inherit it from the node before them.
+	UnrealizedJustifiedEpoch Epoch
+	UnrealizedFinalizedEpoch Epoch
+	Weight                   SignedGwei
 	// Relative to ForkchoiceParent relations
 	BestChild NodeIndex
 	// Relative to ForkchoiceParent relations
 	BestDescendant NodeIndex
-}
-
-type NodeSinkFn func(ctx context.Context, ref NodeRef, canonical bool) error
-
-func (fn NodeSinkFn) OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error {
-	return fn(ctx, ref, canonical)
-}
-
-type NodeSink interface {
-	OnPrunedNode(ctx context.Context, ref NodeRef, canonical bool) error
+	// The execution payload of the block, gap slot nodes share it with the block before them.
+	Execution ExecutionInfo
 }
 
 // Tracks slots and blocks as nodes.
@@ -44,17 +45,18 @@ type NodeSink interface {
 // Gap slots just have a single node.
 // There may be multiple nodes with the same parent but different blocks (i.e. double proposals, but slashable).
 type ProtoArray struct {
-	sink           NodeSink
-	indexOffset    NodeIndex
-	justifiedEpoch Epoch
-	finalizedEpoch Epoch
-	nodes          []ProtoNode
+	sink NodeSink
+	// The justification and finalization that the nodes are filtered by, updated with the scores.
+	filter HeadFilter
+	nodes  []ProtoNode
 	// maintains only nodes that are actually part of the tree starting from finalized point.
 	indices map[NodeRef]NodeIndex
 	// Tracks the first slot at or after the block root that the array knows of.
 	// The lowest slot for a block does not equal the block.slot itself, that may have been pruned.
 	blockSlots         map[Root]Slot
 	updatedConnections bool
+	// The proposer boost that is currently applied to the node weights.
+	proposerBoost ProposerBoost
 }
 
 var _ ForkchoiceGraph = (*ProtoArray)(nil)
@@ -63,9 +65,7 @@ func NewProtoArray(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch E
 	blockRef := NodeRef{Root: blockRoot, Slot: blockSlot}
 	pr := ProtoArray{
 		sink:               sink,
-		indexOffset:        0,
-		justifiedEpoch:     justifiedEpoch,
-		finalizedEpoch:     finalizedEpoch,
+		filter:             HeadFilter{JustifiedEpoch: justifiedEpoch, FinalizedEpoch: finalizedEpoch},
 		nodes:              make([]ProtoNode, 0, 100),
 		indices:            make(map[NodeRef]NodeIndex, 100),
 		blockSlots:         make(map[Root]Slot, 100),
@@ -74,30 +74,50 @@ func NewProtoArray(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch E
 	pr.blockSlots[blockRoot] = blockSlot
 	pr.indices[blockRef] = 0
 	pr.nodes = append(pr.nodes, ProtoNode{
-		Ref:              blockRef,
-		TransitionParent: NONE,
-		ForkchoiceParent: NONE,
-		ParentRoot:       parent,
-		JustifiedEpoch:   justifiedEpoch,
-		FinalizedEpoch:   finalizedEpoch,
-		Weight:           0,
-		BestChild:        NONE,
-		BestDescendant:   NONE,
+		Ref:                      blockRef,
+		TransitionParent:         NONE,
+		ForkchoiceParent:         NONE,
+		Depth:                    0,
+		Jump:                     NONE,
+		ParentRoot:               parent,
+		JustifiedEpoch:           justifiedEpoch,
+		FinalizedEpoch:           finalizedEpoch,
+		UnrealizedJustifiedEpoch: justifiedEpoch,
+		UnrealizedFinalizedEpoch: finalizedEpoch,
+		Weight:                   0,
+		BestChild:                NONE,
+		BestDescendant:           NONE,
 	})
 	return &pr
 }
 
+func (pr *ProtoArray) Copy(sink NodeSink) ForkchoiceGraph {
+	out := &ProtoArray{
+		sink:               sink,
+		filter:             pr.filter,
+		nodes:              make([]ProtoNode, len(pr.nodes), cap(pr.nodes)),
+		indices:            make(map[NodeRef]NodeIndex, len(pr.indices)),
+		blockSlots:         make(map[Root]Slot, len(pr.blockSlots)),
+		updatedConnections: pr.updatedConnections,
+		proposerBoost:      pr.proposerBoost,
+	}
+	copy(out.nodes, pr.nodes)
+	for k, v := range pr.indices {
+		out.indices[k] = v
+	}
+	for k, v := range pr.blockSlots {
+		out.blockSlots[k] = v
+	}
+	return out
+}
+
 var invalidIndexErr = errors.New("invalid index")
 
 func (pr *ProtoArray) getNode(index NodeIndex) (*ProtoNode, error) {
-	if index < pr.indexOffset {
-		return nil, invalidIndexErr
-	}
-	i := index - pr.indexOffset
-	if i > NodeIndex(len(pr.nodes)) {
+	if index >= NodeIndex(len(pr.nodes)) {
 		return nil, invalidIndexErr
 	}
-	return &pr.nodes[i], nil
+	return &pr.nodes[index], nil
 }
 
 func (pr *ProtoArray) Indices() map[NodeRef]NodeIndex {
@@ -113,7 +133,7 @@ func (pr *ProtoArray) CanonicalChain(anchorRoot Root, anchorSlot Slot) ([]Extend
 	}
 	chain := make([]ExtendedNodeRef, 0, len(pr.nodes))
 	index := pr.indices[head]
-	for index != NONE && index >= pr.indexOffset {
+	for index != NONE {
 		node, err := pr.getNode(index)
 		if err != nil {
 			return nil, err
@@ -201,7 +221,7 @@ func (pr *ProtoArray) CanonAtSlot(anchor Root, slot Slot, withBlock bool) (at No
 	// Walk back the canonical chain, and stop as soon as we find the node at slot of interest.
 	index := pr.indices[head]
 	var node *ProtoNode
-	for index != NONE && index >= pr.indexOffset {
+	for index != NONE {
 		node, err = pr.getNode(index)
 		if err != nil {
 			return NodeRef{}, err
@@ -231,6 +251,122 @@ func (pr *ProtoArray) GetSlot(blockRoot Root) (Slot, bool) {
 	return slot, ok
 }
 
+func (pr *ProtoArray) GetExecution(blockRoot Root) (ExecutionInfo, bool) {
+	node, err := pr.blockNode(blockRoot)
+	if err != nil {
+		return ExecutionInfo{}, false
+	}
+	return node.Execution, true
+}
+
+func (pr *ProtoArray) GetWeight(blockRoot Root) (SignedGwei, bool) {
+	node, err := pr.blockNode(blockRoot)
+	if err != nil {
+		return 0, false
+	}
+	return node.Weight, true
+}
+
+func (pr *ProtoArray) GetUnrealized(blockRoot Root) (justifiedEpoch Epoch, finalizedEpoch Epoch, ok bool) {
+	node, err := pr.blockNode(blockRoot)
+	if err != nil {
+		return 0, 0, false
+	}
+	return node.UnrealizedJustifiedEpoch, node.UnrealizedFinalizedEpoch, true
+}
+
+// blockNode returns the first known node of the block.
+func (pr *ProtoArray) blockNode(blockRoot Root) (*ProtoNode, error) {
+	slot, ok := pr.blockSlots[blockRoot]
+	if !ok {
+		return nil, fmt.Errorf("unknown block %s", blockRoot)
+	}
+	return pr.getNode(pr.indices[NodeRef{Root: blockRoot, Slot: slot}])
+}
+
+// setExecutionStatus changes the status of all nodes of the given blocks.
+func (pr *ProtoArray) setExecutionStatus(blocks map[Root]struct{}, status ExecutionStatus) {
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		if _, ok := blocks[node.Ref.Root]; ok {
+			node.Execution.Status = status
+		}
+	}
+}
+
+func (pr *ProtoArray) OnPayloadValid(blockRoot Root) error {
+	node, err := pr.blockNode(blockRoot)
+	if err != nil {
+		return err
+	}
+	if node.Execution.Status == ExecutionInvalid {
+		return fmt.Errorf("block %s has an invalid payload, cannot mark it valid", blockRoot)
+	}
+	valid := make(map[Root]struct{})
+	for {
+		if node.Execution.Status != ExecutionOptimistic {
+			break
+		}
+		valid[node.Ref.Root] = struct{}{}
+		if node.ForkchoiceParent == NONE {
+			break
+		}
+		node = &pr.nodes[node.ForkchoiceParent]
+	}
+	pr.setExecutionStatus(valid, ExecutionValid)
+	return nil
+}
+
+func (pr *ProtoArray) OnPayloadInvalid(blockRoot Root, latestValidHash *Root) error {
+	node, err := pr.blockNode(blockRoot)
+	if err != nil {
+		return err
+	}
+	switch node.Execution.Status {
+	case ExecutionIrrelevant:
+		return fmt.Errorf("block %s has no payload, cannot mark it invalid", blockRoot)
+	case ExecutionValid:
+		return fmt.Errorf("block %s has a valid payload, cannot mark it invalid", blockRoot)
+	}
+	invalid := map[Root]struct{}{blockRoot: {}}
+	if latestValidHash != nil {
+		// The optimistic ancestors after the latest valid payload are invalid too,
+		// if the latest valid payload is found. Otherwise the latest valid hash is not trusted.
+		var between []Root
+		for i := node.ForkchoiceParent; i != NONE; i = pr.nodes[i].ForkchoiceParent {
+			ancestor := &pr.nodes[i]
+			if *latestValidHash != (Root{}) && ancestor.Execution.BlockHash == *latestValidHash {
+				if err := pr.OnPayloadValid(ancestor.Ref.Root); err != nil {
+					return err
+				}
+				for _, root := range between {
+					invalid[root] = struct{}{}
+				}
+				break
+			}
+			if ancestor.Execution.Status != ExecutionOptimistic {
+				if *latestValidHash == (Root{}) {
+					for _, root := range between {
+						invalid[root] = struct{}{}
+					}
+				}
+				break
+			}
+			between = append(between, ancestor.Ref.Root)
+		}
+	}
+	pr.setExecutionStatus(invalid, ExecutionInvalid)
+	// Descendants are always after their transition parent in the array, a single pass invalidates all of them.
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		if node.TransitionParent != NONE && pr.nodes[node.TransitionParent].Execution.Status == ExecutionInvalid {
+			node.Execution.Status = ExecutionInvalid
+		}
+	}
+	pr.updatedConnections = false
+	return nil
+}
+
 // Searches the available nodes for blocks with a matching parent root and/or matching slot.
 // If no options are specified, the
 func (pr *ProtoArray) Search(anchor NodeRef, parentRoot *Root, slot *Slot) (nonCanon []NodeRef, canon []NodeRef, err error) {
@@ -295,26 +431,39 @@ var lengthMismatchErr = errors.New("length mismatch")
 // - Compare the current node with the parents best-child, updating it if the current node
 // should become the best child.
 // - If required, update the parents best-descendant with the current node or its best-descendant.
-func (pr *ProtoArray) ApplyScoreChanges(deltas []SignedGwei, justifiedEpoch Epoch, finalizedEpoch Epoch) error {
+//
+// The previously applied proposer boost is removed, and the given boost is applied,
+// as delta to the boosted node, which back-propagates like the vote deltas.
+func (pr *ProtoArray) ApplyScoreChanges(deltas []SignedGwei, boost ProposerBoost, filter HeadFilter) error {
 	if len(deltas) != len(pr.nodes) {
 		return lengthMismatchErr
 	}
-	if justifiedEpoch != pr.justifiedEpoch || finalizedEpoch != pr.finalizedEpoch {
-		pr.justifiedEpoch = justifiedEpoch
-		pr.finalizedEpoch = finalizedEpoch
+	// The previous boosted node may have been pruned, then there is nothing to remove.
+	if index, ok := pr.indices[pr.proposerBoost.Ref]; ok && pr.proposerBoost.Ref != (NodeRef{}) {
+		deltas[index] -= pr.proposerBoost.Score
 	}
+	pr.proposerBoost = ProposerBoost{}
+	if index, ok := pr.indices[boost.Ref]; ok && boost.Ref != (NodeRef{}) {
+		deltas[index] += boost.Score
+		pr.proposerBoost = boost
+	}
+	pr.filter = filter
 	for i := len(pr.nodes) - 1; i >= 0; i-- {
 		delta := deltas[i]
 		node := &pr.nodes[i]
+		// Invalid nodes do not count: their weight is removed from the ancestors, and new votes are ignored.
+		if node.Execution.Status == ExecutionInvalid {
+			delta = -node.Weight
+		}
 		node.Weight += delta
 		if node.ForkchoiceParent != NONE {
-			deltas[node.ForkchoiceParent-pr.indexOffset] += delta
+			deltas[node.ForkchoiceParent] += delta
 		}
 	}
 	for i := len(pr.nodes) - 1; i >= 0; i-- {
 		node := &pr.nodes[i]
 		if node.ForkchoiceParent != NONE {
-			if err := pr.maybeUpdateBestChildAndDescendant(node.ForkchoiceParent, pr.indexOffset+NodeIndex(i)); err != nil {
+			if err := pr.maybeUpdateBestChildAndDescendant(node.ForkchoiceParent, NodeIndex(i)); err != nil {
 				return err
 			}
 		}
@@ -327,7 +476,7 @@ func (pr *ProtoArray) updateConnections() error {
 	for i := len(pr.nodes) - 1; i >= 0; i-- {
 		node := &pr.nodes[i]
 		if node.ForkchoiceParent != NONE {
-			if err := pr.maybeUpdateBestChildAndDescendant(node.ForkchoiceParent, pr.indexOffset+NodeIndex(i)); err != nil {
+			if err := pr.maybeUpdateBestChildAndDescendant(node.ForkchoiceParent, NodeIndex(i)); err != nil {
 				return err
 			}
 		}
@@ -348,9 +497,20 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 		return
 	}
 	parentIndex := NONE
+	var execution ExecutionInfo
+	unrealizedJustifiedEpoch, unrealizedFinalizedEpoch := justifiedEpoch, finalizedEpoch
 	parentSlot, ok := pr.blockSlots[parent]
 	if ok {
 		parentIndex = pr.indices[NodeRef{Root: parent, Slot: parentSlot}]
+		parentNode := &pr.nodes[parentIndex]
+		execution = parentNode.Execution
+		// Without blocks, the unrealized justification and finalization of the parent can only be realized.
+		if parentNode.UnrealizedJustifiedEpoch > unrealizedJustifiedEpoch {
+			unrealizedJustifiedEpoch = parentNode.UnrealizedJustifiedEpoch
+		}
+		if parentNode.UnrealizedFinalizedEpoch > unrealizedFinalizedEpoch {
+			unrealizedFinalizedEpoch = parentNode.UnrealizedFinalizedEpoch
+		}
 		for i := parentSlot + 1; i < slot; i++ {
 			nodeRef := NodeRef{Root: parent, Slot: i}
 			// remember the last node before (up to and including same slot)
@@ -361,36 +521,48 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 				continue
 			}
 			// No node to represent space between parent slot and new slot yet, so we add it.
-			nodeIndex = pr.indexOffset + NodeIndex(len(pr.nodes))
+			nodeIndex = NodeIndex(len(pr.nodes))
 			pr.indices[nodeRef] = nodeIndex
+			depth, jump := pr.jumpLinks(parentIndex)
 			pr.nodes = append(pr.nodes, ProtoNode{
-				Ref:              nodeRef,
-				TransitionParent: parentIndex,
-				ForkchoiceParent: parentIndex,
-				ParentRoot:       parent,
-				JustifiedEpoch:   justifiedEpoch,
-				FinalizedEpoch:   finalizedEpoch,
-				Weight:           0,
-				BestChild:        NONE,
-				BestDescendant:   NONE,
+				Ref:                      nodeRef,
+				TransitionParent:         parentIndex,
+				ForkchoiceParent:         parentIndex,
+				Depth:                    depth,
+				Jump:                     jump,
+				ParentRoot:               parent,
+				JustifiedEpoch:           justifiedEpoch,
+				FinalizedEpoch:           finalizedEpoch,
+				UnrealizedJustifiedEpoch: unrealizedJustifiedEpoch,
+				UnrealizedFinalizedEpoch: unrealizedFinalizedEpoch,
+				Weight:                   0,
+				BestChild:                NONE,
+				BestDescendant:           NONE,
+				Execution:                execution,
 			})
 			// remember the node as parent for the next
 			parentIndex = nodeIndex
 		}
 	}
 	// Add the node for the slot
-	nodeIndex := pr.indexOffset + NodeIndex(len(pr.nodes))
+	nodeIndex := NodeIndex(len(pr.nodes))
 	pr.indices[nodeRef] = nodeIndex
+	depth, jump := pr.jumpLinks(parentIndex)
 	pr.nodes = append(pr.nodes, ProtoNode{
-		Ref:              nodeRef,
-		TransitionParent: parentIndex,
-		ForkchoiceParent: parentIndex,
-		ParentRoot:       parent,
-		JustifiedEpoch:   justifiedEpoch,
-		FinalizedEpoch:   finalizedEpoch,
-		Weight:           0,
-		BestChild:        NONE,
-		BestDescendant:   NONE,
+		Ref:                      nodeRef,
+		TransitionParent:         parentIndex,
+		ForkchoiceParent:         parentIndex,
+		Depth:                    depth,
+		Jump:                     jump,
+		ParentRoot:               parent,
+		JustifiedEpoch:           justifiedEpoch,
+		FinalizedEpoch:           finalizedEpoch,
+		UnrealizedJustifiedEpoch: unrealizedJustifiedEpoch,
+		UnrealizedFinalizedEpoch: unrealizedFinalizedEpoch,
+		Weight:                   0,
+		BestChild:                NONE,
+		BestDescendant:           NONE,
+		Execution:                execution,
 	})
 	// Connections are out of sync, i.e. array needs work before next find-head can return the proper head.
 	pr.updatedConnections = false
@@ -400,7 +572,9 @@ func (pr *ProtoArray) ProcessSlot(parent Root, slot Slot, justifiedEpoch Epoch,
 // If justified or finalized in-between, make sure to call OnSlot with accurate details first.
 //
 // The parent root of the genesis block should be zeroed.
-func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch) (ok bool) {
+// A block that builds on an invalid execution payload is invalid as well.
+func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot, justifiedEpoch Epoch, finalizedEpoch Epoch,
+	unrealizedJustifiedEpoch Epoch, unrealizedFinalizedEpoch Epoch, execution ExecutionInfo) (ok bool) {
 	blockRef := NodeRef{Root: blockRoot, Slot: blockSlot}
 	// If the block is already known, simply ignore it.
 	if _, ok := pr.indices[blockRef]; ok {
@@ -428,19 +602,35 @@ func (pr *ProtoArray) ProcessBlock(parent Root, blockRoot Root, blockSlot Slot,
 	if !ok {
 		panic("OnSlot failed to add node for block slot (transition parent)")
 	}
-	nodeIndex := pr.indexOffset + NodeIndex(len(pr.nodes))
+	if pr.nodes[transitionParentIndex].Execution.Status == ExecutionInvalid {
+		execution.Status = ExecutionInvalid
+	}
+	// Processing the justification of the epoch cannot undo the justification or finalization.
+	if unrealizedJustifiedEpoch < justifiedEpoch {
+		unrealizedJustifiedEpoch = justifiedEpoch
+	}
+	if unrealizedFinalizedEpoch < finalizedEpoch {
+		unrealizedFinalizedEpoch = finalizedEpoch
+	}
+	nodeIndex := NodeIndex(len(pr.nodes))
 	pr.blockSlots[blockRoot] = blockSlot
 	pr.indices[blockRef] = nodeIndex
+	depth, jump := pr.jumpLinks(transitionParentIndex)
 	pr.nodes = append(pr.nodes, ProtoNode{
-		Ref:              blockRef,
-		TransitionParent: transitionParentIndex,
-		ForkchoiceParent: forkchoiceParentIndex,
-		ParentRoot:       parent,
-		JustifiedEpoch:   justifiedEpoch,
-		FinalizedEpoch:   finalizedEpoch,
-		Weight:           0,
-		BestChild:        NONE,
-		BestDescendant:   NONE,
+		Ref:                      blockRef,
+		TransitionParent:         transitionParentIndex,
+		ForkchoiceParent:         forkchoiceParentIndex,
+		Depth:                    depth,
+		Jump:                     jump,
+		ParentRoot:               parent,
+		JustifiedEpoch:           justifiedEpoch,
+		FinalizedEpoch:           finalizedEpoch,
+		UnrealizedJustifiedEpoch: unrealizedJustifiedEpoch,
+		UnrealizedFinalizedEpoch: unrealizedFinalizedEpoch,
+		Weight:                   0,
+		BestChild:                NONE,
+		BestDescendant:           NONE,
+		Execution:                execution,
 	})
 	// Connections are out of sync, i.e. array needs work before next find-head can return the proper head.
 	pr.updatedConnections = false
@@ -475,7 +665,8 @@ func (pr *ProtoArray) FindHead(anchorRoot Root, anchorSlot Slot) (NodeRef, error
 	}
 	bestDescIndex := anchorNode.BestDescendant
 	if bestDescIndex == NONE {
-		bestDescIndex = anchorIndex
+		// Without viable descendants, the anchor itself is the head.
+		return anchorNode.Ref, nil
 	}
 	bestNode, err := pr.getNode(bestDescIndex)
 	if err != nil {
@@ -563,15 +754,11 @@ func (pr *ProtoArray) inSubtree(anchorIndex NodeIndex, lookupIndex NodeIndex) (u
 
 var HeadUnknownErr = errors.New("array has invalid state, head has no index")
 
-type prunedNode struct {
-	canonical bool
-	node      *ProtoNode
-}
-
 // Update the tree with new finalization information (or alternatively another trusted root and slot)
 // The slot may point to a gap slot,
 // in which case the node with the anchor block of the anchor block-root is pruned,
 // and the next nodes, up to (and excl.) the anchorSlot.
+// Nodes that do not descend from the anchor are pruned too, also when they were inserted after it.
 func (pr *ProtoArray) OnPrune(ctx context.Context, anchorRoot Root, anchorSlot Slot) error {
 	anchorRef := NodeRef{Root: anchorRoot, Slot: anchorSlot}
 	anchorIndex, ok := pr.indices[anchorRef]
@@ -579,48 +766,93 @@ func (pr *ProtoArray) OnPrune(ctx context.Context, anchorRoot Root, anchorSlot S
 		// if the anchor is unknown, then there is nothing to prune anyway.
 		return nil
 	}
-	if anchorIndex == pr.indexOffset {
+	// The canonical nodes are the transition ancestors of the anchor.
+	canonical := make(map[NodeIndex]struct{})
+	for i := pr.nodes[anchorIndex].TransitionParent; i != NONE; i = pr.nodes[i].TransitionParent {
+		canonical[i] = struct{}{}
+	}
+	// Only the anchor and its descendants are kept. Parents come before their children,
+	// so a single pass finds every descendant, including those of branches inserted after the anchor.
+	keep := make([]bool, len(pr.nodes))
+	keep[anchorIndex] = true
+	var pruned []NodeIndex
+	for i := range pr.nodes {
+		if i > int(anchorIndex) {
+			if parent := pr.nodes[i].TransitionParent; parent != NONE && keep[parent] {
+				keep[i] = true
+			}
+		}
+		if !keep[i] {
+			pruned = append(pruned, NodeIndex(i))
+		}
+	}
+	if len(pruned) == 0 {
 		// nothing to do
 		return nil
 	}
-	// Get the head, it will help quickly determine if pruned nodes are canonical
-	head, err := pr.FindHead(anchorRoot, anchorSlot)
-	if err != nil {
-		return err
+	// Send pruned nodes to the node sink (if any). Continue until it fails.
+	// Only prune what we sucessfully sent to the sink.
+	var err error
+	prunedUpTo := 0
+	for _, i := range pruned {
+		if pr.sink != nil {
+			_, isCanon := canonical[i]
+			if err = pr.sink.OnPrunedNode(ctx, pr.nodes[i].Ref, isCanon); err != nil {
+				break
+			}
+		}
+		prunedUpTo++
 	}
-	headIndex, ok := pr.indices[head]
-	if !ok {
-		return HeadUnknownErr
+	// Compute the new index of every node, or NONE if it is pruned.
+	remap := make([]NodeIndex, len(pr.nodes))
+	for _, i := range pruned[:prunedUpTo] {
+		remap[i] = NONE
 	}
-	// Remove the `self.indices` and `self.blockSlots` key/values for all the to-be-deleted nodes.
-	j := 0
-	var pruned []prunedNode
-	for i := pr.indexOffset; i < anchorIndex; i++ {
-		node := &pr.nodes[j]
-		if pr.sink != nil {
-			canonical := node.BestDescendant == headIndex
-			pruned = append(pruned, prunedNode{canonical, node})
+	next := NodeIndex(0)
+	for i := range remap {
+		if remap[i] != NONE {
+			remap[i] = next
+			next++
 		}
 	}
-	// Send pruned nodes to the node sink (empty if no sink). Continue until it fails.
-	// Only prune what we sucessfully sent to the sink.
-	prunedUpTo := 0
-	for _, p := range pruned {
-		if err = pr.sink.OnPrunedNode(ctx, p.node.Ref, p.canonical); err != nil {
-			break
+	shift := func(index NodeIndex) NodeIndex {
+		if index == NONE {
+			return NONE
 		}
-		prunedUpTo++
+		return remap[index]
+	}
+	// Move the remaining nodes to the front, and unlink them from pruned nodes.
+	remaining := pr.nodes[:0]
+	for i := range pr.nodes {
+		if remap[i] == NONE {
+			delete(pr.indices, pr.nodes[i].Ref)
+			continue
+		}
+		node := pr.nodes[i]
+		node.TransitionParent = shift(node.TransitionParent)
+		node.ForkchoiceParent = shift(node.ForkchoiceParent)
+		node.BestChild = shift(node.BestChild)
+		node.BestDescendant = shift(node.BestDescendant)
+		remaining = append(remaining, node)
+	}
+	pr.nodes = remaining
+	// Parents come before their children, so the links of the parent are already updated.
+	for i := range pr.nodes {
+		node := &pr.nodes[i]
+		node.Depth, node.Jump = pr.jumpLinks(node.TransitionParent)
+	}
+	for ref, index := range pr.indices {
+		pr.indices[ref] = remap[index]
 	}
-	// adjust the slot we know for the anchor root, everything before it was pruned.
-	pr.blockSlots[anchorRoot] = anchorSlot
-	for _, p := range pruned[:prunedUpTo] {
-		delete(pr.indices, p.node.Ref)
-		// Remove the block-slots ref
-		delete(pr.blockSlots, p.node.Ref.Root)
-		// TODO: is this slicing bad for GC?
-		pr.nodes = pr.nodes[1:]
-		// update offset
-		pr.indexOffset++
+	// The slot known for a block root is the first remaining slot, the slots of the anchor root before it were pruned.
+	for root := range pr.blockSlots {
+		delete(pr.blockSlots, root)
+	}
+	for i := range pr.nodes {
+		ref := pr.nodes[i].Ref
+		if slot, ok := pr.blockSlots[ref.Root]; !ok || ref.Slot < slot {
+			pr.blockSlots[ref.Root] = ref.Slot
+		}
 	}
 	return err
 }
@@ -732,7 +964,23 @@ func (pr *ProtoArray) nodeLeadsToViableHead(node *ProtoNode) (bool, error) {
 //https://github.com/ethereum/eth2.0-specs/blob/v0.11.1/specs/phase0/fork-choice.md#filter_block_tree
 //
 //Any node that has a different finalized or justified epoch should not be viable for the head.
+//Nodes of previous epochs are pulled up: their unrealized justification and finalization is used instead.
+//If the previous epoch is justified, nodes that are pulled up to it remain viable,
+//unless their justification is older than two epochs.
+//Nodes with an invalid execution payload are not viable either.
 func (pr *ProtoArray) isNodeViableForHead(node *ProtoNode) bool {
-	return (node.JustifiedEpoch == pr.justifiedEpoch || pr.justifiedEpoch == common.GENESIS_EPOCH) &&
-		(node.FinalizedEpoch == pr.finalizedEpoch || pr.finalizedEpoch == common.GENESIS_EPOCH)
+	if node.Execution.Status == ExecutionInvalid {
+		return false
+	}
+	f := &pr.filter
+	justified, finalized := node.JustifiedEpoch, node.FinalizedEpoch
+	if node.Ref.Slot < f.CurrentEpochStart {
+		justified, finalized = node.UnrealizedJustifiedEpoch, node.UnrealizedFinalizedEpoch
+	}
+	correctJustified := justified == f.JustifiedEpoch || f.JustifiedEpoch == common.GENESIS_EPOCH
+	if !correctJustified && f.JustifiedEpoch+1 == f.CurrentEpoch {
+		correctJustified = node.UnrealizedJustifiedEpoch >= f.JustifiedEpoch && justified+2 >= f.CurrentEpoch
+	}
+	correctFinalized := finalized == f.FinalizedEpoch || f.FinalizedEpoch == common.GENESIS_EPOCH
+	return correctJustified && correctFinalized
 }
@@ -3,6 +3,7 @@ package proto
 import (
 	"github.com/protolambda/zrnt/eth2/beacon/common"
 	. "github.com/protolambda/zrnt/eth2/forkchoice"
+	"sort"
 )
 
 type VoteTracker struct {
@@ -16,16 +17,21 @@ type ProtoVoteStore struct {
 	spec    *common.Spec
 	votes   []VoteTracker
 	changed bool
+	// Validators whose weight is removed, and whose votes are ignored.
+	equivocating map[ValidatorIndex]struct{}
 }
 
 var _ VoteStore = (*ProtoVoteStore)(nil)
 
 func NewProtoVoteStore(spec *common.Spec) VoteStore {
-	return &ProtoVoteStore{spec: spec, changed: true}
+	return &ProtoVoteStore{spec: spec, changed: true, equivocating: make(map[ValidatorIndex]struct{})}
 }
 
 // Process an attestation. (Note that the head slot may be for a gap slot after the block root)
-func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool) {
+func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Root, headSlot Slot) (ok bool, changed bool) {
+	if _, ok := st.equivocating[index]; ok {
+		return true, false
+	}
 	if index >= ValidatorIndex(len(st.votes)) {
 		if index < ValidatorIndex(cap(st.votes)) {
 			st.votes = st.votes[:index+1]
@@ -41,11 +47,45 @@ func (st *ProtoVoteStore) ProcessAttestation(index ValidatorIndex, blockRoot Roo
 		vote.NextTargetEpoch = targetEpoch
 		vote.Next = NodeRef{Root: blockRoot, Slot: headSlot}
 		st.changed = true
+		changed = true
+	}
+	return true, changed
+}
+
+// ProcessEquivocation marks the validator as equivocating, the weight is removed with the next deltas.
+func (st *ProtoVoteStore) ProcessEquivocation(index ValidatorIndex) (changed bool) {
+	if _, ok := st.equivocating[index]; ok {
+		return false
 	}
-	// TODO: maybe help detect slashable votes on the fly?
+	st.equivocating[index] = struct{}{}
+	st.changed = true
 	return true
 }
 
+func (st *ProtoVoteStore) Equivocating() []ValidatorIndex {
+	out := make([]ValidatorIndex, 0, len(st.equivocating))
+	for index := range st.equivocating {
+		out = append(out, index)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i] < out[j]
+	})
+	return out
+}
+
+func (st *ProtoVoteStore) Copy() VoteStore {
+	equivocating := make(map[ValidatorIndex]struct{}, len(st.equivocating))
+	for index := range st.equivocating {
+		equivocating[index] = struct{}{}
+	}
+	return &ProtoVoteStore{
+		spec:         st.spec,
+		votes:        append(make([]VoteTracker, 0, cap(st.votes)), st.votes...),
+		changed:      st.changed,
+		equivocating: equivocating,
+	}
+}
+
 func (st *ProtoVoteStore) HasChanges() bool {
 	return st.changed
 }
@@ -63,6 +103,15 @@ func (st *ProtoVoteStore) ComputeDeltas(indices map[NodeRef]NodeIndex, oldBalanc
 			continue
 		}
 
+		// The weight of equivocating validators is removed once, the vote is cleared to not remove it again.
+		if _, ok := st.equivocating[ValidatorIndex(i)]; ok {
+			if currentIndex, ok := indices[vote.Current]; ok && i < len(oldBalances) {
+				deltas[currentIndex] -= SignedGwei(oldBalances[i])
+			}
+			*vote = VoteTracker{}
+			continue
+		}
+
 		// Validator sets may have different sizes (but attesters are not different, activation only under finality)
 		oldBal := Gwei(0)
 		if i < len(oldBalances) {
@@ -0,0 +1,128 @@
+// Package chaintest provides the validators, genesis state and blocks that the chain tests build on.
+package chaintest
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/configs"
+	"github.com/protolambda/ztyp/tree"
+)
+
+const ValidatorCount = 64
+
+// Keys are deterministic secret keys of the test validators, usable to sign blocks and attestations.
+var Keys = func() []*blsu.SecretKey {
+	out := make([]*blsu.SecretKey, ValidatorCount)
+	for i := range out {
+		var raw [32]byte
+		binary.BigEndian.PutUint64(raw[24:], uint64(i)+1)
+		var sk blsu.SecretKey
+		if err := sk.Deserialize(&raw); err != nil {
+			panic(err)
+		}
+		out[i] = &sk
+	}
+	return out
+}()
+
+// Spec is the minimal spec, with Altair at epoch 1 and Bellatrix at epoch 2.
+func Spec() *common.Spec {
+	spec := *configs.Minimal
+	spec.ALTAIR_FORK_EPOCH = 1
+	spec.BELLATRIX_FORK_EPOCH = 2
+	return &spec
+}
+
+// Genesis creates a phase0 genesis state with the test validators.
+func Genesis(t testing.TB, spec *common.Spec) *phase0.BeaconStateView {
+	validators := make([]phase0.KickstartValidatorData, 0, len(Keys))
+	for i, sk := range Keys {
+		pub, err := blsu.SkToPk(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withdrawalCred := common.Root{0xbb}
+		binary.LittleEndian.PutUint64(withdrawalCred[1:], uint64(i))
+		validators = append(validators, phase0.KickstartValidatorData{
+			Pubkey:                pub.Serialize(),
+			WithdrawalCredentials: withdrawalCred,
+			Balance:               spec.MAX_EFFECTIVE_BALANCE,
+		})
+	}
+	state, _, err := phase0.KickStartState(spec, common.Root{123}, 1564000000, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// Sign signs the signing root with the key of the given test validator.
+func Sign(t testing.TB, index common.ValidatorIndex, signingRoot common.Root) common.BLSSignature {
+	if uint64(index) >= uint64(len(Keys)) {
+		t.Fatalf("no test key for validator %d", index)
+	}
+	return blsu.Sign(Keys[index], signingRoot[:]).Serialize()
+}
+
+// PreState is the chain entry that a block is built on, at the slot of the block.
+type PreState interface {
+	State(ctx context.Context) (common.BeaconState, error)
+	EpochsContext(ctx context.Context) (*common.EpochsContext, error)
+}
+
+// Block builds a signed phase0 block on top of the given parent block, from the state of the parent at the block slot.
+// The graffiti can be used to produce different blocks for the same slot and parent.
+func Block(t testing.TB, spec *common.Spec, pre PreState, parent common.Root, slot common.Slot, graffiti byte) *common.BeaconBlockEnvelope {
+	ctx := context.Background()
+	state, err := pre.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epc, err := pre.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposer, err := epc.GetBeaconProposer(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth1Data, err := state.Eth1Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork, err := state.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot, err := state.GenesisValidatorsRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := spec.SlotToEpoch(slot)
+	randaoDom := common.ComputeDomain(common.DOMAIN_RANDAO, fork.CurrentVersion, genesisValRoot)
+	block := &phase0.SignedBeaconBlock{
+		Message: phase0.BeaconBlock{
+			Slot:          slot,
+			ProposerIndex: proposer,
+			ParentRoot:    parent,
+			Body: phase0.BeaconBlockBody{
+				RandaoReveal: Sign(t, proposer, common.ComputeSigningRoot(epoch.HashTreeRoot(tree.GetHashFn()), randaoDom)),
+				Eth1Data:     eth1Data,
+				Graffiti:     common.Root{graffiti},
+			},
+		},
+	}
+	digest := common.ComputeForkDigest(fork.CurrentVersion, genesisValRoot)
+	if err := state.ProcessBlock(ctx, spec, epc, block.Envelope(spec, digest)); err != nil {
+		t.Fatal(err)
+	}
+	block.Message.StateRoot = state.HashTreeRoot(tree.GetHashFn())
+	proposerDom := common.ComputeDomain(common.DOMAIN_BEACON_PROPOSER, fork.CurrentVersion, genesisValRoot)
+	block.Signature = Sign(t, proposer, common.ComputeSigningRoot(block.Message.HashTreeRoot(spec, tree.GetHashFn()), proposerDom))
+	return block.Envelope(spec, digest)
+}
@@ -0,0 +1,418 @@
+package produce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/bellatrix"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/pool"
+	"github.com/protolambda/ztyp/tree"
+)
+
+// Pools are the sources of the operations to include in a block. Nil pools are skipped.
+type Pools struct {
+	Attestations      *pool.AttestationPool
+	AttesterSlashings *pool.AttesterSlashingPool
+	ProposerSlashings *pool.ProposerSlashingPool
+	VoluntaryExits    *pool.VoluntaryExitPool
+}
+
+// BlockInputs are the block contents that are not derived from the chain or the pools.
+type BlockInputs struct {
+	Slot common.Slot
+	// ParentRoot is the block to build on, the head of the chain if zero.
+	ParentRoot common.Root
+	// RandaoReveal is the signature of the proposer over the epoch of the slot.
+	RandaoReveal common.BLSSignature
+	Graffiti     common.Root
+	// Eth1Data is the eth1 vote of the block.
+	Eth1Data common.Eth1Data
+	// Deposits are the pending deposits, in order, starting at the deposit index of the state.
+	// Only the deposits required by the spec are included, and it is an error to provide too few.
+	Deposits []common.Deposit
+	// SyncAggregate is included in Altair and later blocks. An empty aggregate is used if nil.
+	SyncAggregate *altair.SyncAggregate
+	// ExecutionPayload is included in Bellatrix blocks.
+	// If nil, an empty payload is used, which is only valid before the merge transition is completed.
+	ExecutionPayload *common.ExecutionPayload
+}
+
+// Result is a produced block, ready for signing.
+type Result struct {
+	// Block is the unsigned block: a *phase0.BeaconBlock, *altair.BeaconBlock or *bellatrix.BeaconBlock.
+	Block      common.SpecObj
+	BlockRoot  common.Root
+	ForkDigest common.ForkDigest
+	// Domain is the proposer signature domain of the block.
+	Domain common.BLSDomain
+	// PostState is the state after processing the block.
+	PostState common.BeaconState
+}
+
+// SigningRoot is the root to sign by the proposer of the block.
+func (r *Result) SigningRoot() common.Root {
+	return common.ComputeSigningRoot(r.BlockRoot, r.Domain)
+}
+
+// Signed combines the block with the proposer signature, as envelope to add to the chain or to publish.
+func (r *Result) Signed(spec *common.Spec, sig common.BLSSignature) *common.BeaconBlockEnvelope {
+	switch b := r.Block.(type) {
+	case *phase0.BeaconBlock:
+		return (&phase0.SignedBeaconBlock{Message: *b, Signature: sig}).Envelope(spec, r.ForkDigest)
+	case *altair.BeaconBlock:
+		return (&altair.SignedBeaconBlock{Message: *b, Signature: sig}).Envelope(spec, r.ForkDigest)
+	case *bellatrix.BeaconBlock:
+		return (&bellatrix.SignedBeaconBlock{Message: *b, Signature: sig}).Envelope(spec, r.ForkDigest)
+	default:
+		panic(fmt.Errorf("unexpected block type %T", r.Block))
+	}
+}
+
+// Producer assembles blocks on top of the chain, with operations from the pools.
+type Producer struct {
+	Spec  *common.Spec
+	Chain chain.FullChain
+	Pools Pools
+}
+
+func NewProducer(spec *common.Spec, ch chain.FullChain, pools Pools) *Producer {
+	return &Producer{Spec: spec, Chain: ch, Pools: pools}
+}
+
+// operations are the operations selected for a block.
+type operations struct {
+	proposerSlashings phase0.ProposerSlashings
+	attesterSlashings phase0.AttesterSlashings
+	attestations      phase0.Attestations
+	deposits          phase0.Deposits
+	voluntaryExits    phase0.VoluntaryExits
+}
+
+// ProduceBlock assembles an unsigned block of the fork of the slot.
+// Operations are only included if they are valid on top of the operations before them,
+// up to the maximum of the spec. Pool operations are not removed from the pools.
+// The state root is computed by processing the block, without modifying the chain.
+func (p *Producer) ProduceBlock(ctx context.Context, in *BlockInputs) (*Result, error) {
+	parent := in.ParentRoot
+	if parent == (common.Root{}) {
+		head, err := p.Chain.Head()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get chain head: %v", err)
+		}
+		parent = head.BlockRoot()
+	}
+	pre, err := p.Chain.Towards(ctx, parent, in.Slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process slots of parent %s up to slot %d: %v", parent, in.Slot, err)
+	}
+	if pre.Step() != chain.AsStep(in.Slot, false) || pre.BlockRoot() != parent {
+		return nil, fmt.Errorf("cannot build on parent %s at slot %d, closest entry is %s at step %s",
+			parent, in.Slot, pre.BlockRoot(), pre.Step())
+	}
+	state, err := pre.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	epc, err := pre.EpochsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	proposer, err := epc.GetBeaconProposer(in.Slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proposer of slot %d: %v", in.Slot, err)
+	}
+	fork, err := state.Fork()
+	if err != nil {
+		return nil, err
+	}
+	genesisValRoot := p.Chain.Genesis().ValidatorsRoot
+	digest := common.ComputeForkDigest(fork.CurrentVersion, genesisValRoot)
+
+	// The deposits to include depend on the eth1 data after the vote of this block.
+	if err := phase0.ProcessEth1Vote(ctx, p.Spec, epc, state, in.Eth1Data); err != nil {
+		return nil, fmt.Errorf("failed to process eth1 vote: %v", err)
+	}
+	ops, err := p.selectOperations(ctx, epc, state, in.Deposits)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed interface {
+		Envelope(spec *common.Spec, digest common.ForkDigest) *common.BeaconBlockEnvelope
+	}
+	var block common.SpecObj
+	switch s := state.(type) {
+	case *phase0.BeaconStateView:
+		b := &phase0.SignedBeaconBlock{Message: phase0.BeaconBlock{
+			Slot:          in.Slot,
+			ProposerIndex: proposer,
+			ParentRoot:    parent,
+			Body: phase0.BeaconBlockBody{
+				RandaoReveal:      in.RandaoReveal,
+				Eth1Data:          in.Eth1Data,
+				Graffiti:          in.Graffiti,
+				ProposerSlashings: ops.proposerSlashings,
+				AttesterSlashings: ops.attesterSlashings,
+				Attestations:      ops.attestations,
+				Deposits:          ops.deposits,
+				VoluntaryExits:    ops.voluntaryExits,
+			},
+		}}
+		signed, block = b, &b.Message
+	case *altair.BeaconStateView:
+		b := &altair.SignedBeaconBlock{Message: altair.BeaconBlock{
+			Slot:          in.Slot,
+			ProposerIndex: proposer,
+			ParentRoot:    parent,
+			Body: altair.BeaconBlockBody{
+				RandaoReveal:      in.RandaoReveal,
+				Eth1Data:          in.Eth1Data,
+				Graffiti:          in.Graffiti,
+				ProposerSlashings: ops.proposerSlashings,
+				AttesterSlashings: ops.attesterSlashings,
+				Attestations:      ops.attestations,
+				Deposits:          ops.deposits,
+				VoluntaryExits:    ops.voluntaryExits,
+				SyncAggregate:     p.syncAggregate(in),
+			},
+		}}
+		signed, block = b, &b.Message
+	case *bellatrix.BeaconStateView:
+		payload, err := p.executionPayload(s, in)
+		if err != nil {
+			return nil, err
+		}
+		b := &bellatrix.SignedBeaconBlock{Message: bellatrix.BeaconBlock{
+			Slot:          in.Slot,
+			ProposerIndex: proposer,
+			ParentRoot:    parent,
+			Body: bellatrix.BeaconBlockBody{
+				RandaoReveal:      in.RandaoReveal,
+				Eth1Data:          in.Eth1Data,
+				Graffiti:          in.Graffiti,
+				ProposerSlashings: ops.proposerSlashings,
+				AttesterSlashings: ops.attesterSlashings,
+				Attestations:      ops.attestations,
+				Deposits:          ops.deposits,
+				VoluntaryExits:    ops.voluntaryExits,
+				SyncAggregate:     p.syncAggregate(in),
+				ExecutionPayload:  *payload,
+			},
+		}}
+		signed, block = b, &b.Message
+	default:
+		return nil, fmt.Errorf("block production is not supported for state type %T", state)
+	}
+
+	// Process the block with a zero state root and signature, to compute the state root.
+	benv := signed.Envelope(p.Spec, digest)
+	postState, stateRoot, err := p.Chain.SimulateBlock(ctx, benv, false)
+	if err != nil {
+		return nil, fmt.Errorf("produced block is invalid: %v", err)
+	}
+	switch b := block.(type) {
+	case *phase0.BeaconBlock:
+		b.StateRoot = stateRoot
+	case *altair.BeaconBlock:
+		b.StateRoot = stateRoot
+	case *bellatrix.BeaconBlock:
+		b.StateRoot = stateRoot
+	}
+	return &Result{
+		Block:      block,
+		BlockRoot:  block.HashTreeRoot(p.Spec, tree.GetHashFn()),
+		ForkDigest: digest,
+		Domain:     common.ComputeDomain(common.DOMAIN_BEACON_PROPOSER, fork.CurrentVersion, genesisValRoot),
+		PostState:  postState,
+	}, nil
+}
+
+// tryApply applies the operation to a copy of the state, and returns the copy if the operation is valid.
+func tryApply(state common.BeaconState, apply func(state common.BeaconState) error) (common.BeaconState, bool) {
+	next, err := state.CopyState()
+	if err != nil {
+		return state, false
+	}
+	if err := apply(next); err != nil {
+		return state, false
+	}
+	return next, true
+}
+
+// selectOperations selects the operations to include, in the order of block processing,
+// by applying them to the state, which is modified.
+func (p *Producer) selectOperations(ctx context.Context, epc *common.EpochsContext, state common.BeaconState,
+	deposits []common.Deposit) (*operations, error) {
+	var ops operations
+	if p.Pools.ProposerSlashings != nil {
+		for _, sl := range p.Pools.ProposerSlashings.All() {
+			if uint64(len(ops.proposerSlashings)) >= uint64(p.Spec.MAX_PROPOSER_SLASHINGS) {
+				break
+			}
+			var ok bool
+			if state, ok = tryApply(state, func(state common.BeaconState) error {
+				return phase0.ProcessProposerSlashing(p.Spec, epc, state, sl)
+			}); ok {
+				ops.proposerSlashings = append(ops.proposerSlashings, *sl)
+			}
+		}
+	}
+	if p.Pools.AttesterSlashings != nil {
+		for _, sl := range p.Pools.AttesterSlashings.All() {
+			if uint64(len(ops.attesterSlashings)) >= uint64(p.Spec.MAX_ATTESTER_SLASHINGS) {
+				break
+			}
+			var ok bool
+			if state, ok = tryApply(state, func(state common.BeaconState) error {
+				return phase0.ProcessAttesterSlashing(p.Spec, epc, state, sl)
+			}); ok {
+				ops.attesterSlashings = append(ops.attesterSlashings, *sl)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if p.Pools.Attestations != nil {
+		var err error
+		if state, err = p.selectAttestations(epc, state, &ops); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	eth1Data, err := state.Eth1Data()
+	if err != nil {
+		return nil, err
+	}
+	depIndex, err := state.Eth1DepositIndex()
+	if err != nil {
+		return nil, err
+	}
+	required := uint64(0)
+	if eth1Data.DepositCount > depIndex {
+		required = uint64(eth1Data.DepositCount - depIndex)
+	}
+	if required > uint64(p.Spec.MAX_DEPOSITS) {
+		required = uint64(p.Spec.MAX_DEPOSITS)
+	}
+	if uint64(len(deposits)) < required {
+		return nil, fmt.Errorf("block requires %d deposits, starting at deposit index %d, got %d",
+			required, depIndex, len(deposits))
+	}
+	for i := uint64(0); i < required; i++ {
+		if err := phase0.ProcessDeposit(p.Spec, epc, state, &deposits[i], false); err != nil {
+			return nil, fmt.Errorf("invalid deposit %d: %v", uint64(depIndex)+i, err)
+		}
+		ops.deposits = append(ops.deposits, deposits[i])
+	}
+	if p.Pools.VoluntaryExits != nil {
+		for _, exit := range p.Pools.VoluntaryExits.All() {
+			if uint64(len(ops.voluntaryExits)) >= uint64(p.Spec.MAX_VOLUNTARY_EXITS) {
+				break
+			}
+			var ok bool
+			if state, ok = tryApply(state, func(state common.BeaconState) error {
+				return phase0.ProcessVoluntaryExit(p.Spec, epc, state, exit)
+			}); ok {
+				ops.voluntaryExits = append(ops.voluntaryExits, *exit)
+			}
+		}
+	}
+	return &ops, nil
+}
+
+// selectAttestations selects the attestations with the most participants,
+// skipping those that are covered by an already selected attestation of the same data.
+func (p *Producer) selectAttestations(epc *common.EpochsContext, state common.BeaconState, ops *operations) (common.BeaconState, error) {
+	slot, err := state.Slot()
+	if err != nil {
+		return nil, err
+	}
+	var apply func(state common.BeaconState, att *phase0.Attestation) error
+	switch state.(type) {
+	case phase0.Phase0PendingAttestationsBeaconState:
+		apply = func(state common.BeaconState, att *phase0.Attestation) error {
+			return phase0.ProcessAttestation(p.Spec, epc, state.(phase0.Phase0PendingAttestationsBeaconState), att)
+		}
+	case altair.AltairLikeBeaconState:
+		apply = func(state common.BeaconState, att *phase0.Attestation) error {
+			return altair.ProcessAttestation(p.Spec, epc, state.(altair.AltairLikeBeaconState), att)
+		}
+	default:
+		return nil, fmt.Errorf("attestation processing is not supported for state type %T", state)
+	}
+	currentEpoch := p.Spec.SlotToEpoch(slot)
+	var candidates []*phase0.Attestation
+	for _, att := range p.Pools.Attestations.Search() {
+		if att.Data.Slot+p.Spec.MIN_ATTESTATION_INCLUSION_DELAY > slot {
+			continue
+		}
+		if att.Data.Target.Epoch != currentEpoch && att.Data.Target.Epoch != currentEpoch.Previous() {
+			continue
+		}
+		candidates = append(candidates, att)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].AggregationBits.OnesCount() > candidates[j].AggregationBits.OnesCount()
+	})
+	selected := make(map[common.Root][]phase0.AttestationBits)
+	for _, att := range candidates {
+		if uint64(len(ops.attestations)) >= uint64(p.Spec.MAX_ATTESTATIONS) {
+			break
+		}
+		dataRoot := att.Data.HashTreeRoot(tree.GetHashFn())
+		if covered(selected[dataRoot], att.AggregationBits) {
+			continue
+		}
+		var ok bool
+		if state, ok = tryApply(state, func(state common.BeaconState) error {
+			return apply(state, att)
+		}); ok {
+			ops.attestations = append(ops.attestations, *att)
+			selected[dataRoot] = append(selected[dataRoot], att.AggregationBits)
+		}
+	}
+	return state, nil
+}
+
+func covered(selected []phase0.AttestationBits, bits phase0.AttestationBits) bool {
+	for _, s := range selected {
+		if ok, err := s.Covers(bits); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Producer) syncAggregate(in *BlockInputs) altair.SyncAggregate {
+	if in.SyncAggregate != nil {
+		return *in.SyncAggregate
+	}
+	// Without participants the signature is the point at infinity.
+	return altair.SyncAggregate{
+		SyncCommitteeBits:      make(altair.SyncCommitteeBits, (p.Spec.SYNC_COMMITTEE_SIZE+7)/8),
+		SyncCommitteeSignature: common.BLSSignature{0xc0},
+	}
+}
+
+func (p *Producer) executionPayload(state *bellatrix.BeaconStateView, in *BlockInputs) (*common.ExecutionPayload, error) {
+	if in.ExecutionPayload != nil {
+		return in.ExecutionPayload, nil
+	}
+	completed, err := state.IsTransitionCompleted()
+	if err != nil {
+		return nil, err
+	}
+	if completed {
+		return nil, errors.New("an execution payload is required after the merge transition")
+	}
+	return &common.ExecutionPayload{}, nil
+}
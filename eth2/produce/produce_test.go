@@ -0,0 +1,179 @@
+package produce
+
+import (
+	"context"
+	"testing"
+
+	blsu "github.com/protolambda/bls12-381-util"
+	"github.com/protolambda/zrnt/eth2/beacon/altair"
+	"github.com/protolambda/zrnt/eth2/beacon/bellatrix"
+	"github.com/protolambda/zrnt/eth2/beacon/common"
+	"github.com/protolambda/zrnt/eth2/beacon/phase0"
+	"github.com/protolambda/zrnt/eth2/chain"
+	"github.com/protolambda/zrnt/eth2/db/states"
+	"github.com/protolambda/zrnt/eth2/internal/chaintest"
+	"github.com/protolambda/zrnt/eth2/pool"
+	"github.com/protolambda/ztyp/tree"
+)
+
+func testSign(t testing.TB, index common.ValidatorIndex, root common.Root, dom common.BLSDomain) common.BLSSignature {
+	return chaintest.Sign(t, index, common.ComputeSigningRoot(root, dom))
+}
+
+func TestProduceBlock(t *testing.T) {
+	ctx := context.Background()
+	spec := chaintest.Spec()
+	ch, err := chain.NewHotColdChain(chaintest.Genesis(t, spec), spec, states.NewMemDB(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisValRoot := ch.Genesis().ValidatorsRoot
+	domain := func(typ common.BLSDomainType, slot common.Slot) common.BLSDomain {
+		return common.ComputeDomain(typ, spec.ForkVersion(slot), genesisValRoot)
+	}
+	pools := Pools{
+		Attestations:      pool.NewAttestationPool(spec),
+		ProposerSlashings: pool.NewProposerSlashingPool(spec),
+	}
+	producer := NewProducer(spec, ch, pools)
+
+	produce := func(slot common.Slot) *Result {
+		head, err := ch.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pre, err := ch.Towards(ctx, head.BlockRoot(), slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		epc, err := pre.EpochsContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proposer, err := epc.GetBeaconProposer(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := pre.State(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eth1Data, err := state.Eth1Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		epoch := spec.SlotToEpoch(slot)
+		res, err := producer.ProduceBlock(ctx, &BlockInputs{
+			Slot:         slot,
+			RandaoReveal: testSign(t, proposer, epoch.HashTreeRoot(tree.GetHashFn()), domain(common.DOMAIN_RANDAO, slot)),
+			Eth1Data:     eth1Data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		benv := res.Signed(spec, testSign(t, proposer, res.BlockRoot, res.Domain))
+		if benv.BlockRoot != res.BlockRoot {
+			t.Fatal("signed block has a different root")
+		}
+		if err := ch.AddBlock(ctx, benv); err != nil {
+			t.Fatalf("failed to add produced block at slot %d: %v", slot, err)
+		}
+		entry, ok := ch.ByBlock(res.BlockRoot)
+		if !ok {
+			t.Fatal("cannot find produced block")
+		}
+		if entry.StateRoot() != res.PostState.HashTreeRoot(tree.GetHashFn()) {
+			t.Fatal("post-state of produced block does not match the chain")
+		}
+		return res
+	}
+
+	block1 := produce(1).Block.(*phase0.BeaconBlock)
+
+	// An aggregate attestation for block 1, and a proposer slashing, to include in block 2.
+	genesis, ok := ch.ByCanonStep(chain.AsStep(0, true))
+	if !ok {
+		t.Fatal("cannot find genesis")
+	}
+	entry, ok := ch.ByBlock(block1.HashTreeRoot(spec, tree.GetHashFn()))
+	if !ok {
+		t.Fatal("cannot find block 1")
+	}
+	epc, err := entry.EpochsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := epc.GetBeaconCommittee(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := phase0.AttestationData{
+		Slot:            1,
+		BeaconBlockRoot: entry.BlockRoot(),
+		Target:          common.Checkpoint{Root: genesis.BlockRoot()},
+	}
+	bits := phase0.AttestationBits(make([]byte, len(committee)/8+1))
+	sigs := make([]*blsu.Signature, 0, len(committee))
+	for i, index := range committee {
+		bits.SetBit(uint64(i), true)
+		sig := testSign(t, index, data.HashTreeRoot(tree.GetHashFn()), domain(common.DOMAIN_BEACON_ATTESTER, 1))
+		s, err := sig.Signature()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, s)
+	}
+	bits[len(committee)/8] |= 1 << (len(committee) % 8)
+	aggSig, err := blsu.Aggregate(sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	att := &phase0.Attestation{AggregationBits: bits, Data: data, Signature: aggSig.Serialize()}
+	if err := pools.Attestations.AddAttestation(att, committee); err != nil {
+		t.Fatal(err)
+	}
+
+	slashed := common.ValidatorIndex(3)
+	header := func(graffiti byte) common.SignedBeaconBlockHeader {
+		h := common.BeaconBlockHeader{Slot: 1, ProposerIndex: slashed, BodyRoot: common.Root{graffiti}}
+		return common.SignedBeaconBlockHeader{
+			Message:   h,
+			Signature: testSign(t, slashed, h.HashTreeRoot(tree.GetHashFn()), domain(common.DOMAIN_BEACON_PROPOSER, 1)),
+		}
+	}
+	pools.ProposerSlashings.AddProposerSlashing(&phase0.ProposerSlashing{SignedHeader1: header(1), SignedHeader2: header(2)})
+
+	res2 := produce(2)
+	block2 := res2.Block.(*phase0.BeaconBlock)
+	if len(block2.Body.Attestations) != 1 {
+		t.Fatalf("expected 1 attestation, got %d", len(block2.Body.Attestations))
+	}
+	if len(block2.Body.ProposerSlashings) != 1 {
+		t.Fatalf("expected 1 proposer slashing, got %d", len(block2.Body.ProposerSlashings))
+	}
+	vals, err := res2.PostState.Validators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := vals.Validator(slashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := val.Slashed(); err != nil || !ok {
+		t.Fatal("expected validator to be slashed")
+	}
+
+	// The slashing is not valid anymore, and the attestation is outside of the inclusion range: both are skipped.
+	altairSlot, _ := spec.EpochStartSlot(spec.ALTAIR_FORK_EPOCH)
+	block3, ok := produce(altairSlot + 2).Block.(*altair.BeaconBlock)
+	if !ok {
+		t.Fatal("expected altair block")
+	}
+	if len(block3.Body.ProposerSlashings) != 0 || len(block3.Body.Attestations) != 0 {
+		t.Fatal("expected no operations in altair block")
+	}
+	bellatrixSlot, _ := spec.EpochStartSlot(spec.BELLATRIX_FORK_EPOCH)
+	if _, ok := produce(bellatrixSlot).Block.(*bellatrix.BeaconBlock); !ok {
+		t.Fatal("expected bellatrix block")
+	}
+}